@@ -4,22 +4,36 @@ import (
 	"encoding/json"
 	"fmt"
 	"html/template"
+	"image"
 	"log"
 	"net/http"
+	"path/filepath"
 	"regexp"
 	"strconv"
+	"strings"
+	"time"
 	"udemy_drone/go_tello_edu/app/models"
 	"udemy_drone/go_tello_edu/config"
 )
 
 var appContext struct {
-	DroneManager   *models.DroneManager
-	DefaultCourses map[int]models.BaseCourse
+	DroneManager *models.DroneManager
+	Courses      *models.CourseRegistry
+	CourseRunner *models.CourseRunner
+	ShakeGame    *models.ShakeGame
 }
 
 func init() {
 	appContext.DroneManager = models.NewDroneManager()
-	appContext.DefaultCourses = models.NewDefaultCourse(appContext.DroneManager)
+	appContext.Courses = models.NewCourseRegistry(config.Config.MissionsDir, appContext.DroneManager)
+	appContext.CourseRunner = models.NewCourseRunner(appContext.DroneManager)
+	appContext.ShakeGame = models.NewShakeGame(appContext.CourseRunner, appContext.Courses,
+		config.Config.LeaderboardFile)
+}
+
+// シグナルを受けて終了する前に呼び出す
+func Shutdown() {
+	appContext.DroneManager.Shutdown()
 }
 
 func getTemplate(temp string) (*template.Template, error) {
@@ -46,6 +60,26 @@ func viewControllerHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func viewShakeHandler(w http.ResponseWriter, r *http.Request) {
+	t, err := getTemplate("app/views/shake.html")
+	if err != nil {
+		panic(err.Error())
+	}
+	if err := t.Execute(w, nil); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func viewCoursesHandler(w http.ResponseWriter, r *http.Request) {
+	t, err := getTemplate("app/views/courses.html")
+	if err != nil {
+		panic(err.Error())
+	}
+	if err := t.Execute(w, nil); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 type APIResult struct {
 	Result interface{} `json:"result"`
 	Code   int         `json:"code"`
@@ -63,7 +97,7 @@ func APIResponse(w http.ResponseWriter, result interface{}, code int) {
 	w.Write(js)
 }
 
-var apiValidPath = regexp.MustCompile("^/api/(command|shake|video)")
+var apiValidPath = regexp.MustCompile("^/api/(command|shake|video|connection|telemetry|flights|watchdog|emergency|runner|courses|leaderboard|patrol|control|detector|target|recordings)")
 
 // http.handlerFuncを返すWrapperみたいな役割
 func apiMakeHandler(fn func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
@@ -91,100 +125,717 @@ func getSpeed(r *http.Request) int {
 	return speed
 }
 
+// HTTPリクエストから巡回パターンを取得
+// patternで組み込みのパターンを選ぶか、legsにJSONで区間のリストを渡す。loopsで繰り返す回数を変更できる
+func getPatrolPattern(r *http.Request) (models.PatrolPattern, error) {
+	var pattern models.PatrolPattern
+	if legs := r.FormValue("legs"); legs != "" {
+		pattern.Name = r.FormValue("pattern")
+		if pattern.Name == "" {
+			pattern.Name = "custom"
+		}
+		if err := json.Unmarshal([]byte(legs), &pattern.Legs); err != nil {
+			return pattern, fmt.Errorf("%w: %s", models.ErrInvalidPatrol, err.Error())
+		}
+	} else {
+		name := r.FormValue("pattern")
+		if name == "" {
+			name = "square"
+		}
+		var err error
+		if pattern, err = models.PatrolPatternByName(name); err != nil {
+			return pattern, err
+		}
+	}
+	if strLoops := r.FormValue("loops"); strLoops != "" {
+		loops, err := strconv.Atoi(strLoops)
+		if err != nil {
+			return pattern, fmt.Errorf("%w: loops must be a number", models.ErrInvalidPatrol)
+		}
+		pattern.Loops = loops
+	}
+	return pattern, pattern.Validate()
+}
+
 // リクエストされたAPIのハンドラー(ログ出力、APIのレスポンスのWrapper)
 func apiCommandHandler(w http.ResponseWriter, r *http.Request) {
 	command := r.FormValue("command")
 	log.Printf("action=apiCommandHandler command=%s", command)
 	drone := appContext.DroneManager
+	// 移動コマンドは手動操作として送り、コースや巡回より優先する
+	manual := drone.Control.Drone(models.BehaviorManual)
+	var err error
 	switch command {
 	case "ceaseRotation":
-		drone.CeaseRotation()
+		manual.CeaseRotation()
 	case "takeOff":
-		drone.TakeOff()
+		if err = manual.TakeOff(); err == nil {
+			drone.FlightLog.Begin()
+		}
 	case "land":
-		drone.Land()
+		err = drone.Land()
 	case "hover":
-		drone.Hover()
+		manual.Hover()
 	case "up":
-		drone.Up(drone.Speed)
+		err = manual.Up(drone.CurrentSpeed())
 	case "clockwise":
-		drone.Clockwise(drone.Speed)
+		err = manual.Clockwise(drone.CurrentSpeed())
 	case "counterClockwise":
-		drone.CounterClockwise(drone.Speed)
+		err = manual.CounterClockwise(drone.CurrentSpeed())
 	case "down":
-		drone.Down(drone.Speed)
+		err = manual.Down(drone.CurrentSpeed())
 	case "forward":
-		drone.Forward(drone.Speed)
+		err = manual.Forward(drone.CurrentSpeed())
 	case "left":
-		drone.Left(drone.Speed)
+		err = manual.Left(drone.CurrentSpeed())
 	case "right":
-		drone.Right(drone.Speed)
+		err = manual.Right(drone.CurrentSpeed())
 	case "backward":
-		drone.Backward(drone.Speed)
+		err = manual.Backward(drone.CurrentSpeed())
 	case "frontFlip":
-		drone.FrontFlip()
+		err = manual.FrontFlip()
 	case "backFlip":
-		drone.BackFlip()
+		err = manual.BackFlip()
 	case "leftFlip":
-		drone.LeftFlip()
+		err = manual.LeftFlip()
 	case "rightFlip":
-		drone.RightFlip()
+		err = manual.RightFlip()
 	case "bounce":
-		drone.Bounce()
+		err = manual.Bounce()
 	case "throwTakeOff":
-		drone.ThrowTakeOff()
+		if err = manual.ThrowTakeOff(); err == nil {
+			drone.FlightLog.Begin()
+		}
 	case "patrol":
-		drone.StartPatrol()
+		if !drone.IsConnected() {
+			err = models.ErrNotConnected
+			break
+		}
+		pattern, perr := getPatrolPattern(r)
+		if perr != nil {
+			APIResponse(w, perr.Error(), http.StatusBadRequest)
+			return
+		}
+		err = drone.Patrol.Start(pattern)
 	case "stopPatrol":
-		drone.StopPatrol()
+		drone.Patrol.Stop()
 	case "speed":
-		drone.Speed = getSpeed(r)
-		log.Printf("スピードを%dに変更しました", drone.Speed)
+		drone.SetSpeed(getSpeed(r))
+		log.Printf("スピードを%dに変更しました", drone.CurrentSpeed())
 	case "startFaceDetectTrack":
 		drone.EnableFaceDetectTracking()
 	case "stopFaceDetectTrack":
 		drone.DisableFaceDetectTracking()
 	case "snapshot":
 		drone.TakeSnapshot()
+	case "startRecording":
+		annotated := config.Config.RecordingAnnotated
+		if str := r.FormValue("annotated"); str != "" {
+			annotated, _ = strconv.ParseBool(str)
+		}
+		err = drone.Recorder.Start(annotated)
+	case "stopRecording":
+		_, err = drone.Recorder.Stop()
 	default:
 		APIResponse(w, "Command not found", http.StatusNotFound)
 		return
 	}
+	logCommand(drone, command, r, err)
+	if err != nil {
+		log.Printf("action=apiCommandHandler command=%s err=%s", command, err.Error())
+		code := http.StatusInternalServerError
+		switch err {
+		case models.ErrNotConnected:
+			code = http.StatusServiceUnavailable
+		case models.ErrTakeOffRefused, models.ErrGeofence, models.ErrNotInControl,
+			models.ErrRecording, models.ErrNotRecording:
+			code = http.StatusConflict
+		case models.ErrNoVideoFrame:
+			code = http.StatusServiceUnavailable
+		case models.ErrEmergencyStop:
+			code = http.StatusLocked
+		}
+		APIResponse(w, err.Error(), code)
+		return
+	}
+	APIResponse(w, "OK", http.StatusOK)
+}
+
+// 緊急停止
+// コースや巡回の処理を待たずに全ての自律動作を止めて着陸する
+func apiEmergencyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		APIResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	drone := appContext.DroneManager
+	err := drone.Emergency()
+	logCommand(drone, "emergency", r, err)
+	if err != nil {
+		// 着陸コマンドは再接続後に再送される
+		log.Printf("action=apiEmergencyHandler err=%s", err.Error())
+		code := http.StatusInternalServerError
+		if err == models.ErrNotConnected {
+			code = http.StatusServiceUnavailable
+		}
+		APIResponse(w, err.Error(), code)
+		return
+	}
 	APIResponse(w, "OK", http.StatusOK)
 }
 
+// フライトログに記録するコマンドの内容
+type commandLog struct {
+	Command string `json:"command"`
+	Speed   int    `json:"speed"`
+	Remote  string `json:"remote"`
+	Error   string `json:"error,omitempty"`
+}
+
+func logCommand(drone *models.DroneManager, command string, r *http.Request, err error) {
+	entry := commandLog{Command: command, Speed: drone.CurrentSpeed(), Remote: r.RemoteAddr}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	drone.FlightLog.Record(models.LogCommand, entry)
+}
+
+func apiConnectionHandler(w http.ResponseWriter, r *http.Request) {
+	APIResponse(w, appContext.DroneManager.ConnectionStatus(), http.StatusOK)
+}
+
+// Server-Sent Eventsでイベントを書き込む
+func writeSSE(w http.ResponseWriter, event string, data interface{}) error {
+	js, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, js)
+	return err
+}
+
+// FlightDataの更新をServer-Sent Eventsで配信し続ける
+func apiTelemetryHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		APIResponse(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	drone := appContext.DroneManager
+	events, unsubscribe := drone.SubscribeEvents()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	// 接続直後に現在の状態を送る
+	if err := writeSSE(w, models.TelemetryEvent, drone.Telemetry()); err != nil {
+		return
+	}
+	if notice := drone.Safety.LastNotice(); notice != nil {
+		if err := writeSSE(w, models.SafetyEvent, notice); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if err := writeSSE(w, e.Name, e.Data); err != nil {
+				log.Printf("action=apiTelemetryHandler err=%s", err.Error())
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// 操縦画面のデッドマンスイッチ
+// command=enableでセッションを開始し、heartbeatをtimeoutより短い間隔で送り続ける
+// enableのland=trueでタイムアウト時にホバリングではなく着陸する(省略時は設定ファイルの値)
+func apiWatchdogHandler(w http.ResponseWriter, r *http.Request) {
+	watchdog := appContext.DroneManager.Watchdog
+	session := r.FormValue("session")
+	switch command := r.FormValue("command"); command {
+	case "enable":
+		var timeout time.Duration
+		if sec, err := strconv.ParseFloat(r.FormValue("timeout"), 64); err == nil {
+			timeout = time.Duration(sec * float64(time.Second))
+		}
+		var land *bool
+		if v := r.FormValue("land"); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				APIResponse(w, "land must be true or false", http.StatusBadRequest)
+				return
+			}
+			land = &b
+		}
+		APIResponse(w, watchdog.Enable(timeout, land), http.StatusOK)
+	case "heartbeat":
+		s, err := watchdog.Heartbeat(session)
+		if err != nil {
+			APIResponse(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		APIResponse(w, s, http.StatusOK)
+	case "disable":
+		if err := watchdog.Disable(session); err != nil {
+			APIResponse(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		APIResponse(w, "OK", http.StatusOK)
+	default:
+		APIResponse(w, "Command not found", http.StatusNotFound)
+	}
+}
+
+// クエリのidからコースを取得する
+func getCourse(r *http.Request) (int, models.BaseCourse, error) {
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		return 0, nil, err
+	}
+	course, err := appContext.Courses.Course(id)
+	if err != nil {
+		return 0, nil, err
+	}
+	return id, course, nil
+}
+
+func shakeErrorCode(err error) int {
+	switch err {
+	case models.ErrCourseNotFound, models.ErrShakeSessionNotFound:
+		return http.StatusNotFound
+	case models.ErrPlayerNameRequired:
+		return http.StatusBadRequest
+	case models.ErrRunnerBusy, models.ErrShakeSessionInactive:
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// シェイクゲームを開始する(/api/shake/start/?id=コース&player=名前)
+// コースはサーバー側のCourseRunnerが進め、shakes条件のステップは振った回数で進む
 func apiStartShakeHandler(w http.ResponseWriter, r *http.Request) {
-	query := r.URL.Query()
-	strId := query.Get("id")
-	id, err := strconv.Atoi(strId)
+	id, err := strconv.Atoi(r.FormValue("id"))
 	if err != nil {
 		APIResponse(w, err.Error(), http.StatusNotFound)
 		return
 	}
-	course := appContext.DefaultCourses[id]
-	course.Start()
-	APIResponse(w, "started", http.StatusOK)
+	session, err := appContext.ShakeGame.Start(r.FormValue("player"), id)
+	if err != nil {
+		APIResponse(w, err.Error(), shakeErrorCode(err))
+		return
+	}
+	APIResponse(w, session, http.StatusOK)
 }
 
+// スマートフォンを振るたびに呼ぶ(/api/shake/run/?session=ID)
 func apiRunShakeHandler(w http.ResponseWriter, r *http.Request) {
-	query := r.URL.Query()
-	strId := query.Get("id")
-	id, err := strconv.Atoi(strId)
+	session, err := appContext.ShakeGame.Shake(r.FormValue("session"))
+	if err != nil {
+		APIResponse(w, err.Error(), shakeErrorCode(err))
+		return
+	}
+	APIResponse(w, session, http.StatusOK)
+}
+
+func apiShakeStatusHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := appContext.ShakeGame.Session(r.FormValue("session"))
+	if err != nil {
+		APIResponse(w, err.Error(), shakeErrorCode(err))
+		return
+	}
+	APIResponse(w, session, http.StatusOK)
+}
+
+// /api/leaderboard?course=ID&limit=10 (courseを省略すると全てのコース)
+func apiLeaderboardHandler(w http.ResponseWriter, r *http.Request) {
+	courseID, _ := strconv.Atoi(r.FormValue("course"))
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil {
+		limit = 10
+	}
+	APIResponse(w, appContext.ShakeGame.Leaderboard.Top(courseID, limit), http.StatusOK)
+}
+
+// どの動作が機体を操作しているか
+func apiControlHandler(w http.ResponseWriter, r *http.Request) {
+	APIResponse(w, appContext.DroneManager.Control.Status(), http.StatusOK)
+}
+
+type patrolResult struct {
+	Status   models.PatrolStatus    `json:"status"`
+	Patterns []models.PatrolPattern `json:"patterns"`
+}
+
+// 巡回の進み具合と選べるパターン
+func apiPatrolHandler(w http.ResponseWriter, r *http.Request) {
+	APIResponse(w, patrolResult{
+		Status:   appContext.DroneManager.Patrol.Status(),
+		Patterns: models.PatrolPatterns(),
+	}, http.StatusOK)
+}
+
+type videoResult struct {
+	Decoder models.DecoderStatus `json:"decoder"`
+	Frames  models.FrameBusStats `json:"frames"`
+}
+
+// 映像のデコーダーの状態(FPS、再起動回数、ffmpegのstderr)と、フレームの配信状況
+func apiVideoHandler(w http.ResponseWriter, r *http.Request) {
+	drone := appContext.DroneManager
+	APIResponse(w, videoResult{Decoder: drone.DecoderStatus(), Frames: drone.Frames.Stats()}, http.StatusOK)
+}
+
+type detectorResult struct {
+	Detector models.DetectorConfig `json:"detector"`
+	Types    []string              `json:"types"`
+}
+
+// GET  /api/detector/ 使用中の検出器
+// POST /api/detector/ 検出器を切り替える
+// ボディのJSONは使用中の設定に上書きする({"type": "color"}だけでもよい)
+// ファイルはconfig.iniのmodels_dir内の名前で指定する
+func apiDetectorHandler(w http.ResponseWriter, r *http.Request) {
+	drone := appContext.DroneManager
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		conf := drone.CurrentDetector()
+		if err := json.NewDecoder(r.Body).Decode(&conf); err != nil {
+			APIResponse(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := drone.UpdateDetector(conf); err != nil {
+			log.Printf("action=apiDetectorHandler type=%s err=%s", conf.Type, err.Error())
+			APIResponse(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		APIResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	APIResponse(w, detectorResult{Detector: drone.CurrentDetector(), Types: models.DetectorTypes}, http.StatusOK)
+}
+
+type targetResult struct {
+	Status     models.TargetStatus `json:"status"`
+	Modes      []string            `json:"modes"`
+	Algorithms []string            `json:"algorithms"`
+}
+
+// 追跡する物体のロック
+// command=lockでx, y(映像の座標)にある物体をロックする。w, hを指定するとその範囲をロックする
+// command=configでmode, algorithm, redetect, lost_timeout(秒)を変更する
+func apiTargetHandler(w http.ResponseWriter, r *http.Request) {
+	target := appContext.DroneManager.Target
+	var err error
+	switch command := r.FormValue("command"); command {
+	case "", "status":
+	case "lock":
+		x, xerr := strconv.Atoi(r.FormValue("x"))
+		y, yerr := strconv.Atoi(r.FormValue("y"))
+		if xerr != nil || yerr != nil {
+			APIResponse(w, "x and y must be numbers", http.StatusBadRequest)
+			return
+		}
+		width, _ := strconv.Atoi(r.FormValue("w"))
+		height, _ := strconv.Atoi(r.FormValue("h"))
+		err = target.Lock(image.Pt(x, y), image.Pt(width, height))
+	case "unlock":
+		target.Unlock()
+	case "config":
+		conf := target.Status().TargetConfig
+		if mode := r.FormValue("mode"); mode != "" {
+			conf.Mode = mode
+		}
+		if algorithm := r.FormValue("algorithm"); algorithm != "" {
+			conf.Algorithm = algorithm
+		}
+		if sec, perr := strconv.ParseFloat(r.FormValue("redetect"), 64); perr == nil {
+			conf.Redetect = time.Duration(sec * float64(time.Second))
+		}
+		if sec, perr := strconv.ParseFloat(r.FormValue("lost_timeout"), 64); perr == nil {
+			conf.LostTimeout = time.Duration(sec * float64(time.Second))
+		}
+		err = target.SetConfig(conf)
+	default:
+		APIResponse(w, "Command not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("action=apiTargetHandler err=%s", err.Error())
+		code := http.StatusBadRequest
+		switch err {
+		case models.ErrNoTarget:
+			code = http.StatusNotFound
+		case models.ErrNoVideoFrame:
+			code = http.StatusServiceUnavailable
+		}
+		APIResponse(w, err.Error(), code)
+		return
+	}
+	APIResponse(w, targetResult{
+		Status:     target.Status(),
+		Modes:      models.TargetModes,
+		Algorithms: models.TrackerAlgorithms,
+	}, http.StatusOK)
+}
+
+// /api/runner/{start,pause,resume,abort,status}/
+func apiRunnerHandler(w http.ResponseWriter, r *http.Request) {
+	runner := appContext.CourseRunner
+	action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/runner"), "/")
+	var err error
+	switch action {
+	case "start":
+		id, course, err := getCourse(r)
+		if err != nil {
+			APIResponse(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err := runner.Start(id, course); err != nil {
+			APIResponse(w, err.Error(), http.StatusConflict)
+			return
+		}
+	case "pause":
+		err = runner.Pause()
+	case "resume":
+		err = runner.Resume()
+	case "abort":
+		err = runner.Abort()
+	case "status":
+	default:
+		APIResponse(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		APIResponse(w, err.Error(), http.StatusConflict)
+		return
+	}
+	APIResponse(w, runner.Status(), http.StatusOK)
+}
+
+// リクエストボディのJSONからミッションを読み込んで検証する
+func decodeMission(r *http.Request) (*models.Mission, error) {
+	m := &models.Mission{}
+	if err := json.NewDecoder(r.Body).Decode(m); err != nil {
+		return nil, err
+	}
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func courseErrorCode(err error) int {
+	switch err {
+	case models.ErrCourseNotFound:
+		return http.StatusNotFound
+	case models.ErrCourseExists, models.ErrCourseRunning:
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// GET    /api/courses           一覧
+// POST   /api/courses           作成
+// POST   /api/courses/validate  保存せずに検証
+// GET    /api/courses/{id}      取得
+// PUT    /api/courses/{id}      更新
+// DELETE /api/courses/{id}      削除
+func apiCoursesHandler(w http.ResponseWriter, r *http.Request) {
+	courses := appContext.Courses
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/courses"), "/")
+
+	if path == "dryrun" || strings.HasSuffix(path, "/dryrun") {
+		apiCourseDryRunHandler(w, r, strings.TrimSuffix(path, "dryrun"))
+		return
+	}
+	if path == "" || path == "validate" {
+		switch {
+		case path == "" && r.Method == http.MethodGet:
+			APIResponse(w, courses.List(), http.StatusOK)
+		case r.Method == http.MethodPost:
+			m, err := decodeMission(r)
+			if err != nil {
+				APIResponse(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if path == "validate" {
+				APIResponse(w, m, http.StatusOK)
+				return
+			}
+			m, err = courses.Create(m)
+			if err != nil {
+				APIResponse(w, err.Error(), courseErrorCode(err))
+				return
+			}
+			APIResponse(w, m, http.StatusCreated)
+		default:
+			APIResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	id, err := strconv.Atoi(path)
+	if err != nil {
+		APIResponse(w, "Not found", http.StatusNotFound)
+		return
+	}
+	var m *models.Mission
+	switch r.Method {
+	case http.MethodGet:
+		m, err = courses.Get(id)
+	case http.MethodPut:
+		if m, err = decodeMission(r); err != nil {
+			APIResponse(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		m, err = courses.Update(id, m)
+	case http.MethodDelete:
+		if err = courses.Delete(id); err == nil {
+			APIResponse(w, "OK", http.StatusOK)
+			return
+		}
+	default:
+		APIResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		APIResponse(w, err.Error(), courseErrorCode(err))
+		return
+	}
+	APIResponse(w, m, http.StatusOK)
+}
+
+// POST /api/courses/dryrun       リクエストボディのミッションをドライラン
+// GET  /api/courses/{id}/dryrun  保存済みのコースをドライラン
+// batteryを指定しない場合は現在のバッテリー残量(未接続なら100%)から計算する
+func apiCourseDryRunHandler(w http.ResponseWriter, r *http.Request, strID string) {
+	var m *models.Mission
+	var err error
+	if strID = strings.Trim(strID, "/"); strID == "" {
+		if r.Method != http.MethodPost {
+			APIResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if m, err = decodeMission(r); err != nil {
+			APIResponse(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		id, err := strconv.Atoi(strID)
+		if err != nil {
+			APIResponse(w, "Not found", http.StatusNotFound)
+			return
+		}
+		if m, err = appContext.Courses.Get(id); err != nil {
+			APIResponse(w, err.Error(), courseErrorCode(err))
+			return
+		}
+	}
+
+	drone := appContext.DroneManager
+	battery := 100.0
+	if t := drone.Telemetry(); !t.Time.IsZero() {
+		battery = float64(t.Battery)
+	}
+	if b, err := strconv.ParseFloat(r.URL.Query().Get("battery"), 64); err == nil {
+		battery = b
+	}
+	APIResponse(w, models.DryRun(m, battery, drone.CurrentSpeed()), http.StatusOK)
+}
+
+// /api/flights/で一覧、/api/flights/{id}でログファイルをダウンロード
+func apiFlightsHandler(w http.ResponseWriter, r *http.Request) {
+	flightLog := appContext.DroneManager.FlightLog
+	id := strings.TrimPrefix(r.URL.Path, "/api/flights")
+	id = strings.Trim(id, "/")
+	if id == "" {
+		logs, err := flightLog.List()
+		if err != nil {
+			APIResponse(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		APIResponse(w, logs, http.StatusOK)
+		return
+	}
+	path, err := flightLog.Path(id)
+	if err != nil {
+		APIResponse(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(path)))
+	http.ServeFile(w, r, path)
+}
+
+type recordingsResult struct {
+	Status     models.RecorderStatus  `json:"status"`
+	Recordings []models.RecordingInfo `json:"recordings"`
+}
+
+// 録画の一覧(/api/recordings)とダウンロード(/api/recordings/<ファイル名>)
+func apiRecordingsHandler(w http.ResponseWriter, r *http.Request) {
+	recorder := appContext.DroneManager.Recorder
+	name := strings.TrimPrefix(r.URL.Path, "/api/recordings")
+	name = strings.Trim(name, "/")
+	if name == "" {
+		recordings, err := recorder.List()
+		if err != nil {
+			APIResponse(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		APIResponse(w, recordingsResult{Status: recorder.Status(), Recordings: recordings}, http.StatusOK)
+		return
+	}
+	path, err := recorder.Path(name)
 	if err != nil {
 		APIResponse(w, err.Error(), http.StatusNotFound)
 		return
 	}
-	course := appContext.DefaultCourses[id]
-	course.Run()
-	APIResponse(w, course, http.StatusOK)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(path)))
+	http.ServeFile(w, r, path)
 }
 
 func StartWebServer() error {
 	http.HandleFunc("/", viewIndexHandler)
 	http.HandleFunc("/controller/", viewControllerHandler)
+	http.HandleFunc("/courses/", viewCoursesHandler)
+	http.HandleFunc("/games/shake/", viewShakeHandler)
 	http.HandleFunc("/api/command/", apiMakeHandler(apiCommandHandler))
+	http.HandleFunc("/api/emergency/", apiMakeHandler(apiEmergencyHandler))
+	http.HandleFunc("/api/connection/", apiMakeHandler(apiConnectionHandler))
+	http.HandleFunc("/api/telemetry", apiMakeHandler(apiTelemetryHandler))
+	http.HandleFunc("/api/telemetry/", apiMakeHandler(apiTelemetryHandler))
+	http.HandleFunc("/api/flights", apiMakeHandler(apiFlightsHandler))
+	http.HandleFunc("/api/flights/", apiMakeHandler(apiFlightsHandler))
+	http.HandleFunc("/api/recordings", apiMakeHandler(apiRecordingsHandler))
+	http.HandleFunc("/api/recordings/", apiMakeHandler(apiRecordingsHandler))
+	http.HandleFunc("/api/watchdog/", apiMakeHandler(apiWatchdogHandler))
 	http.HandleFunc("/api/shake/start/", apiMakeHandler(apiStartShakeHandler))
 	http.HandleFunc("/api/shake/run/", apiMakeHandler(apiRunShakeHandler))
+	http.HandleFunc("/api/shake/status/", apiMakeHandler(apiShakeStatusHandler))
+	http.HandleFunc("/api/leaderboard", apiMakeHandler(apiLeaderboardHandler))
+	http.HandleFunc("/api/leaderboard/", apiMakeHandler(apiLeaderboardHandler))
+	http.HandleFunc("/api/patrol/", apiMakeHandler(apiPatrolHandler))
+	http.HandleFunc("/api/control/", apiMakeHandler(apiControlHandler))
+	http.HandleFunc("/api/detector/", apiMakeHandler(apiDetectorHandler))
+	http.HandleFunc("/api/video/", apiMakeHandler(apiVideoHandler))
+	http.HandleFunc("/api/target/", apiMakeHandler(apiTargetHandler))
+	http.HandleFunc("/api/runner/", apiMakeHandler(apiRunnerHandler))
+	http.HandleFunc("/api/courses", apiMakeHandler(apiCoursesHandler))
+	http.HandleFunc("/api/courses/", apiMakeHandler(apiCoursesHandler))
 	http.Handle("/video/streaming", appContext.DroneManager.Stream)
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
 	return http.ListenAndServe(fmt.Sprintf("%s:%d", config.Config.Address, config.Config.Port), nil)
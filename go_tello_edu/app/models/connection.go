@@ -0,0 +1,341 @@
+package models
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"gobot.io/x/gobot/platforms/dji/tello"
+)
+
+// ドローンとの接続状態
+type ConnectionState string
+
+const (
+	// ドライバーが起動していない
+	StateDisconnected ConnectionState = "disconnected"
+	// 起動後、最初の接続応答を待っている
+	StateConnecting ConnectionState = "connecting"
+	StateConnected  ConnectionState = "connected"
+	// FlightDataが一定時間届いていない
+	StateLost ConnectionState = "lost"
+	// 接続要求を再送している
+	StateReconnecting ConnectionState = "reconnecting"
+)
+
+const ConnectionEvent = "connection"
+
+var ErrNotConnected = errors.New("drone is not connected")
+
+type ConnectionStatus struct {
+	State          ConnectionState `json:"state"`
+	Since          time.Time       `json:"since"`
+	LastFlightData time.Time       `json:"last_flight_data"`
+	Reconnects     int             `json:"reconnects"`
+}
+
+type connection struct {
+	mux            sync.RWMutex
+	state          ConnectionState
+	since          time.Time
+	lastFlightData time.Time
+	lastRequest    time.Time
+	reconnects     int
+	connected      chan struct{}
+	connectedOnce  sync.Once
+	// 状態が変わったときに呼ばれる(ロック中に呼ばれるので処理をブロックしないこと)
+	onChange func(ConnectionState)
+}
+
+func newConnection() *connection {
+	return &connection{
+		state:     StateDisconnected,
+		since:     time.Now(),
+		connected: make(chan struct{}),
+	}
+}
+
+// ロック済みの状態で呼び出すこと
+func (c *connection) setState(state ConnectionState) {
+	if c.state == state {
+		return
+	}
+	log.Printf("action=connection from=%s to=%s", c.state, state)
+	c.state = state
+	c.since = time.Now()
+	if state == StateConnected {
+		c.connectedOnce.Do(func() { close(c.connected) })
+	}
+	if c.onChange != nil {
+		c.onChange(state)
+	}
+}
+
+func (c *connection) started() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.lastRequest = time.Now()
+	// 起動処理中に接続応答が届いている場合がある
+	if c.state == StateDisconnected {
+		c.setState(StateConnecting)
+	}
+}
+
+// tello.ConnectedEventを受信した
+func (c *connection) handshake() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.lastFlightData = time.Now()
+	c.setState(StateConnected)
+}
+
+// FlightDataを受信した
+// 切断中に届いた場合はドローンとの通信が復旧したとみなす
+func (c *connection) alive() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.lastFlightData = time.Now()
+	if c.state == StateLost || c.state == StateReconnecting {
+		c.setState(StateConnected)
+	}
+}
+
+// 時間経過による状態遷移を行い、接続要求を再送するべきかを返す
+func (c *connection) tick(now time.Time, connectTimeout, lostTimeout, reconnectInterval time.Duration) (resend bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	switch c.state {
+	case StateConnecting:
+		if now.Sub(c.since) > connectTimeout {
+			c.setState(StateReconnecting)
+		}
+	case StateConnected:
+		if now.Sub(c.lastFlightData) > lostTimeout {
+			c.setState(StateLost)
+		}
+	case StateLost:
+		c.setState(StateReconnecting)
+	}
+	if c.state == StateReconnecting && now.Sub(c.lastRequest) > reconnectInterval {
+		c.lastRequest = now
+		c.reconnects++
+		return true
+	}
+	return false
+}
+
+func (c *connection) check() error {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	if c.state != StateConnected {
+		return ErrNotConnected
+	}
+	return nil
+}
+
+// ドライバーが起動していればnilを返す
+// 起動後は接続が途絶えていてもコマンドを送信できる(届くかどうかはわからない)
+func (c *connection) checkStarted() error {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	if c.state == StateDisconnected {
+		return ErrNotConnected
+	}
+	return nil
+}
+
+func (c *connection) status() ConnectionStatus {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return ConnectionStatus{
+		State:          c.state,
+		Since:          c.since,
+		LastFlightData: c.lastFlightData,
+		Reconnects:     c.reconnects,
+	}
+}
+
+// 接続するかtimeoutが経過するまで待つ
+func (c *connection) wait(timeout time.Duration) bool {
+	select {
+	case <-c.connected:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// gobotのドライバーが起動時に送るものと同じ形式の接続要求
+// Telloは映像をvideoPortに送るようになる
+func connectionRequest(videoPort int) string {
+	b := [2]byte{}
+	binary.LittleEndian.PutUint16(b[:], uint16(videoPort))
+	return "conn_req:" + string(b[:])
+}
+
+// 接続していない状態ではコマンドを拒否するDrone
+// (接続前にコマンドを送るとドライバー内部でinvalid memory errorになる)
+// 緊急停止の直後は着陸以外の操作も拒否する
+// 着陸とホバリングは接続が途絶えていても送信する(ドライバーの起動前だけ拒否する)
+type connectedDrone struct {
+	Drone
+	conn *connection
+	stop *emergencyStop
+}
+
+func (g *connectedDrone) check() error {
+	if err := g.conn.check(); err != nil {
+		return err
+	}
+	return g.stop.check()
+}
+
+func (g *connectedDrone) TakeOff() error {
+	if err := g.check(); err != nil {
+		return err
+	}
+	return g.Drone.TakeOff()
+}
+
+func (g *connectedDrone) ThrowTakeOff() error {
+	if err := g.check(); err != nil {
+		return err
+	}
+	return g.Drone.ThrowTakeOff()
+}
+
+func (g *connectedDrone) Land() error {
+	if err := g.conn.checkStarted(); err != nil {
+		return err
+	}
+	return g.Drone.Land()
+}
+
+func (g *connectedDrone) Hover() {
+	if err := g.conn.checkStarted(); err != nil {
+		return
+	}
+	g.Drone.Hover()
+}
+
+func (g *connectedDrone) Up(val int) error {
+	if err := g.check(); err != nil {
+		return err
+	}
+	return g.Drone.Up(val)
+}
+
+func (g *connectedDrone) Down(val int) error {
+	if err := g.check(); err != nil {
+		return err
+	}
+	return g.Drone.Down(val)
+}
+
+func (g *connectedDrone) Forward(val int) error {
+	if err := g.check(); err != nil {
+		return err
+	}
+	return g.Drone.Forward(val)
+}
+
+func (g *connectedDrone) Backward(val int) error {
+	if err := g.check(); err != nil {
+		return err
+	}
+	return g.Drone.Backward(val)
+}
+
+func (g *connectedDrone) Left(val int) error {
+	if err := g.check(); err != nil {
+		return err
+	}
+	return g.Drone.Left(val)
+}
+
+func (g *connectedDrone) Right(val int) error {
+	if err := g.check(); err != nil {
+		return err
+	}
+	return g.Drone.Right(val)
+}
+
+func (g *connectedDrone) Clockwise(val int) error {
+	if err := g.check(); err != nil {
+		return err
+	}
+	return g.Drone.Clockwise(val)
+}
+
+func (g *connectedDrone) CounterClockwise(val int) error {
+	if err := g.check(); err != nil {
+		return err
+	}
+	return g.Drone.CounterClockwise(val)
+}
+
+func (g *connectedDrone) FrontFlip() error {
+	if err := g.check(); err != nil {
+		return err
+	}
+	return g.Drone.FrontFlip()
+}
+
+func (g *connectedDrone) BackFlip() error {
+	if err := g.check(); err != nil {
+		return err
+	}
+	return g.Drone.BackFlip()
+}
+
+func (g *connectedDrone) LeftFlip() error {
+	if err := g.check(); err != nil {
+		return err
+	}
+	return g.Drone.LeftFlip()
+}
+
+func (g *connectedDrone) RightFlip() error {
+	if err := g.check(); err != nil {
+		return err
+	}
+	return g.Drone.RightFlip()
+}
+
+func (g *connectedDrone) Bounce() error {
+	if err := g.check(); err != nil {
+		return err
+	}
+	return g.Drone.Bounce()
+}
+
+func (g *connectedDrone) StartVideo() error {
+	if err := g.conn.check(); err != nil {
+		return err
+	}
+	return g.Drone.StartVideo()
+}
+
+// 映像の設定やSDKのコマンドは、ドライバーの起動前に送ると接続がnilのまま使われてpanicする
+func (g *connectedDrone) SetVideoEncoderRate(rate tello.VideoBitRate) error {
+	if err := g.conn.checkStarted(); err != nil {
+		return err
+	}
+	return g.Drone.SetVideoEncoderRate(rate)
+}
+
+func (g *connectedDrone) SetExposure(level int) error {
+	if err := g.conn.checkStarted(); err != nil {
+		return err
+	}
+	return g.Drone.SetExposure(level)
+}
+
+func (g *connectedDrone) SendCommand(cmd string) error {
+	if err := g.conn.checkStarted(); err != nil {
+		return err
+	}
+	return g.Drone.SendCommand(cmd)
+}
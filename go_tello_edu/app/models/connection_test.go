@@ -0,0 +1,134 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"gobot.io/x/gobot/platforms/dji/tello"
+)
+
+func TestConnectionStateMachine(t *testing.T) {
+	const (
+		connectTimeout    = 5 * time.Second
+		lostTimeout       = 3 * time.Second
+		reconnectInterval = 2 * time.Second
+	)
+	type step struct {
+		op     string
+		at     time.Duration
+		state  ConnectionState
+		resend bool
+	}
+	for _, tt := range []struct {
+		name       string
+		steps      []step
+		reconnects int
+	}{
+		{"connect and lose flight data", []step{
+			{op: "started", state: StateConnecting},
+			{op: "handshake", state: StateConnected},
+			{op: "tick", at: time.Second, state: StateConnected},
+			{op: "tick", at: 4 * time.Second, state: StateLost},
+			{op: "tick", at: 4500 * time.Millisecond, state: StateReconnecting, resend: true},
+			{op: "tick", at: 5 * time.Second, state: StateReconnecting},
+			{op: "tick", at: 7 * time.Second, state: StateReconnecting, resend: true},
+			{op: "alive", state: StateConnected},
+		}, 2},
+		{"connect timeout", []step{
+			{op: "started", state: StateConnecting},
+			{op: "tick", at: time.Second, state: StateConnecting},
+			{op: "tick", at: 6 * time.Second, state: StateReconnecting, resend: true},
+			{op: "handshake", state: StateConnected},
+		}, 1},
+		{"response before started", []step{
+			{op: "handshake", state: StateConnected},
+			{op: "started", state: StateConnected},
+		}, 0},
+		{"driver not started", []step{
+			{op: "tick", at: 10 * time.Second, state: StateDisconnected},
+			{op: "alive", state: StateDisconnected},
+		}, 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newConnection()
+			start := time.Now()
+			var changes []ConnectionState
+			c.onChange = func(state ConnectionState) { changes = append(changes, state) }
+			var want []ConnectionState
+			for i, s := range tt.steps {
+				resend := false
+				switch s.op {
+				case "started":
+					c.started()
+				case "handshake":
+					c.handshake()
+				case "alive":
+					c.alive()
+				case "tick":
+					resend = c.tick(start.Add(s.at), connectTimeout, lostTimeout, reconnectInterval)
+				}
+				status := c.status()
+				if status.State != s.state || resend != s.resend {
+					t.Fatalf("step %d %s: state = %s resend = %t, want %s %t", i, s.op, status.State, resend, s.state, s.resend)
+				}
+				if (c.check() == nil) != (s.state == StateConnected) {
+					t.Errorf("step %d: check() = %v in %s", i, c.check(), s.state)
+				}
+				if (c.checkStarted() == nil) != (s.state != StateDisconnected) {
+					t.Errorf("step %d: checkStarted() = %v in %s", i, c.checkStarted(), s.state)
+				}
+				if len(want) == 0 && s.state != StateDisconnected || len(want) > 0 && want[len(want)-1] != s.state {
+					want = append(want, s.state)
+				}
+			}
+			if !reflect.DeepEqual(changes, want) {
+				t.Errorf("changes = %v, want %v", changes, want)
+			}
+			if got := c.status().Reconnects; got != tt.reconnects {
+				t.Errorf("reconnects = %d, want %d", got, tt.reconnects)
+			}
+		})
+	}
+}
+
+// 着陸とホバリングは接続が途絶えていても送るが、ドライバーの起動前は送らない
+func TestConnectedDroneGates(t *testing.T) {
+	for _, tt := range []struct {
+		state ConnectionState
+		want  []string
+	}{
+		{StateDisconnected, []string{}},
+		{StateConnecting, []string{"land", "hover"}},
+		{StateConnected, []string{"land", "hover", "forward"}},
+		{StateLost, []string{"land", "hover"}},
+		{StateReconnecting, []string{"land", "hover"}},
+	} {
+		fake := &fakeDrone{}
+		conn := newConnection()
+		conn.state = tt.state
+		drone := &connectedDrone{Drone: fake, conn: conn, stop: &emergencyStop{}}
+		landErr := drone.Land()
+		drone.Hover()
+		forwardErr := drone.Forward(10)
+		// ドライバーの起動前はpanicするので送らない
+		for name, err := range map[string]error{
+			"SendCommand":         drone.SendCommand("command"),
+			"SetExposure":         drone.SetExposure(0),
+			"SetVideoEncoderRate": drone.SetVideoEncoderRate(tello.VideoBitRateAuto),
+		} {
+			if (err == nil) != (tt.state != StateDisconnected) {
+				t.Errorf("%s: %s() = %v", tt.state, name, err)
+			}
+		}
+		if got := fake.Commands(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: commands = %v, want %v", tt.state, got, tt.want)
+		}
+		if (landErr == nil) != (tt.state != StateDisconnected) {
+			t.Errorf("%s: Land() = %v", tt.state, landErr)
+		}
+		if (forwardErr == nil) != (tt.state == StateConnected) {
+			t.Errorf("%s: Forward() = %v", tt.state, forwardErr)
+		}
+	}
+}
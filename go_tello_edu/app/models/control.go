@@ -0,0 +1,269 @@
+package models
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	ControlEvent         = "control"
+	controlCheckInterval = 200 * time.Millisecond
+)
+
+var ErrNotInControl = errors.New("another behavior has control of the drone")
+
+// ドローンを動かす動作の種類
+type Behavior string
+
+const (
+	BehaviorNone      Behavior = ""
+	BehaviorPatrol    Behavior = "patrol"
+	BehaviorTracking  Behavior = "tracking"
+	BehaviorCourse    Behavior = "course"
+	BehaviorManual    Behavior = "manual"
+	BehaviorEmergency Behavior = "emergency"
+)
+
+// 優先度(大きいほど優先する)
+var behaviorPriority = map[Behavior]int{
+	BehaviorPatrol:    1,
+	BehaviorTracking:  2,
+	BehaviorCourse:    3,
+	BehaviorManual:    4,
+	BehaviorEmergency: 5,
+}
+
+func (b Behavior) String() string {
+	if b == BehaviorNone {
+		return "none"
+	}
+	return string(b)
+}
+
+type ControlStatus struct {
+	Owner Behavior `json:"owner"`
+	// 有効な動作(優先度の高い順)
+	Active []Behavior `json:"active"`
+}
+
+// 巡回・顔追跡・コース・手動操作・緊急停止のうち、どれが機体を動かすかを決める
+// 有効な動作のうち最も優先度の高いものだけが移動コマンドを送れ、それ以外のコマンドは捨てる
+// 優先度の高い動作が終わると、有効なままの動作が次のコマンドから操作を引き継ぐ
+// 安全機能(バッテリー・通信断・ジオフェンス・ウォッチドッグ)はこの仕組みを通らずに機体を止める
+type ControlArbiter struct {
+	mux   sync.Mutex
+	drone *DroneManager
+	// 手動操作はコマンドを送ってからこの時間だけ有効
+	manualHold time.Duration
+	// 有効な動作と期限(ゼロなら解除するまで有効)
+	claims map[Behavior]time.Time
+	owner  Behavior
+}
+
+func newControlArbiter(drone *DroneManager, manualHold time.Duration) *ControlArbiter {
+	return &ControlArbiter{drone: drone, manualHold: manualHold, claims: map[Behavior]time.Time{}}
+}
+
+// 動作を有効にする(Releaseするまで有効)
+func (a *ControlArbiter) Claim(b Behavior) {
+	a.claim(b, time.Time{})
+}
+
+// 動作をdの間だけ有効にする
+func (a *ControlArbiter) ClaimFor(b Behavior, d time.Duration) {
+	a.claim(b, time.Now().Add(d))
+}
+
+// 操作画面から自律動作を始めた場合に使う
+// 手動操作の有効期限を待たずに、bへ操作を渡す
+func (a *ControlArbiter) Handover(b Behavior) {
+	if a == nil {
+		return
+	}
+	a.mux.Lock()
+	delete(a.claims, BehaviorManual)
+	a.mux.Unlock()
+	a.Claim(b)
+}
+
+func (a *ControlArbiter) claim(b Behavior, until time.Time) {
+	if a == nil {
+		return
+	}
+	a.mux.Lock()
+	a.claims[b] = until
+	from, to := a.update(time.Now())
+	a.mux.Unlock()
+	a.handoff(from, to)
+}
+
+func (a *ControlArbiter) Release(b Behavior) {
+	if a == nil {
+		return
+	}
+	a.mux.Lock()
+	delete(a.claims, b)
+	from, to := a.update(time.Now())
+	a.mux.Unlock()
+	a.handoff(from, to)
+}
+
+// bが機体を動かせるか確認する
+// 手動操作はコマンドを送るたびに有効期限を延ばす
+func (a *ControlArbiter) check(b Behavior) error {
+	if b == BehaviorManual {
+		a.ClaimFor(b, a.manualHold)
+	}
+	a.mux.Lock()
+	from, to := a.update(time.Now())
+	a.mux.Unlock()
+	a.handoff(from, to)
+	switch to {
+	case b:
+		return nil
+	case BehaviorEmergency:
+		return ErrEmergencyStop
+	}
+	return ErrNotInControl
+}
+
+func (a *ControlArbiter) Status() ControlStatus {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	return a.status()
+}
+
+// ロック済みの状態で呼び出すこと
+func (a *ControlArbiter) status() ControlStatus {
+	status := ControlStatus{Owner: a.owner, Active: []Behavior{}}
+	for b := range a.claims {
+		status.Active = append(status.Active, b)
+	}
+	sort.Slice(status.Active, func(i, j int) bool {
+		return behaviorPriority[status.Active[i]] > behaviorPriority[status.Active[j]]
+	})
+	return status
+}
+
+// 期限切れの動作を取り除いて操作する動作を決め直す
+// ロック済みの状態で呼び出すこと
+func (a *ControlArbiter) update(now time.Time) (from, to Behavior) {
+	owner := BehaviorNone
+	for b, until := range a.claims {
+		if !until.IsZero() && !now.Before(until) {
+			delete(a.claims, b)
+			continue
+		}
+		if behaviorPriority[b] > behaviorPriority[owner] {
+			owner = b
+		}
+	}
+	from = a.owner
+	a.owner = owner
+	if from != owner {
+		a.drone.events.Publish(ControlEvent, a.status())
+	}
+	return from, owner
+}
+
+func (a *ControlArbiter) handoff(from, to Behavior) {
+	if from == to {
+		return
+	}
+	log.Printf("action=ControlArbiter from=%s to=%s", from, to)
+	if from != BehaviorNone && to != BehaviorNone {
+		// 前の動作のスティック入力が残らないように止めてから引き継ぐ
+		a.drone.Drone.Hover()
+	}
+}
+
+// 手動操作や緊急停止の期限切れを検知する
+func (a *ControlArbiter) watch() {
+	ticker := time.NewTicker(controlCheckInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		a.mux.Lock()
+		from, to := a.update(now)
+		a.mux.Unlock()
+		a.handoff(from, to)
+	}
+}
+
+// 動作ごとのドローン
+// その動作が機体を動かしているときだけ移動コマンドを送り、それ以外はErrNotInControlを返す
+func (a *ControlArbiter) Drone(b Behavior) CourseDrone {
+	return &behaviorDrone{DroneManager: a.drone, behavior: b}
+}
+
+type behaviorDrone struct {
+	*DroneManager
+	behavior Behavior
+}
+
+func (b *behaviorDrone) check() error {
+	return b.Control.check(b.behavior)
+}
+
+func (b *behaviorDrone) TakeOff() error {
+	if err := b.check(); err != nil {
+		return err
+	}
+	return b.DroneManager.TakeOff()
+}
+
+func (b *behaviorDrone) ThrowTakeOff() error {
+	if err := b.check(); err != nil {
+		return err
+	}
+	return b.DroneManager.ThrowTakeOff()
+}
+
+func (b *behaviorDrone) Hover() {
+	if b.check() == nil {
+		b.DroneManager.Hover()
+	}
+}
+
+func (b *behaviorDrone) CeaseRotation() {
+	if b.check() == nil {
+		b.DroneManager.CeaseRotation()
+	}
+}
+
+func (b *behaviorDrone) move(val int, fn func(int) error) error {
+	if err := b.check(); err != nil {
+		return err
+	}
+	return fn(val)
+}
+
+func (b *behaviorDrone) Up(val int) error       { return b.move(val, b.DroneManager.Up) }
+func (b *behaviorDrone) Down(val int) error     { return b.move(val, b.DroneManager.Down) }
+func (b *behaviorDrone) Forward(val int) error  { return b.move(val, b.DroneManager.Forward) }
+func (b *behaviorDrone) Backward(val int) error { return b.move(val, b.DroneManager.Backward) }
+func (b *behaviorDrone) Left(val int) error     { return b.move(val, b.DroneManager.Left) }
+func (b *behaviorDrone) Right(val int) error    { return b.move(val, b.DroneManager.Right) }
+
+func (b *behaviorDrone) Clockwise(val int) error {
+	return b.move(val, b.DroneManager.Clockwise)
+}
+
+func (b *behaviorDrone) CounterClockwise(val int) error {
+	return b.move(val, b.DroneManager.CounterClockwise)
+}
+
+func (b *behaviorDrone) flip(fn func() error) error {
+	if err := b.check(); err != nil {
+		return err
+	}
+	return fn()
+}
+
+func (b *behaviorDrone) FrontFlip() error { return b.flip(b.DroneManager.FrontFlip) }
+func (b *behaviorDrone) BackFlip() error  { return b.flip(b.DroneManager.BackFlip) }
+func (b *behaviorDrone) LeftFlip() error  { return b.flip(b.DroneManager.LeftFlip) }
+func (b *behaviorDrone) RightFlip() error { return b.flip(b.DroneManager.RightFlip) }
+func (b *behaviorDrone) Bounce() error    { return b.flip(b.DroneManager.Bounce) }
@@ -0,0 +1,73 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestControlArbiterPriority(t *testing.T) {
+	d, fake := newTestDroneManager(t)
+	patrol := d.Control.Drone(BehaviorPatrol)
+	tracking := d.Control.Drone(BehaviorTracking)
+	manual := d.Control.Drone(BehaviorManual)
+
+	d.Control.Claim(BehaviorPatrol)
+	if err := patrol.Forward(10); err != nil {
+		t.Fatalf("patrol should have control: %v", err)
+	}
+	d.Control.Claim(BehaviorTracking)
+	if err := patrol.Forward(10); err != ErrNotInControl {
+		t.Errorf("patrol should be preempted by tracking: %v", err)
+	}
+	if err := tracking.Left(10); err != nil {
+		t.Errorf("tracking should have control: %v", err)
+	}
+
+	// 手動操作はmanual_holdの間だけ優先する
+	if err := manual.Right(10); err != nil {
+		t.Fatalf("manual should have control: %v", err)
+	}
+	if err := tracking.Left(10); err != ErrNotInControl {
+		t.Errorf("tracking should be preempted by manual: %v", err)
+	}
+	time.Sleep(80 * time.Millisecond)
+	if err := tracking.Left(10); err != nil {
+		t.Errorf("tracking should get control back after manual hold: %v", err)
+	}
+
+	// 緊急停止中は手動操作も拒否する
+	d.Control.ClaimFor(BehaviorEmergency, time.Second)
+	if err := manual.Up(10); err != ErrEmergencyStop {
+		t.Errorf("manual should be locked by emergency: %v", err)
+	}
+
+	d.Control.Release(BehaviorTracking)
+	if got := d.Control.Status().Active; len(got) != 3 || got[0] != BehaviorEmergency || got[2] != BehaviorPatrol {
+		t.Errorf("active = %v", got)
+	}
+
+	// 引き継ぐたびにホバリングしてから次の動作のコマンドを送る
+	want := []string{"forward", "hover", "left", "hover", "right", "hover", "left", "hover"}
+	got := fake.Commands()
+	if len(got) != len(want) {
+		t.Fatalf("commands = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("commands = %v, want %v", got, want)
+		}
+	}
+}
+
+// 操作画面から巡回を始めた場合は手動操作の有効期限を待たない
+func TestControlArbiterHandover(t *testing.T) {
+	d, _ := newTestDroneManager(t)
+	manual := d.Control.Drone(BehaviorManual)
+	if err := manual.Forward(10); err != nil {
+		t.Fatal(err)
+	}
+	d.Control.Handover(BehaviorPatrol)
+	if owner := d.Control.Status().Owner; owner != BehaviorPatrol {
+		t.Errorf("owner = %s, want patrol", owner)
+	}
+}
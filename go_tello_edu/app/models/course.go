@@ -1,6 +1,7 @@
 package models
 
 import (
+	"log"
 	"sync"
 	"time"
 )
@@ -9,17 +10,77 @@ type BaseCourse interface {
 	Start()
 	Stop()
 	Run()
+	Abort()
+	Pause()
+	Resume()
+	Running() bool
+	Shake() int
+	Progress() CourseStatus
 	UpdateElapsed()
 }
 
+// コースから操作するドローン
+// 実機ではDroneManager、ドライランではRecordingDroneを使う
+type CourseDrone interface {
+	Drone
+	Telemetry() Telemetry
+	CurrentSpeed() int
+}
+
 type Course struct {
-	Name      string        `json:name`
-	Status    int           `json:status`
-	IsRunning bool          `json:is_running`
-	StartTime time.Time     `json:start_time`
-	Elasped   time.Duration `json:elasped`
-	Drone     *DroneManager `json:"-"`
-	mux       sync.Mutex    `json:"-"`
+	Name      string        `json:"name"`
+	Status    int           `json:"status"`
+	IsRunning bool          `json:"is_running"`
+	StartTime time.Time     `json:"start_time"`
+	Elasped   time.Duration `json:"elapsed"`
+	Drone     CourseDrone   `json:"-"`
+	// nilの場合は記録しない
+	FlightLog *FlightRecorder `json:"-"`
+	// nilの場合はtime.Now(ドライランでは仮想時計を使う)
+	Clock    func() time.Time `json:"-"`
+	mux      sync.Mutex
+	pausedAt time.Time
+	shakes   int
+}
+
+func (c *Course) now() time.Time {
+	if c.Clock != nil {
+		return c.Clock()
+	}
+	return time.Now()
+}
+
+// コースの進行状況(APIのレスポンス用)
+type CourseStatus struct {
+	Name      string `json:"name"`
+	Status    int    `json:"status"`
+	Steps     int    `json:"steps,omitempty"`
+	IsRunning bool   `json:"is_running"`
+	// 全てのステップを実行して終了した
+	Completed bool          `json:"completed"`
+	Shakes    int           `json:"shakes"`
+	StartTime time.Time     `json:"start_time"`
+	Elapsed   time.Duration `json:"elapsed"`
+}
+
+// コースの進行状況(フライトログに記録する)
+type courseProgress struct {
+	Name    string        `json:"name"`
+	Event   string        `json:"event"`
+	Status  int           `json:"status"`
+	Elapsed time.Duration `json:"elapsed"`
+}
+
+func (c *Course) logProgress(event string) {
+	if c.FlightLog == nil {
+		return
+	}
+	c.FlightLog.Record(LogCourse, courseProgress{
+		Name:    c.Name,
+		Event:   event,
+		Status:  c.Status,
+		Elapsed: c.Elasped,
+	})
 }
 
 func (c *Course) Start() {
@@ -27,7 +88,10 @@ func (c *Course) Start() {
 		return
 	}
 	c.IsRunning = true
-	c.StartTime = time.Now()
+	c.StartTime = c.now()
+	c.pausedAt = time.Time{}
+	c.shakes = 0
+	c.logProgress("start")
 }
 
 func (c *Course) Stop() {
@@ -35,89 +99,280 @@ func (c *Course) Stop() {
 		return
 	}
 	c.IsRunning = false
+	c.logProgress("stop")
 	c.Status = 0
 }
 
+// 緊急停止用
+// Runの実行中でも待たずに戻り、Runが終わったところでコースを止める
+func (c *Course) Abort() {
+	go func() {
+		c.mux.Lock()
+		defer c.mux.Unlock()
+		c.Stop()
+	}()
+}
+
+func (c *Course) Running() bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.IsRunning
+}
+
+// 一時停止中はRunを呼ばないこと
+func (c *Course) Pause() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.pause()
+}
+
+func (c *Course) pause() {
+	if !c.IsRunning || !c.pausedAt.IsZero() {
+		return
+	}
+	c.pausedAt = c.now()
+	c.Drone.Hover()
+	c.logProgress("pause")
+}
+
+func (c *Course) Resume() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.resume()
+}
+
+// 一時停止していた時間を返す
+// 経過時間に含めないように開始時刻をずらす
+func (c *Course) resume() time.Duration {
+	if c.pausedAt.IsZero() {
+		return 0
+	}
+	paused := c.now().Sub(c.pausedAt)
+	c.StartTime = c.StartTime.Add(paused)
+	c.pausedAt = time.Time{}
+	c.logProgress("resume")
+	return paused
+}
+
+// シェイクゲームで振った回数を数える(実行中のみ)
+func (c *Course) Shake() int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.IsRunning && c.pausedAt.IsZero() {
+		c.shakes++
+	}
+	return c.shakes
+}
+
+func (c *Course) Progress() CourseStatus {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.progress()
+}
+
+func (c *Course) progress() CourseStatus {
+	return CourseStatus{
+		Name:      c.Name,
+		Status:    c.Status,
+		IsRunning: c.IsRunning,
+		Shakes:    c.shakes,
+		StartTime: c.StartTime,
+		Elapsed:   c.Elasped,
+	}
+}
+
 func (c *Course) UpdateElapsed() {
 	if !c.IsRunning {
 		return
 	}
-	c.Elasped = time.Since(c.StartTime)
+	c.Elasped = c.now().Sub(c.StartTime)
 }
 
-type CourseA struct {
+// ミッションファイルの手順を実行するコース
+// Runを呼ぶたびに経過時間と機体の状態を見てステップを進める
+type MissionCourse struct {
 	Course
+	Mission   *Mission `json:"-"`
+	step      int
+	stepStart time.Time
+	started   bool
+}
+
+func NewMissionCourse(m *Mission, droneManager *DroneManager) *MissionCourse {
+	return &MissionCourse{
+		Course:  Course{Name: m.Name, Drone: droneManager.Control.Drone(BehaviorCourse), FlightLog: droneManager.FlightLog},
+		Mission: m,
+	}
 }
 
-func (c *CourseA) Run() {
+func (c *MissionCourse) Start() {
 	c.mux.Lock()
 	defer c.mux.Unlock()
-	if !c.IsRunning {
+	if c.IsRunning {
 		return
 	}
+	c.step = 0
+	c.started = false
+	c.Course.Start()
+}
 
-	c.Status++
-	switch c.Status {
-	case 1:
-		c.Drone.TakeOff()
-	case 10:
-		c.Drone.Clockwise(30)
-	case 15:
-		c.Drone.CounterClockwise(30)
-	case 20:
-		c.Drone.Clockwise(30)
-	case 25:
-		c.Drone.CounterClockwise(30)
-	case 30:
-		c.Drone.Hover()
-	case 35:
-		c.Drone.FrontFlip()
-	case 45:
-		c.Drone.BackFlip()
-	case 55:
-		c.Drone.Land()
-		c.Stop()
+// 一時停止中の時間はステップの経過時間に含めず、移動・回転中だった場合は動作を再開する
+func (c *MissionCourse) Resume() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	paused := c.resume()
+	if paused == 0 || !c.started || c.step >= len(c.Mission.Steps) {
+		return
+	}
+	c.stepStart = c.stepStart.Add(paused)
+	s := c.Mission.Steps[c.step]
+	if s.Action == StepMove || s.Action == StepRotate {
+		if err := c.begin(s); err != nil {
+			log.Printf("action=MissionCourse.Resume mission=%s step=%d err=%s", c.Name, c.Status, err.Error())
+		}
 	}
-	c.UpdateElapsed()
 }
 
-type CourseB struct {
-	Course
+func (c *MissionCourse) Progress() CourseStatus {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	p := c.progress()
+	p.Steps = len(c.Mission.Steps)
+	p.Completed = c.step >= len(c.Mission.Steps)
+	return p
 }
 
-func (c *CourseB) Run() {
+func (c *MissionCourse) Run() {
 	c.mux.Lock()
 	defer c.mux.Unlock()
-
-	if !c.IsRunning {
+	if !c.IsRunning || !c.pausedAt.IsZero() {
 		return
 	}
+	c.UpdateElapsed()
+	// 時間のかからないステップは1回のRunでまとめて進める
+	for c.IsRunning && c.step < len(c.Mission.Steps) {
+		if !c.runStep(c.Mission.Steps[c.step]) {
+			break
+		}
+		c.step++
+		c.started = false
+	}
+	if c.IsRunning && c.step >= len(c.Mission.Steps) {
+		c.Stop()
+		return
+	}
+	c.logProgress("run")
+}
 
-	c.Status++
-	switch c.Status {
-	case 1:
-		c.Drone.TakeOff()
-	case 10:
-		c.Drone.FrontFlip()
-	case 20:
-		c.Drone.FrontFlip()
-		if time.Since(c.StartTime) < 10 {
-			c.Status = 35
+// ステップを実行し、終わったらtrueを返す
+func (c *MissionCourse) runStep(s MissionStep) bool {
+	t := c.Drone.Telemetry()
+	if !c.started {
+		if s.SkipIf != nil && s.SkipIf.met(c.Elasped, c.shakes, t) {
+			c.logProgress("skip:" + s.Action)
+			return true
+		}
+		c.started = true
+		c.stepStart = c.now()
+		c.Status = c.step + 1
+		c.logProgress("step:" + s.Action)
+		if err := c.begin(s); err != nil {
+			if err == ErrNotInControl {
+				// 手動操作などが終わるまでステップの開始を待つ
+				c.started = false
+				return false
+			}
+			log.Printf("action=MissionCourse.Run mission=%s step=%d err=%s", c.Name, c.Status, err.Error())
+			c.Drone.Hover()
+			c.Stop()
+			return false
+		}
+	}
+
+	running := c.now().Sub(c.stepStart)
+	switch s.Action {
+	case StepMove:
+		if running < s.duration() {
+			return false
 		}
-	case 30:
-		c.Drone.Clockwise(30)
-	case 40:
 		c.Drone.Hover()
-	case 50:
-		c.Drone.Land()
-		c.Stop()
+	case StepRotate:
+		if running < s.duration() {
+			return false
+		}
+		c.Drone.CeaseRotation()
+	case StepHover:
+		return running >= s.duration()
+	case StepWait:
+		if s.Until == nil {
+			return running >= s.duration()
+		}
+		if s.Until.met(c.Elasped, c.shakes, t) {
+			return true
+		}
+		if s.Timeout > 0 && running.Seconds() >= s.Timeout {
+			log.Printf("action=MissionCourse.Run mission=%s step=%d wait timeout", c.Name, c.Status)
+			return true
+		}
+		return false
 	}
-	c.UpdateElapsed()
+	return true
 }
 
-func NewDefaultCourse(droneManager *DroneManager) map[int]BaseCourse {
-	var a, b BaseCourse
-	a = &CourseA{Course{Name: "Course A", Drone: droneManager}}
-	b = &CourseB{Course{Name: "Course B", Drone: droneManager}}
-	return map[int]BaseCourse{1: a, 2: b}
+func (c *MissionCourse) begin(s MissionStep) error {
+	speed := s.Speed
+	if speed == 0 {
+		speed = c.Drone.CurrentSpeed()
+	}
+	d := c.Drone
+	switch s.Action {
+	case StepTakeOff:
+		if err := d.TakeOff(); err != nil {
+			return err
+		}
+		if c.FlightLog != nil {
+			c.FlightLog.Begin()
+		}
+	case StepLand:
+		return d.Land()
+	case StepHover:
+		d.Hover()
+	case StepMove, StepRotate:
+		return moveDrone(d, s.Direction, speed)
+	case StepFlip:
+		switch s.Direction {
+		case "front":
+			return d.FrontFlip()
+		case "back":
+			return d.BackFlip()
+		case "left":
+			return d.LeftFlip()
+		case "right":
+			return d.RightFlip()
+		}
+	}
+	return nil
+}
+
+// 移動・回転の方向名に対応するコマンドを送る(巡回でも使う)
+func moveDrone(d Drone, direction string, speed int) error {
+	switch direction {
+	case "forward":
+		return d.Forward(speed)
+	case "backward":
+		return d.Backward(speed)
+	case "left":
+		return d.Left(speed)
+	case "right":
+		return d.Right(speed)
+	case "up":
+		return d.Up(speed)
+	case "down":
+		return d.Down(speed)
+	case "clockwise":
+		return d.Clockwise(speed)
+	case "counter_clockwise":
+		return d.CounterClockwise(speed)
+	}
+	return nil
 }
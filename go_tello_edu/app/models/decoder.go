@@ -0,0 +1,570 @@
+package models
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+	"udemy_drone/go_tello_edu/config"
+
+	"gocv.io/x/gocv"
+)
+
+const (
+	DecoderEvent = "decoder"
+
+	// デコーダーの種類
+	DecoderFFmpeg = "ffmpeg"
+	DecoderGocv   = "gocv"
+
+	DecoderStarting   = "starting"
+	DecoderRunning    = "running"
+	DecoderRestarting = "restarting"
+	DecoderStopped    = "stopped"
+
+	// 状態を確認してFPSを計算する間隔
+	decoderCheckInterval = time.Second
+	// 再起動に失敗し続けた場合の待ち時間の上限
+	decoderMaxBackoff = 30 * time.Second
+	// デコーダーに渡す前に溜めておくパケット数(超えた分は捨てる)
+	decoderInputBuffer = 256
+	// 保存するstderrの行数
+	decoderStderrLines = 20
+)
+
+var (
+	ErrUnknownDecoder = errors.New("unknown decoder type")
+	ErrDecoderStalled = errors.New("decoder stalled")
+)
+
+// ドローンの映像(H.264)をフレームにデコードする
+type VideoDecoder interface {
+	Start()
+	// デコーダーを終了させ、Startで起動したgoroutineが終わるまで待つ
+	Stop()
+	// ドローンから受け取ったH.264のパケットを渡す。ブロックしない
+	Write(pkt []byte) (int, error)
+	Status() DecoderStatus
+}
+
+type DecoderConfig struct {
+	Type string
+	Path string
+	// 入力(pipe:0)より前に付けるオプション
+	InputArgs     []string
+	Hwaccel       string
+	HwaccelDevice string
+	LogLevel      string
+	Width         int
+	Height        int
+	// 終了してから起動し直すまでの時間(失敗が続くと倍にしていく)
+	RestartInterval time.Duration
+	// 映像を渡しているのにこの時間フレームが出てこなければ止まったとみなす
+	StallTimeout time.Duration
+	// ffmpegに追加する環境変数(KEY=value)
+	Env []string
+}
+
+func decoderConfigFromConfig() DecoderConfig {
+	c := config.Config
+	return DecoderConfig{
+		Type:            c.VideoDecoder,
+		Path:            c.FfmpegPath,
+		InputArgs:       c.FfmpegArgs,
+		Hwaccel:         c.VideoHwaccel,
+		HwaccelDevice:   c.VideoHwaccelDevice,
+		LogLevel:        c.VideoLogLevel,
+		Width:           c.VideoWidth,
+		Height:          c.VideoHeight,
+		RestartInterval: c.VideoRestartInterval,
+		StallTimeout:    c.VideoStallTimeout,
+	}
+}
+
+// ffmpegの引数を作成(出力の形式はフレームの読み込み処理に合わせて固定)
+func (c DecoderConfig) Args() []string {
+	args := []string{"-hide_banner", "-nostats", "-loglevel", c.LogLevel}
+	if c.Hwaccel != "" && c.Hwaccel != "none" {
+		args = append(args, "-hwaccel", c.Hwaccel)
+		if c.HwaccelDevice != "" {
+			args = append(args, "-hwaccel_device", c.HwaccelDevice)
+		}
+	}
+	args = append(args, c.InputArgs...)
+	return append(args, "-i", "pipe:0", "-pix_fmt", "bgr24",
+		"-s", strconv.Itoa(c.Width)+"x"+strconv.Itoa(c.Height), "-f", "rawvideo", "pipe:1")
+}
+
+type DecoderStatus struct {
+	Type     string   `json:"type"`
+	State    string   `json:"state"`
+	Args     []string `json:"args,omitempty"`
+	Width    int      `json:"width"`
+	Height   int      `json:"height"`
+	PID      int      `json:"pid,omitempty"`
+	Restarts int      `json:"restarts"`
+	// 直近の1秒間に出力したフレーム数
+	FPS       float64   `json:"fps"`
+	Frames    uint64    `json:"frames"`
+	LastFrame time.Time `json:"last_frame"`
+	// ドローンから受け取ったパケット数と、デコーダーが追いつかずに捨てた数
+	Packets        uint64    `json:"packets"`
+	DroppedPackets uint64    `json:"dropped_packets"`
+	LastInput      time.Time `json:"last_input"`
+	LastError      string    `json:"last_error,omitempty"`
+	// ffmpegのstderrの最後の数行
+	Stderr []string `json:"stderr"`
+}
+
+// デコーダーの実装ごとの処理
+type decoderBackend interface {
+	// デコードを開始する。stderrには実装が出力したログを1行ずつ渡す
+	open(conf DecoderConfig, stderr func(string)) (decoderSession, error)
+}
+
+// 起動してから終了するまでのデコーダー
+type decoderSession interface {
+	// H.264を書き込む
+	io.Writer
+	// BGR24のフレーム(Width x Height)を1枚読み込む
+	readFrame() ([]byte, error)
+	// 止まったデコーダーを強制的に終了させる。readFrameがエラーを返すようになる
+	kill()
+	// readFrameがエラーを返した後に呼び出し、後片付けをして終了の理由を返す
+	close() error
+	// 子プロセスの場合はそのPID
+	pid() int
+}
+
+// デコーダーを動かし続け、異常終了したり、映像を渡しているのにフレームが出てこなくなったりした場合は起動し直す
+type supervisedDecoder struct {
+	conf    DecoderConfig
+	backend decoderBackend
+	publish func(Frame)
+	notify  func(name string, data interface{})
+	input   chan []byte
+	stop    chan struct{}
+	wg      sync.WaitGroup
+
+	mux        sync.Mutex
+	status     DecoderStatus
+	session    decoderSession
+	startedAt  time.Time
+	lastFrames uint64
+	lastCheck  time.Time
+}
+
+// publishはデコードしたフレームの配信先、notifyは状態の通知先
+func NewVideoDecoder(conf DecoderConfig, publish func(Frame), notify func(name string, data interface{})) (VideoDecoder, error) {
+	var backend decoderBackend
+	var args []string
+	switch conf.Type {
+	case DecoderFFmpeg:
+		backend = ffmpegBackend{}
+		args = conf.Args()
+	case DecoderGocv:
+		backend = gocvBackend{}
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownDecoder, conf.Type)
+	}
+	return newSupervisedDecoder(conf, backend, args, publish, notify), nil
+}
+
+func newSupervisedDecoder(conf DecoderConfig, backend decoderBackend, args []string,
+	publish func(Frame), notify func(name string, data interface{})) *supervisedDecoder {
+	return &supervisedDecoder{
+		conf:    conf,
+		backend: backend,
+		publish: publish,
+		notify:  notify,
+		input:   make(chan []byte, decoderInputBuffer),
+		stop:    make(chan struct{}),
+		status: DecoderStatus{
+			Type:   conf.Type,
+			State:  DecoderStarting,
+			Args:   args,
+			Width:  conf.Width,
+			Height: conf.Height,
+			Stderr: []string{},
+		},
+	}
+}
+
+func (dec *supervisedDecoder) Start() {
+	dec.wg.Add(2)
+	go func() {
+		defer dec.wg.Done()
+		dec.supervise()
+	}()
+	go func() {
+		defer dec.wg.Done()
+		dec.watch()
+	}()
+}
+
+// 2回目以降は何もしない
+func (dec *supervisedDecoder) Stop() {
+	dec.mux.Lock()
+	if dec.status.State == DecoderStopped {
+		dec.mux.Unlock()
+		return
+	}
+	dec.status.State = DecoderStopped
+	close(dec.stop)
+	if dec.session != nil {
+		dec.session.kill()
+	}
+	dec.mux.Unlock()
+	dec.wg.Wait()
+	log.Printf("action=decoder type=%s stopped", dec.conf.Type)
+}
+
+func (dec *supervisedDecoder) stopped() bool {
+	select {
+	case <-dec.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// デコーダーが止まっていてもブロックせず、溜めきれない分は捨てる
+func (dec *supervisedDecoder) Write(pkt []byte) (int, error) {
+	dec.mux.Lock()
+	dec.status.Packets++
+	dec.status.LastInput = time.Now()
+	dec.mux.Unlock()
+	select {
+	case dec.input <- pkt:
+	default:
+		dec.mux.Lock()
+		dec.status.DroppedPackets++
+		dec.mux.Unlock()
+	}
+	return len(pkt), nil
+}
+
+func (dec *supervisedDecoder) Status() DecoderStatus {
+	dec.mux.Lock()
+	defer dec.mux.Unlock()
+	status := dec.status
+	status.Stderr = append([]string{}, dec.status.Stderr...)
+	return status
+}
+
+func (dec *supervisedDecoder) supervise() {
+	backoff := dec.conf.RestartInterval
+	for !dec.stopped() {
+		start := time.Now()
+		err := dec.run()
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		dec.mux.Lock()
+		dec.session = nil
+		dec.status.PID = 0
+		if dec.stopped() {
+			dec.mux.Unlock()
+			return
+		}
+		dec.status.State = DecoderRestarting
+		dec.status.LastError = err.Error()
+		// フレームを出力できていた場合は待ち時間を戻す
+		if dec.status.LastFrame.After(start) {
+			backoff = dec.conf.RestartInterval
+		}
+		dec.mux.Unlock()
+		log.Printf("action=decoder type=%s err=%s restart_in=%s", dec.conf.Type, err.Error(), backoff)
+
+		select {
+		case <-dec.stop:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > decoderMaxBackoff {
+			backoff = decoderMaxBackoff
+		}
+		dec.mux.Lock()
+		dec.status.Restarts++
+		dec.mux.Unlock()
+	}
+}
+
+// デコーダーを起動して終了するまでフレームを読み込む
+func (dec *supervisedDecoder) run() error {
+	session, err := dec.backend.open(dec.conf, dec.addStderr)
+	if err != nil {
+		return err
+	}
+	dec.mux.Lock()
+	if dec.stopped() {
+		// 起動している間にStopされた
+		dec.mux.Unlock()
+		session.kill()
+		session.close()
+		return nil
+	}
+	dec.session = session
+	dec.startedAt = time.Now()
+	dec.status.PID = session.pid()
+	dec.status.State = DecoderRunning
+	dec.mux.Unlock()
+	log.Printf("action=decoder type=%s started pid=%d", dec.conf.Type, session.pid())
+
+	done := make(chan struct{})
+	go dec.writeInput(session, done)
+	readErr := dec.readFrames(session)
+	close(done)
+	if err := session.close(); err != nil && readErr != ErrDecoderStalled {
+		return err
+	}
+	return readErr
+}
+
+func (dec *supervisedDecoder) writeInput(w io.Writer, done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case pkt := <-dec.input:
+			if _, err := w.Write(pkt); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (dec *supervisedDecoder) addStderr(line string) {
+	log.Printf("action=decoder type=%s stderr=%q", dec.conf.Type, line)
+	dec.mux.Lock()
+	defer dec.mux.Unlock()
+	dec.status.Stderr = append(dec.status.Stderr, line)
+	if n := len(dec.status.Stderr); n > decoderStderrLines {
+		dec.status.Stderr = dec.status.Stderr[n-decoderStderrLines:]
+	}
+}
+
+func (dec *supervisedDecoder) readFrames(session decoderSession) error {
+	for {
+		buf, err := session.readFrame()
+		if err != nil {
+			dec.mux.Lock()
+			defer dec.mux.Unlock()
+			if dec.status.State == DecoderRestarting {
+				// watchが止まったと判断して終了させた
+				return ErrDecoderStalled
+			}
+			return err
+		}
+		now := time.Now()
+		dec.mux.Lock()
+		dec.status.Frames++
+		dec.status.LastFrame = now
+		dec.mux.Unlock()
+		dec.publish(Frame{Time: now, Width: dec.conf.Width, Height: dec.conf.Height, Data: buf})
+	}
+}
+
+// FPSを計算し、フレームが出てこなくなったデコーダーを終了させる
+func (dec *supervisedDecoder) watch() {
+	ticker := time.NewTicker(decoderCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-dec.stop:
+			return
+		case now := <-ticker.C:
+			dec.notify(DecoderEvent, dec.check(now))
+		}
+	}
+}
+
+func (dec *supervisedDecoder) check(now time.Time) DecoderStatus {
+	dec.mux.Lock()
+	defer dec.mux.Unlock()
+	if !dec.lastCheck.IsZero() {
+		dec.status.FPS = float64(dec.status.Frames-dec.lastFrames) / now.Sub(dec.lastCheck).Seconds()
+	}
+	dec.lastFrames = dec.status.Frames
+	dec.lastCheck = now
+
+	if dec.status.State == DecoderRunning && dec.session != nil && dec.stalled(now) {
+		log.Printf("action=decoder type=%s stalled pid=%d", dec.conf.Type, dec.status.PID)
+		dec.status.State = DecoderRestarting
+		dec.session.kill()
+	}
+	status := dec.status
+	status.Stderr = append([]string{}, dec.status.Stderr...)
+	return status
+}
+
+// 映像を渡し続けているのに、起動または最後のフレームからStallTimeout以上出力がない
+// ロック済みの状態で呼び出すこと
+func (dec *supervisedDecoder) stalled(now time.Time) bool {
+	timeout := dec.conf.StallTimeout
+	if timeout <= 0 || now.Sub(dec.status.LastInput) >= timeout {
+		return false
+	}
+	last := dec.startedAt
+	if dec.status.LastFrame.After(last) {
+		last = dec.status.LastFrame
+	}
+	return now.Sub(last) >= timeout
+}
+
+// ffmpegを子プロセスとして動かし、stdinにH.264を書き込んでstdoutからフレームを読む
+type ffmpegBackend struct{}
+
+type ffmpegSession struct {
+	cmd        *exec.Cmd
+	stdin      io.WriteCloser
+	stdout     io.Reader
+	size       int
+	stderrDone chan struct{}
+}
+
+func (ffmpegBackend) open(conf DecoderConfig, stderr func(string)) (decoderSession, error) {
+	cmd := ffmpegCommand(conf.Path, conf.Env, conf.Args()...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderrPipe, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	s := &ffmpegSession{
+		cmd:        cmd,
+		stdin:      stdin,
+		stdout:     stdout,
+		size:       conf.Width * conf.Height * 3,
+		stderrDone: make(chan struct{}),
+	}
+	go func() {
+		defer close(s.stderrDone)
+		scanner := bufio.NewScanner(stderrPipe)
+		for scanner.Scan() {
+			stderr(scanner.Text())
+		}
+	}()
+	return s, nil
+}
+
+// envはこのプロセスの環境変数に追加する
+func ffmpegCommand(path string, env []string, args ...string) *exec.Cmd {
+	cmd := exec.Command(path, args...)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	return cmd
+}
+
+func (s *ffmpegSession) Write(pkt []byte) (int, error) { return s.stdin.Write(pkt) }
+
+func (s *ffmpegSession) readFrame() ([]byte, error) {
+	buf := make([]byte, s.size)
+	if _, err := io.ReadFull(s.stdout, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (s *ffmpegSession) kill() { s.cmd.Process.Kill() }
+
+func (s *ffmpegSession) close() error {
+	s.stdin.Close()
+	// 出力を閉じただけで動き続けている場合に備えて止める
+	s.cmd.Process.Kill()
+	// stderrを読み終わってからWaitする
+	<-s.stderrDone
+	return s.cmd.Wait()
+}
+
+func (s *ffmpegSession) pid() int { return s.cmd.Process.Pid }
+
+// OpenCVに組み込まれたFFmpegでデコードする(ffmpegのコマンドは不要)
+// VideoCaptureはファイル名しか受け取れないので、名前付きパイプを通してH.264を渡す
+type gocvBackend struct{}
+
+type gocvSession struct {
+	conf    DecoderConfig
+	dir     string
+	path    string
+	pipe    *os.File
+	capture *gocv.VideoCapture
+	img     gocv.Mat
+	resized gocv.Mat
+}
+
+func (gocvBackend) open(conf DecoderConfig, stderr func(string)) (decoderSession, error) {
+	dir, err := ioutil.TempDir("", "tello-video")
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, "video.h264")
+	if err := mkfifo(path); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	// 読み込み側が開くのを待たずに書き込めるように読み書き両用で開く
+	pipe, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return &gocvSession{conf: conf, dir: dir, path: path, pipe: pipe, img: gocv.NewMat(), resized: gocv.NewMat()}, nil
+}
+
+func (s *gocvSession) Write(pkt []byte) (int, error) { return s.pipe.Write(pkt) }
+
+func (s *gocvSession) readFrame() ([]byte, error) {
+	if s.capture == nil {
+		// 映像の形式が分かるまでデータが届くのを待つ
+		capture, err := gocv.VideoCaptureFileWithAPI(s.path, gocv.VideoCaptureFFmpeg)
+		if err != nil {
+			capture.Close()
+			return nil, err
+		}
+		s.capture = capture
+	}
+	if !s.capture.Read(&s.img) || s.img.Empty() {
+		return nil, io.EOF
+	}
+	if s.img.Cols() == s.conf.Width && s.img.Rows() == s.conf.Height {
+		return s.img.ToBytes(), nil
+	}
+	gocv.Resize(s.img, &s.resized, image.Pt(s.conf.Width, s.conf.Height), 0, 0, gocv.InterpolationArea)
+	return s.resized.ToBytes(), nil
+}
+
+// 書き込み側を閉じると、VideoCaptureは映像が終わったとみなしてReadがfalseを返す
+func (s *gocvSession) kill() { s.pipe.Close() }
+
+func (s *gocvSession) close() error {
+	s.pipe.Close()
+	if s.capture != nil {
+		s.capture.Close()
+	}
+	s.img.Close()
+	s.resized.Close()
+	os.RemoveAll(s.dir)
+	return nil
+}
+
+func (s *gocvSession) pid() int { return 0 }
@@ -0,0 +1,262 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+// FAKE_FFMPEGが設定されていればテストのバイナリをffmpegの代わりとして動かす
+// ffmpegの引数はテストのフラグとして解釈できないので、フラグを読む前に切り替える
+func TestMain(m *testing.M) {
+	if mode := os.Getenv("FAKE_FFMPEG"); mode != "" {
+		fakeFFmpeg(mode)
+	}
+	os.Exit(m.Run())
+}
+
+func fakeFFmpeg(mode string) {
+	switch mode {
+	case "exit":
+		// 2フレーム(4x2のBGR)を出力して異常終了する
+		os.Stdout.Write(make([]byte, 4*2*3*2))
+		fmt.Fprintln(os.Stderr, "decode error")
+		os.Exit(1)
+	case "stall":
+		// 入力を読むだけで何も出力しない
+		io.Copy(ioutil.Discard, os.Stdin)
+	case "copy":
+		// -iのファイルを最後の引数のファイルにコピーする(-c copyでMP4にする代わり)
+		var input string
+		for i, arg := range os.Args[:len(os.Args)-1] {
+			if arg == "-i" {
+				input = os.Args[i+1]
+			}
+		}
+		data, err := ioutil.ReadFile(input)
+		if err == nil {
+			err = ioutil.WriteFile(os.Args[len(os.Args)-1], data, 0644)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	os.Exit(0)
+}
+
+// 終了時にStopする
+func newTestDecoder(t *testing.T, mode string) (*supervisedDecoder, *[]Frame, *sync.Mutex) {
+	conf := DecoderConfig{
+		Type:            DecoderFFmpeg,
+		Path:            os.Args[0],
+		LogLevel:        "error",
+		Width:           4,
+		Height:          2,
+		RestartInterval: 50 * time.Millisecond,
+		StallTimeout:    time.Second,
+		Env:             []string{"FAKE_FFMPEG=" + mode},
+	}
+	var mux sync.Mutex
+	frames := []Frame{}
+	dec := newSupervisedDecoder(conf, ffmpegBackend{}, conf.Args(), func(f Frame) {
+		mux.Lock()
+		defer mux.Unlock()
+		frames = append(frames, f)
+	}, func(string, interface{}) {})
+	t.Cleanup(dec.Stop)
+	return dec, &frames, &mux
+}
+
+// 条件を満たすまで待つ
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDecoderConfigArgs(t *testing.T) {
+	conf := DecoderConfig{Hwaccel: "none", HwaccelDevice: "opencl", LogLevel: "error", Width: 640, Height: 480}
+	want := []string{"-hide_banner", "-nostats", "-loglevel", "error", "-i", "pipe:0",
+		"-pix_fmt", "bgr24", "-s", "640x480", "-f", "rawvideo", "pipe:1"}
+	if got := conf.Args(); !reflect.DeepEqual(got, want) {
+		t.Errorf("args = %v, want %v", got, want)
+	}
+	conf.Hwaccel = "auto"
+	if got := strings.Join(conf.Args(), " "); !strings.Contains(got, "-hwaccel auto -hwaccel_device opencl -i pipe:0") {
+		t.Errorf("args = %s, want hwaccel options before the input", got)
+	}
+}
+
+func TestNewVideoDecoder(t *testing.T) {
+	conf := DecoderConfig{Type: DecoderGocv, Width: 320, Height: 240}
+	dec, err := NewVideoDecoder(conf, func(Frame) {}, func(string, interface{}) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ffmpegを使わない場合は引数を表示しない
+	if status := dec.Status(); status.Type != DecoderGocv || status.Args != nil {
+		t.Errorf("status = %+v", status)
+	}
+	conf.Type = "vlc"
+	if _, err := NewVideoDecoder(conf, func(Frame) {}, func(string, interface{}) {}); !errors.Is(err, ErrUnknownDecoder) {
+		t.Errorf("err = %v, want ErrUnknownDecoder", err)
+	}
+}
+
+func TestFFmpegDecoderRestartsOnExit(t *testing.T) {
+	dec, frames, mux := newTestDecoder(t, "exit")
+	dec.Start()
+
+	waitFor(t, "restart", func() bool { return dec.Status().Restarts >= 1 })
+	mux.Lock()
+	n := len(*frames)
+	mux.Unlock()
+	if n < 2 {
+		t.Errorf("published %d frames, want at least 2", n)
+	}
+	status := dec.Status()
+	if status.Frames < 2 || status.LastError == "" {
+		t.Errorf("status = %+v", status)
+	}
+	waitFor(t, "stderr", func() bool {
+		stderr := dec.Status().Stderr
+		return len(stderr) > 0 && stderr[len(stderr)-1] == "decode error"
+	})
+}
+
+func TestFFmpegDecoderStall(t *testing.T) {
+	dec, _, _ := newTestDecoder(t, "stall")
+	dec.Start()
+	waitFor(t, "start", func() bool { return dec.Status().State == DecoderRunning })
+
+	// 映像を渡していなければ止まったとはみなさない
+	if s := dec.check(time.Now().Add(2 * time.Second)); s.State != DecoderRunning {
+		t.Fatalf("state = %s without input, want running", s.State)
+	}
+	dec.Write([]byte{0, 0, 0, 1})
+	now := time.Now()
+	dec.mux.Lock()
+	dec.startedAt = now.Add(-2 * time.Second)
+	dec.mux.Unlock()
+	if s := dec.check(now); s.State != DecoderRestarting {
+		t.Fatalf("state = %s, want restarting", s.State)
+	}
+	waitFor(t, "stall error", func() bool { return dec.Status().LastError == ErrDecoderStalled.Error() })
+}
+
+// Stopすると再起動せずにffmpegを終了させる
+func TestFFmpegDecoderStop(t *testing.T) {
+	dec, _, _ := newTestDecoder(t, "stall")
+	dec.Start()
+	waitFor(t, "start", func() bool { return dec.Status().State == DecoderRunning })
+	pid := dec.Status().PID
+
+	dec.Stop()
+	status := dec.Status()
+	if status.State != DecoderStopped || status.PID != 0 || status.Restarts != 0 {
+		t.Errorf("status = %+v, want stopped without restarts", status)
+	}
+	if p, err := os.FindProcess(pid); err == nil && p.Signal(syscall.Signal(0)) == nil {
+		t.Errorf("ffmpeg (pid %d) is still running", pid)
+	}
+	dec.Stop()
+}
+
+// testdata/tello.h264は32x32の赤、緑、青の3フレーム(I_PCMで符号化)
+// Telloの映像と同じく、各フレームの前にSPSとPPSが付いている
+func TestVideoDecoderFixture(t *testing.T) {
+	fixture, err := ioutil.ReadFile("testdata/tello.h264")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, typ := range []string{DecoderFFmpeg, DecoderGocv} {
+		t.Run(typ, func(t *testing.T) {
+			switch typ {
+			case DecoderFFmpeg:
+				if _, err := exec.LookPath("ffmpeg"); err != nil {
+					t.Skip("ffmpeg is not installed")
+				}
+			case DecoderGocv:
+				capture, err := gocv.VideoCaptureFileWithAPI("testdata/tello.h264", gocv.VideoCaptureFFmpeg)
+				capture.Close()
+				if err != nil {
+					t.Skip("OpenCV cannot decode H.264: " + err.Error())
+				}
+			}
+			testDecodeFixture(t, typ, fixture)
+		})
+	}
+}
+
+func testDecodeFixture(t *testing.T, typ string, fixture []byte) {
+	frames := make(chan Frame, 16)
+	// 縮小してもフレームの色は変わらない
+	conf := DecoderConfig{Type: typ, Path: "ffmpeg", Hwaccel: "none", LogLevel: "error",
+		Width: 16, Height: 16, RestartInterval: time.Second, StallTimeout: 10 * time.Second}
+	dec, err := NewVideoDecoder(conf, func(f Frame) {
+		select {
+		case frames <- f:
+		default:
+		}
+	}, func(string, interface{}) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec.Start()
+	defer dec.Stop()
+
+	// ライブ映像と同じように、Telloのパケットの大きさに区切って流し続ける
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			for i := 0; i < len(fixture); i += 1460 {
+				end := i + 1460
+				if end > len(fixture) {
+					end = len(fixture)
+				}
+				select {
+				case <-stop:
+					return
+				case <-time.After(10 * time.Millisecond):
+					dec.Write(fixture[i:end])
+				}
+			}
+		}
+	}()
+
+	// BGRのどのチャンネルが最も明るいか
+	want := []int{2, 1, 0}
+	for i, channel := range want {
+		select {
+		case f := <-frames:
+			if f.Width != 16 || f.Height != 16 || len(f.Data) != 16*16*3 {
+				t.Fatalf("frame %d: %dx%d %d bytes", i, f.Width, f.Height, len(f.Data))
+			}
+			pixel := f.Data[(8*16+8)*3:][:3]
+			for c := range pixel {
+				if c != channel && pixel[c] >= pixel[channel] {
+					t.Errorf("frame %d: pixel %v, want channel %d brightest", i, pixel, channel)
+				}
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out waiting for frame %d: %+v", i, dec.Status())
+		}
+	}
+}
@@ -0,0 +1,554 @@
+package models
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"udemy_drone/go_tello_edu/config"
+
+	"gocv.io/x/gocv"
+)
+
+const (
+	DetectorHaar  = "haar"
+	DetectorDNN   = "dnn"
+	DetectorColor = "color"
+
+	dnnSSD  = "ssd"
+	dnnYOLO = "yolo"
+	// YOLOで重なった矩形をまとめるしきい値
+	dnnNMSThreshold = 0.4
+)
+
+var (
+	ErrUnknownDetector = errors.New("unknown detector type")
+	ErrInvalidDetector = errors.New("invalid detector config")
+	ErrDetectorLoad    = errors.New("cannot load detector")
+	ErrDetectorPath    = errors.New("detector files must be names in the models directory")
+)
+
+// 選べる検出器の種類
+var DetectorTypes = []string{DetectorHaar, DetectorDNN, DetectorColor}
+
+// 映像から見つけた物体
+type Detection struct {
+	Rect  image.Rectangle `json:"rect"`
+	Label string          `json:"label"`
+	// DNNの確からしさ(0-1)。Haar Cascadeと色検出では0
+	Confidence float64 `json:"confidence"`
+}
+
+// 映像のフレームから追跡する物体を探す
+// 結果は追跡したい順に並べて返す(先頭の物体を追跡する)
+// Detectは映像処理のgoroutineからだけ呼ばれる
+type Detector interface {
+	Detect(img gocv.Mat) []Detection
+	Close() error
+}
+
+// Haar Cascade(OpenCVのXMLファイルなら顔以外でもよい)
+type HaarConfig struct {
+	Cascade string `json:"cascade"`
+	Label   string `json:"label"`
+}
+
+// OpenCVのDNNモジュールで読み込むモデル(CPUで推論する)
+type DNNConfig struct {
+	// ssd(Caffe/ONNXのSSD)、yolo(Darknet/ONNXのYOLO)
+	Kind string `json:"kind"`
+	// .caffemodel, .onnx, .weightsなど
+	Model string `json:"model"`
+	// .prototxt, .cfgなど(ONNXでは空)
+	Config string `json:"config"`
+	// クラス名を1行に1つ書いたファイル(空ならクラス番号を表示する)
+	Labels string `json:"labels"`
+	// 追跡するクラス番号(空なら全て)
+	Classes    []int   `json:"classes"`
+	Confidence float64 `json:"confidence"`
+	// 入力の一辺のピクセル数、画素値の倍率、BGRの平均値(0なら種類ごとの既定値)
+	Size  int       `json:"size"`
+	Scale float64   `json:"scale"`
+	Mean  []float64 `json:"mean"`
+}
+
+// HSVの範囲で色を検出する(OpenCVのHSVはHが0-180、SとVが0-255)
+// Hの下限が上限より大きい場合は、赤のように0をまたぐ範囲とみなす
+type ColorConfig struct {
+	Lower []float64 `json:"lower"`
+	Upper []float64 `json:"upper"`
+	// これより小さい領域(ピクセル数)は無視する
+	MinArea float64 `json:"min_area"`
+	Label   string  `json:"label"`
+}
+
+type DetectorConfig struct {
+	Type  string      `json:"type"`
+	Haar  HaarConfig  `json:"haar"`
+	DNN   DNNConfig   `json:"dnn"`
+	Color ColorConfig `json:"color"`
+}
+
+func detectorConfigFromConfig() DetectorConfig {
+	c := config.Config
+	return DetectorConfig{
+		Type: c.DetectorType,
+		Haar: HaarConfig{Cascade: c.DetectorHaarCascade, Label: c.DetectorHaarLabel},
+		DNN: DNNConfig{
+			Kind:       c.DetectorDNNKind,
+			Model:      c.DetectorDNNModel,
+			Config:     c.DetectorDNNConfig,
+			Labels:     c.DetectorDNNLabels,
+			Classes:    c.DetectorDNNClasses,
+			Confidence: c.DetectorDNNConfidence,
+			Size:       c.DetectorDNNSize,
+			Scale:      c.DetectorDNNScale,
+			Mean:       c.DetectorDNNMean,
+		},
+		Color: ColorConfig{
+			Lower:   c.DetectorColorLower,
+			Upper:   c.DetectorColorUpper,
+			MinArea: c.DetectorColorMinArea,
+			Label:   c.DetectorColorLabel,
+		},
+	}
+}
+
+// 設定のTypeに応じた検出器を作成する
+func NewDetector(conf DetectorConfig) (Detector, error) {
+	switch conf.Type {
+	case DetectorHaar:
+		return newHaarDetector(conf.Haar)
+	case DetectorDNN:
+		return newDNNDetector(conf.DNN)
+	case DetectorColor:
+		return newColorDetector(conf.Color)
+	}
+	return nil, ErrUnknownDetector
+}
+
+func fileExists(name string) error {
+	if name == "" {
+		return fmt.Errorf("%w: no file specified", ErrInvalidDetector)
+	}
+	if _, err := os.Stat(name); err != nil {
+		return fmt.Errorf("%w: %s", ErrDetectorLoad, err.Error())
+	}
+	return nil
+}
+
+// 面積の大きい順に並べる
+func sortByArea(detections []Detection) {
+	sort.SliceStable(detections, func(i, j int) bool {
+		a, b := detections[i].Rect.Size(), detections[j].Rect.Size()
+		return a.X*a.Y > b.X*b.Y
+	})
+}
+
+type haarDetector struct {
+	classifier gocv.CascadeClassifier
+	label      string
+}
+
+func newHaarDetector(conf HaarConfig) (*haarDetector, error) {
+	if err := fileExists(conf.Cascade); err != nil {
+		return nil, err
+	}
+	classifier := gocv.NewCascadeClassifier()
+	if !classifier.Load(conf.Cascade) {
+		classifier.Close()
+		return nil, fmt.Errorf("%w: cannot read cascade file %s", ErrDetectorLoad, conf.Cascade)
+	}
+	return &haarDetector{classifier: classifier, label: conf.Label}, nil
+}
+
+func (h *haarDetector) Detect(img gocv.Mat) []Detection {
+	detections := []Detection{}
+	for _, r := range h.classifier.DetectMultiScale(img) {
+		detections = append(detections, Detection{Rect: r, Label: h.label})
+	}
+	sortByArea(detections)
+	return detections
+}
+
+func (h *haarDetector) Close() error {
+	return h.classifier.Close()
+}
+
+// モデルの種類ごとの入力の既定値
+type dnnInput struct {
+	size   int
+	scale  float64
+	mean   gocv.Scalar
+	swapRB bool
+}
+
+var dnnInputs = map[string]dnnInput{
+	// MobileNet-SSD
+	dnnSSD: {size: 300, scale: 1 / 127.5, mean: gocv.NewScalar(127.5, 127.5, 127.5, 0)},
+	// YOLOv3/v4(Darknet)、YOLOv5(ONNX)
+	dnnYOLO: {size: 416, scale: 1 / 255.0, swapRB: true},
+}
+
+type dnnDetector struct {
+	net     gocv.Net
+	conf    DNNConfig
+	input   dnnInput
+	labels  []string
+	classes map[int]bool
+	// YOLOの出力層
+	outputs []string
+}
+
+func newDNNDetector(conf DNNConfig) (*dnnDetector, error) {
+	input, ok := dnnInputs[conf.Kind]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown dnn kind %q", ErrInvalidDetector, conf.Kind)
+	}
+	if conf.Size > 0 {
+		input.size = conf.Size
+	}
+	if conf.Scale > 0 {
+		input.scale = conf.Scale
+	}
+	switch len(conf.Mean) {
+	case 0:
+	case 3:
+		input.mean = gocv.NewScalar(conf.Mean[0], conf.Mean[1], conf.Mean[2], 0)
+	default:
+		return nil, fmt.Errorf("%w: mean needs 3 values", ErrInvalidDetector)
+	}
+	if conf.Confidence < 0 || conf.Confidence > 1 {
+		return nil, fmt.Errorf("%w: confidence must be 0-1", ErrInvalidDetector)
+	}
+	if err := fileExists(conf.Model); err != nil {
+		return nil, err
+	}
+	if conf.Config != "" {
+		if err := fileExists(conf.Config); err != nil {
+			return nil, err
+		}
+	}
+	var labels []string
+	if conf.Labels != "" {
+		var err error
+		if labels, err = readLabels(conf.Labels); err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrDetectorLoad, err.Error())
+		}
+	}
+
+	net := gocv.ReadNet(conf.Model, conf.Config)
+	if net.Empty() {
+		return nil, fmt.Errorf("%w: cannot read model %s", ErrDetectorLoad, conf.Model)
+	}
+	// GPUのないPCでも動くようにCPUで推論する
+	net.SetPreferableBackend(gocv.NetBackendOpenCV)
+	net.SetPreferableTarget(gocv.NetTargetCPU)
+
+	d := &dnnDetector{net: net, conf: conf, input: input, labels: labels}
+	if len(conf.Classes) > 0 {
+		d.classes = map[int]bool{}
+		for _, c := range conf.Classes {
+			d.classes[c] = true
+		}
+	}
+	if conf.Kind == dnnYOLO {
+		names := net.GetLayerNames()
+		for _, id := range net.GetUnconnectedOutLayers() {
+			// 層の番号は1から始まる
+			if id > 0 && id <= len(names) {
+				d.outputs = append(d.outputs, names[id-1])
+			}
+		}
+	}
+	return d, nil
+}
+
+func readLabels(name string) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	labels := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		labels = append(labels, strings.TrimSpace(scanner.Text()))
+	}
+	return labels, scanner.Err()
+}
+
+func (d *dnnDetector) label(class int) string {
+	if class >= 0 && class < len(d.labels) {
+		return d.labels[class]
+	}
+	return fmt.Sprintf("class %d", class)
+}
+
+func (d *dnnDetector) want(class int) bool {
+	return d.classes == nil || d.classes[class]
+}
+
+func (d *dnnDetector) Detect(img gocv.Mat) []Detection {
+	size := image.Pt(d.input.size, d.input.size)
+	blob := gocv.BlobFromImage(img, d.input.scale, size, d.input.mean, d.input.swapRB, false)
+	defer blob.Close()
+	d.net.SetInput(blob, "")
+
+	var detections []Detection
+	if d.conf.Kind == dnnYOLO {
+		outs := d.net.ForwardLayers(d.outputs)
+		detections = d.parseYOLO(outs, img.Cols(), img.Rows())
+		for i := range outs {
+			outs[i].Close()
+		}
+	} else {
+		out := d.net.Forward("")
+		detections = d.parseSSD(out, img.Cols(), img.Rows())
+		out.Close()
+	}
+	sort.SliceStable(detections, func(i, j int) bool {
+		return detections[i].Confidence > detections[j].Confidence
+	})
+	return detections
+}
+
+// SSDの出力は[1, 1, N, 7]で、1件が(image_id, class, confidence, left, top, right, bottom)
+// 座標は画像に対する比率
+func (d *dnnDetector) parseSSD(out gocv.Mat, width, height int) []Detection {
+	detections := []Detection{}
+	data, err := out.DataPtrFloat32()
+	if err != nil {
+		log.Printf("action=parseSSD err=%s", err.Error())
+		return detections
+	}
+	bounds := image.Rect(0, 0, width, height)
+	w, h := float32(width), float32(height)
+	for i := 0; i+7 <= len(data); i += 7 {
+		v := data[i : i+7]
+		class, confidence := int(v[1]), float64(v[2])
+		if confidence < d.conf.Confidence || !d.want(class) {
+			continue
+		}
+		r := image.Rect(int(v[3]*w), int(v[4]*h), int(v[5]*w), int(v[6]*h)).Intersect(bounds)
+		if r.Empty() {
+			continue
+		}
+		detections = append(detections, Detection{Rect: r, Label: d.label(class), Confidence: confidence})
+	}
+	return detections
+}
+
+// YOLOの出力は1行が(cx, cy, w, h, objectness, クラスごとのスコア...)
+// Darknetは画像に対する比率、ONNXに書き出したモデルは入力のピクセルで座標を返す
+func (d *dnnDetector) parseYOLO(outs []gocv.Mat, width, height int) []Detection {
+	rects := []image.Rectangle{}
+	scores := []float32{}
+	classes := []int{}
+	bounds := image.Rect(0, 0, width, height)
+	threshold := float32(d.conf.Confidence)
+	for _, out := range outs {
+		dims := out.Size()
+		if len(dims) == 0 {
+			continue
+		}
+		stride := dims[len(dims)-1]
+		data, err := out.DataPtrFloat32()
+		if err != nil || stride <= 5 {
+			continue
+		}
+		for i := 0; i+stride <= len(data); i += stride {
+			row := data[i : i+stride]
+			if row[4] < threshold {
+				continue
+			}
+			class, score := 0, float32(0)
+			for c, s := range row[5:] {
+				if s > score {
+					class, score = c, s
+				}
+			}
+			if score < threshold || !d.want(class) {
+				continue
+			}
+			cx, cy, bw, bh := row[0], row[1], row[2], row[3]
+			if cx > 1 || cy > 1 || bw > 1 || bh > 1 {
+				in := float32(d.input.size)
+				cx, cy, bw, bh = cx/in, cy/in, bw/in, bh/in
+			}
+			w, h := float32(width), float32(height)
+			r := image.Rect(int((cx-bw/2)*w), int((cy-bh/2)*h), int((cx+bw/2)*w), int((cy+bh/2)*h)).Intersect(bounds)
+			if r.Empty() {
+				continue
+			}
+			rects = append(rects, r)
+			scores = append(scores, score)
+			classes = append(classes, class)
+		}
+	}
+	detections := []Detection{}
+	if len(rects) == 0 {
+		return detections
+	}
+	// 同じ物体に重なった矩形をまとめる
+	// 残った矩形の番号が先頭から入り、残りは-1のまま
+	indices := make([]int, len(rects))
+	for i := range indices {
+		indices[i] = -1
+	}
+	gocv.NMSBoxes(rects, scores, threshold, dnnNMSThreshold, indices)
+	for _, i := range indices {
+		if i < 0 {
+			break
+		}
+		detections = append(detections, Detection{Rect: rects[i], Label: d.label(classes[i]), Confidence: float64(scores[i])})
+	}
+	return detections
+}
+
+func (d *dnnDetector) Close() error {
+	return d.net.Close()
+}
+
+type colorDetector struct {
+	lower, upper gocv.Scalar
+	// Hが0をまたぐ範囲
+	wrap    bool
+	minArea float64
+	label   string
+}
+
+func newColorDetector(conf ColorConfig) (*colorDetector, error) {
+	if len(conf.Lower) != 3 || len(conf.Upper) != 3 {
+		return nil, fmt.Errorf("%w: lower and upper need 3 values (H, S, V)", ErrInvalidDetector)
+	}
+	for i := 0; i < 3; i++ {
+		if i > 0 && conf.Lower[i] > conf.Upper[i] {
+			return nil, fmt.Errorf("%w: lower must not exceed upper", ErrInvalidDetector)
+		}
+	}
+	return &colorDetector{
+		lower:   gocv.NewScalar(conf.Lower[0], conf.Lower[1], conf.Lower[2], 0),
+		upper:   gocv.NewScalar(conf.Upper[0], conf.Upper[1], conf.Upper[2], 0),
+		wrap:    conf.Lower[0] > conf.Upper[0],
+		minArea: conf.MinArea,
+		label:   conf.Label,
+	}, nil
+}
+
+func (c *colorDetector) Detect(img gocv.Mat) []Detection {
+	hsv := gocv.NewMat()
+	defer hsv.Close()
+	mask := gocv.NewMat()
+	defer mask.Close()
+	gocv.CvtColor(img, &hsv, gocv.ColorBGRToHSV)
+	if c.wrap {
+		// lower.H-180とupper.H-0の2つの範囲を合わせる
+		high := gocv.NewMat()
+		defer high.Close()
+		gocv.InRangeWithScalar(hsv, c.lower, gocv.NewScalar(180, c.upper.Val2, c.upper.Val3, 0), &high)
+		gocv.InRangeWithScalar(hsv, gocv.NewScalar(0, c.lower.Val2, c.lower.Val3, 0), c.upper, &mask)
+		gocv.BitwiseOr(high, mask, &mask)
+	} else {
+		gocv.InRangeWithScalar(hsv, c.lower, c.upper, &mask)
+	}
+
+	contours := gocv.FindContours(mask, gocv.RetrievalExternal, gocv.ChainApproxSimple)
+	defer contours.Close()
+	detections := []Detection{}
+	for i := 0; i < contours.Size(); i++ {
+		contour := contours.At(i)
+		if gocv.ContourArea(contour) < c.minArea {
+			continue
+		}
+		detections = append(detections, Detection{Rect: gocv.BoundingRect(contour), Label: c.label})
+	}
+	sortByArea(detections)
+	return detections
+}
+
+func (c *colorDetector) Close() error {
+	return nil
+}
+
+// 追跡する物体の検出器を切り替える
+// 読み込めなかった場合はエラーを返し、今の検出器を使い続ける
+func (d *DroneManager) SetDetector(conf DetectorConfig) error {
+	detector, err := NewDetector(conf)
+	if err != nil {
+		return err
+	}
+	d.detectorMux.Lock()
+	old := d.detector
+	d.detector = detector
+	d.detectorConf = conf
+	d.detectorMux.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	log.Printf("action=SetDetector type=%s", conf.Type)
+	return nil
+}
+
+// APIなど外部から指定された設定で検出器を切り替える
+// 任意のファイルを開かないように、今の設定から変えたファイルはモデルのディレクトリ内の名前に限る
+func (d *DroneManager) UpdateDetector(conf DetectorConfig) error {
+	conf, err := restrictDetectorFiles(conf, d.CurrentDetector(), config.Config.DetectorModelsDir)
+	if err != nil {
+		return err
+	}
+	return d.SetDetector(conf)
+}
+
+func restrictDetectorFiles(conf, current DetectorConfig, dir string) (DetectorConfig, error) {
+	var err error
+	for _, f := range []struct {
+		name    *string
+		current string
+	}{
+		{&conf.Haar.Cascade, current.Haar.Cascade},
+		{&conf.DNN.Model, current.DNN.Model},
+		{&conf.DNN.Config, current.DNN.Config},
+		{&conf.DNN.Labels, current.DNN.Labels},
+	} {
+		if *f.name, err = modelPath(dir, *f.name, f.current); err != nil {
+			return conf, err
+		}
+	}
+	return conf, nil
+}
+
+// ファイル名をモデルのディレクトリ内のパスにする
+// 空や今の設定と同じ値はそのまま返す
+func modelPath(dir, name, current string) (string, error) {
+	if name == "" || name == current {
+		return name, nil
+	}
+	clean := filepath.Clean(name)
+	if filepath.IsAbs(name) || filepath.VolumeName(name) != "" ||
+		clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%w: %s", ErrDetectorPath, name)
+	}
+	return filepath.Join(dir, clean), nil
+}
+
+func (d *DroneManager) CurrentDetector() DetectorConfig {
+	d.detectorMux.Lock()
+	defer d.detectorMux.Unlock()
+	return d.detectorConf
+}
+
+// 検出器を切り替え中に使わないように、ロックしたまま検出する
+func (d *DroneManager) detect(img gocv.Mat) []Detection {
+	d.detectorMux.Lock()
+	defer d.detectorMux.Unlock()
+	if d.detector == nil {
+		return nil
+	}
+	return d.detector.Detect(img)
+}
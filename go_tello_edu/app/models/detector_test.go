@@ -0,0 +1,167 @@
+package models
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"math"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"gocv.io/x/gocv"
+)
+
+func TestNewDetectorValidates(t *testing.T) {
+	tests := []struct {
+		name string
+		conf DetectorConfig
+		want error
+	}{
+		{"unknown type", DetectorConfig{Type: "sonar"}, ErrUnknownDetector},
+		{"no cascade", DetectorConfig{Type: DetectorHaar}, ErrInvalidDetector},
+		{"missing cascade", DetectorConfig{Type: DetectorHaar, Haar: HaarConfig{Cascade: "no_such.xml"}}, ErrDetectorLoad},
+		{"unknown dnn kind", DetectorConfig{Type: DetectorDNN, DNN: DNNConfig{Kind: "rcnn"}}, ErrInvalidDetector},
+		{"missing model", DetectorConfig{Type: DetectorDNN, DNN: DNNConfig{Kind: dnnSSD, Model: "no_such.onnx"}}, ErrDetectorLoad},
+		{"bad mean", DetectorConfig{Type: DetectorDNN, DNN: DNNConfig{Kind: dnnYOLO, Mean: []float64{1}}}, ErrInvalidDetector},
+		{"short color", DetectorConfig{Type: DetectorColor, Color: ColorConfig{Lower: []float64{0, 0}, Upper: []float64{10, 255, 255}}}, ErrInvalidDetector},
+		{"reversed saturation", DetectorConfig{Type: DetectorColor, Color: ColorConfig{Lower: []float64{0, 200, 0}, Upper: []float64{10, 100, 255}}}, ErrInvalidDetector},
+	}
+	for _, tt := range tests {
+		if _, err := NewDetector(tt.conf); !errors.Is(err, tt.want) {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestColorDetectorHueWrap(t *testing.T) {
+	d, err := newColorDetector(ColorConfig{Lower: []float64{170, 120, 70}, Upper: []float64{10, 255, 255}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !d.wrap {
+		t.Error("hue range 170-10 should wrap around 0")
+	}
+}
+
+func TestSetDetectorKeepsCurrentOnError(t *testing.T) {
+	d, _ := newTestDroneManager(t)
+	color := DetectorConfig{Type: DetectorColor, Color: ColorConfig{Lower: []float64{100, 100, 100}, Upper: []float64{120, 255, 255}}}
+	if err := d.SetDetector(color); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetDetector(DetectorConfig{Type: DetectorHaar, Haar: HaarConfig{Cascade: "no_such.xml"}}); err == nil {
+		t.Fatal("missing cascade should fail")
+	}
+	if got := d.CurrentDetector().Type; got != DetectorColor {
+		t.Errorf("detector = %s, want %s", got, DetectorColor)
+	}
+}
+
+func TestRestrictDetectorFiles(t *testing.T) {
+	current := DetectorConfig{
+		Haar: HaarConfig{Cascade: "app/models/haarcascade_frontalface_default.xml"},
+		DNN:  DNNConfig{Model: "/opt/models/ssd.caffemodel"},
+	}
+	for _, tt := range []struct {
+		name string
+		conf DetectorConfig
+		want DetectorConfig
+		err  bool
+	}{
+		{"unchanged", current, current, false},
+		{"name in models dir",
+			DetectorConfig{Haar: current.Haar, DNN: DNNConfig{Model: "yolo.onnx", Labels: "sub/coco.names"}},
+			DetectorConfig{Haar: current.Haar, DNN: DNNConfig{Model: filepath.Join("models", "yolo.onnx"), Labels: filepath.Join("models", "sub", "coco.names")}},
+			false},
+		{"absolute path", DetectorConfig{Haar: current.Haar, DNN: DNNConfig{Config: "/etc/passwd"}}, DetectorConfig{}, true},
+		{"parent directory", DetectorConfig{Haar: HaarConfig{Cascade: "../config.ini"}}, DetectorConfig{}, true},
+		{"parent after clean", DetectorConfig{Haar: current.Haar, DNN: DNNConfig{Labels: "a/../../secret"}}, DetectorConfig{}, true},
+	} {
+		got, err := restrictDetectorFiles(tt.conf, current, "models")
+		if tt.err {
+			if !errors.Is(err, ErrDetectorPath) {
+				t.Errorf("%s: err = %v, want %v", tt.name, err, ErrDetectorPath)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, %v, want %+v", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+// ネットワークの出力の代わりにfloat32のMatを作る
+func float32Mat(t *testing.T, cols int, values ...float32) gocv.Mat {
+	t.Helper()
+	b := make([]byte, len(values)*4)
+	for i, v := range values {
+		binary.LittleEndian.PutUint32(b[i*4:], math.Float32bits(v))
+	}
+	m, err := gocv.NewMatFromBytes(len(values)/cols, cols, gocv.MatTypeCV32F, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.Close() })
+	return m
+}
+
+func TestParseSSD(t *testing.T) {
+	d := &dnnDetector{
+		conf:    DNNConfig{Confidence: 0.5},
+		labels:  []string{"background", "face"},
+		classes: map[int]bool{1: true, 3: true},
+	}
+	out := float32Mat(t, 7,
+		0, 1, 0.9, 0.25, 0.25, 0.5, 0.75,
+		// 信頼度が低い
+		0, 1, 0.3, 0, 0, 0.5, 0.5,
+		// 対象外のクラス
+		0, 2, 0.8, 0, 0, 0.5, 0.5,
+		// 画像の外
+		0, 1, 0.7, 1.25, 1.25, 1.5, 1.5,
+		// 画像の端で切る
+		0, 3, 0.6, -0.25, 0.5, 0.25, 1.5,
+	)
+	got := d.parseSSD(out, 200, 100)
+	want := []Detection{
+		{Rect: image.Rect(50, 25, 100, 75), Label: "face", Confidence: float64(float32(0.9))},
+		{Rect: image.Rect(0, 50, 50, 100), Label: "class 3", Confidence: float64(float32(0.6))},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("detections = %+v, want %+v", got, want)
+	}
+}
+
+func TestParseYOLO(t *testing.T) {
+	d := &dnnDetector{
+		conf:   DNNConfig{Confidence: 0.5},
+		input:  dnnInput{size: 416},
+		labels: []string{"person", "car"},
+	}
+	// (cx, cy, w, h, objectness, person, car)
+	darknet := float32Mat(t, 7,
+		0.5, 0.5, 0.25, 0.5, 0.9, 0.1, 0.8,
+		// 1行目とほぼ重なるので消える
+		0.515625, 0.5, 0.25, 0.5, 0.9, 0.1, 0.7,
+		// objectnessが低い
+		0.5, 0.5, 0.25, 0.25, 0.3, 0, 0.9,
+	)
+	// ONNXのモデルは入力のピクセルで座標を返す
+	onnx := float32Mat(t, 7,
+		104, 312, 104, 104, 0.8, 0.6, 0.1,
+		// クラスのスコアが低い
+		208, 208, 104, 104, 0.8, 0.2, 0.3,
+	)
+	got := d.parseYOLO([]gocv.Mat{darknet, onnx}, 200, 100)
+	want := []Detection{
+		{Rect: image.Rect(75, 25, 125, 75), Label: "car", Confidence: float64(float32(0.8))},
+		{Rect: image.Rect(25, 62, 75, 87), Label: "person", Confidence: float64(float32(0.6))},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("detections = %+v, want %+v", got, want)
+	}
+	if got := d.parseYOLO([]gocv.Mat{float32Mat(t, 7, 0.5, 0.5, 0.25, 0.25, 0.1, 0, 0)}, 200, 100); len(got) != 0 {
+		t.Errorf("detections below threshold = %+v", got)
+	}
+}
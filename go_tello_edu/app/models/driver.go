@@ -0,0 +1,84 @@
+package models
+
+import (
+	"log"
+	"net"
+
+	"gobot.io/x/gobot"
+	"gobot.io/x/gobot/platforms/dji/tello"
+)
+
+// DroneManagerから利用するドローン操作のインターフェース
+// *tello.Driver以外にもシミュレーターや記録用のドライバーを差し替えられるようにする
+type Drone interface {
+	gobot.Device
+
+	TakeOff() error
+	ThrowTakeOff() error
+	Land() error
+	Hover()
+	CeaseRotation()
+
+	Up(val int) error
+	Down(val int) error
+	Forward(val int) error
+	Backward(val int) error
+	Left(val int) error
+	Right(val int) error
+	Clockwise(val int) error
+	CounterClockwise(val int) error
+
+	FrontFlip() error
+	BackFlip() error
+	LeftFlip() error
+	RightFlip() error
+	Bounce() error
+
+	StartVideo() error
+	SetVideoEncoderRate(rate tello.VideoBitRate) error
+	SetExposure(level int) error
+	SendCommand(cmd string) error
+
+	On(name string, f func(s interface{})) error
+	Once(name string, f func(s interface{})) error
+}
+
+// *tello.DriverがDroneを満たしているかコンパイル時に確認
+var _ Drone = (*tello.Driver)(nil)
+
+// Telloから届く映像パケットを受信してVideoFrameEventとして通知する
+// gobotのドライバーは接続応答を受け取るたびに映像用ポートを開き直し、
+// 2回目以降は開けずに接続がnilで上書きされ、最初に起動した受信のgoroutineは
+// nilの接続からの読み込みでエラーを出し続ける(映像が止まり、CPUを使い続ける)
+// 先にポートを確保しておくとドライバー側の受信処理は起動しないため、再接続しても映像が止まらない
+// ドライバーが開くポートは11111固定なので、別のポートで受信する場合も11111は確保しておく
+func receiveTelloVideo(drone *tello.Driver, port int) error {
+	if port != telloVideoPort {
+		// 映像は届かないので読み込まない(閉じずに持ち続ける)
+		if _, err := net.ListenUDP("udp", &net.UDPAddr{Port: telloVideoPort}); err != nil {
+			return err
+		}
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer conn.Close()
+		for {
+			buf := make([]byte, 2048)
+			n, _, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			if n <= 2 {
+				continue
+			}
+			// 先頭2バイトはTelloのパケットヘッダー
+			drone.Publish(drone.Event(tello.VideoFrameEvent), buf[2:n])
+		}
+	}()
+	log.Printf("action=receiveTelloVideo port=%d", port)
+	return nil
+}
@@ -5,310 +5,453 @@ import (
 	"fmt"
 	"image"
 	"image/color"
-	"io"
 	"io/ioutil"
 	"log"
-	"math"
-	"os/exec"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
+	"udemy_drone/go_tello_edu/config"
 
 	"github.com/hybridgroup/mjpeg"
 	"gobot.io/x/gobot"
 	"gobot.io/x/gobot/platforms/dji/tello"
 	"gocv.io/x/gocv"
-	"golang.org/x/sync/semaphore"
 )
 
 const (
-	DefaultSpeed      = 10
-	WaitDroneStartSec = 5
-	frameX            = 960 / 3
-	frameY            = 720 / 3
-	frameCenterX      = frameX / 2
-	frameCenterY      = frameY / 2
-	frameArea         = frameX * frameY
-	frameSize         = frameArea * 3
-	faceDetectXMLFile = "app/models/haarcascade_frontalface_default.xml"
-	snapshotsFolder   = "static/img/snapshots/"
+	DefaultSpeed            = 10
+	telloVideoPort          = 11111
+	connectionCheckInterval = 500 * time.Millisecond
+	snapshotsFolder         = "static/img/snapshots/"
+)
+
+// デコード後の映像の大きさ(config.iniのvideoで変更できる)
+var (
+	frameX       = config.Config.VideoWidth
+	frameY       = config.Config.VideoHeight
+	frameCenterX = frameX / 2
+	frameCenterY = frameY / 2
+	frameArea    = frameX * frameY
 )
 
 type DroneManager struct {
-	*tello.Driver
-	Speed        int
-	patrolSem    *semaphore.Weighted
-	patrolQuit   chan bool
-	isPatrolling bool
-	// pipe0でドローンのvideoを書き込む
-	ffmpegIn io.WriteCloser
-	// pipe1でドローンのvideoを読み込む
-	ffmpegOut            io.ReadCloser
-	Stream               *mjpeg.Stream
-	faceDetectTrackingOn bool
-	isSnapShot           bool
+	Drone
+	Control *ControlArbiter
+	Patrol  *Patroller
+	Target  *TargetTracker
+	// 顔追跡で使うドローン(Controlで操作権を確認する)
+	tracking    Drone
+	faceTracker *FaceTracker
+	// 追跡する物体の検出器(APIで切り替える)
+	detectorMux  sync.Mutex
+	detector     Detector
+	detectorConf DetectorConfig
+	// 操作画面で設定している速度(atomicで読み書きする)
+	speed int32
+	// ドローンの映像(H.264)をデコードする
+	decoder VideoDecoder
+	Stream  *mjpeg.Stream
+	// デコードしたフレームの配信
+	Frames  *FrameBus
+	overlay videoOverlay
+	// 飛行の録画
+	Recorder *VideoRecorder
+	// 顔追跡中なら1(atomicで読み書きする)
+	faceDetectTracking int32
+	// スナップショットの要求。保存したら受け取ったチャネルを閉じる
+	snapshotRequest chan chan struct{}
+	snapshotMux     sync.Mutex
+	// 接続状態の管理(Droneは未接続時にコマンドを拒否する)
+	driver    Drone
+	conn      *connection
+	emergency *emergencyStop
+	position  *positionEstimator
+	videoOnce sync.Once
+	// FlightDataなどの配信
+	events    *eventHub
+	telemetry telemetryState
+	FlightLog *FlightRecorder
+	Safety    *SafetySupervisor
+	Watchdog  *CommandWatchdog
 }
 
 func NewDroneManager() *DroneManager {
-	drone := tello.NewDriverWithIP("192.168.10.1", "8888")
-
-	ffmpeg := exec.Command("ffmpeg", "-hwaccel", "auto", "-hwaccel_device", "opencl", "-i", "pipe:0", "-pix_fmt", "bgr24",
-		"-s", strconv.Itoa(frameX)+"x"+strconv.Itoa(frameY), "-f", "rawvideo", "pipe:1")
-	ffmpegIn, _ := ffmpeg.StdinPipe()
-	ffmpegOut, _ := ffmpeg.StdoutPipe()
+	drone := tello.NewDriverWithIP(config.Config.DroneIP, strconv.Itoa(config.Config.DroneLocalPort))
+	if err := receiveTelloVideo(drone, config.Config.DroneVideoPort); err != nil {
+		log.Println(err)
+	}
+	return NewDroneManagerWithDrone(drone)
+}
 
+// Droneインターフェースを満たす任意のドライバーからDroneManagerを作成
+func NewDroneManagerWithDrone(drone Drone) *DroneManager {
+	conn := newConnection()
+	emergency := &emergencyStop{}
+	position := newPositionEstimator()
+	fence := geofenceFromConfig()
+	events := newEventHub()
+	conn.onChange = func(state ConnectionState) {
+		events.Publish(ConnectionEvent, state)
+	}
+	connected := &connectedDrone{Drone: drone, conn: conn, stop: emergency}
 	droneManager := &DroneManager{
-		Driver:               drone,
-		Speed:                DefaultSpeed,
-		patrolSem:            semaphore.NewWeighted(1),
-		patrolQuit:           make(chan bool),
-		isPatrolling:         false,
-		ffmpegIn:             ffmpegIn,
-		ffmpegOut:            ffmpegOut,
-		Stream:               mjpeg.NewStream(),
-		faceDetectTrackingOn: false,
-		isSnapShot:           false,
+		Drone: &fencedDrone{
+			Drone:    connected,
+			fence:    fence,
+			position: position,
+		},
+		speed:           DefaultSpeed,
+		Stream:          mjpeg.NewStream(),
+		Frames:          NewFrameBus(),
+		snapshotRequest: make(chan chan struct{}, 1),
+		driver:          drone,
+		conn:            conn,
+		emergency:       emergency,
+		position:        position,
+		events:          events,
+		FlightLog:       NewFlightRecorder(config.Config.FlightLogDir),
 	}
-	work := func() {
-		if err := ffmpeg.Start(); err != nil {
-			log.Println(err)
-			return
-		}
-
-		drone.On(tello.ConnectedEvent, func(data interface{}) {
-			log.Println("Connected")
-			drone.StartVideo()
-			drone.SetVideoEncoderRate(tello.VideoBitRateAuto)
-			drone.SetExposure(0)
-
+	droneManager.Control = newControlArbiter(droneManager, config.Config.ControlManualHold)
+	go droneManager.Control.watch()
+	droneManager.tracking = droneManager.Control.Drone(BehaviorTracking)
+	droneManager.faceTracker = NewFaceTracker(faceTrackerConfigFromConfig())
+	if err := droneManager.SetDetector(detectorConfigFromConfig()); err != nil {
+		log.Printf("action=NewDroneManager detector=%s err=%s", config.Config.DetectorType, err.Error())
+	}
+	droneManager.Target = NewTargetTracker(targetConfigFromConfig(), droneManager.detect, events.Publish)
+	droneManager.Patrol = NewPatroller(droneManager.Control.Drone(BehaviorPatrol), droneManager.Control,
+		droneManager.CurrentSpeed, events.Publish)
+	droneManager.Safety = newSafetySupervisor(droneManager)
+	go droneManager.Safety.watch()
+	droneManager.Watchdog = newCommandWatchdog(droneManager)
+	go droneManager.Watchdog.watch()
+	go (&geofenceGuard{drone: droneManager, mover: connected, fence: fence}).watch()
+
+	// デコーダーが起動できなくても操縦はできるようにする(起動できるまで再試行する)
+	decoderConf := decoderConfigFromConfig()
+	decoder, err := NewVideoDecoder(decoderConf, droneManager.Frames.Publish, events.Publish)
+	if err != nil {
+		log.Printf("action=NewDroneManager decoder=%s err=%s", decoderConf.Type, err.Error())
+		decoderConf.Type = DecoderFFmpeg
+		decoder, _ = NewVideoDecoder(decoderConf, droneManager.Frames.Publish, events.Publish)
+	}
+	droneManager.decoder = decoder
+	droneManager.decoder.Start()
+	droneManager.Recorder = NewVideoRecorder(recordingConfigFromConfig(), droneManager.FlightLog,
+		droneManager.Frames, droneManager.overlay.draw, events.Publish)
+
+	// 接続応答を取りこぼさないように、ドライバーの起動前にイベントを登録する
+	drone.On(tello.ConnectedEvent, func(data interface{}) {
+		log.Println("Connected")
+		conn.handshake()
+		drone.StartVideo()
+		drone.SetVideoEncoderRate(tello.VideoBitRateAuto)
+		drone.SetExposure(0)
+
+		// 再接続時に映像処理が重複しないようにする
+		droneManager.videoOnce.Do(func() {
 			gobot.Every(100*time.Millisecond, func() {
-				drone.StartVideo()
+				droneManager.StartVideo()
 			})
 
 			droneManager.StreamVideo()
 		})
+	})
+
+	drone.On(tello.FlightDataEvent, func(data interface{}) {
+		conn.alive()
+		t := droneManager.telemetry.updateFlightData(data.(*tello.FlightData), conn.status().State)
+		t.Position = position.update(t)
+		events.Publish(TelemetryEvent, t)
+		droneManager.FlightLog.RecordFlightData(t)
+	})
+
+	drone.On(tello.WifiDataEvent, func(data interface{}) {
+		droneManager.telemetry.updateWifi(data.(*tello.WifiData))
+	})
+
+	drone.On(tello.VideoFrameEvent, func(data interface{}) {
+		pkt := data.([]byte)
+		// デコーダーの異常はDecoderStatusで確認する
+		droneManager.decoder.Write(pkt)
+		droneManager.Recorder.Write(pkt)
+	})
+
+	drone.Once(tello.FlightDataEvent, func(data interface{}) {
+		pkt := data.(*tello.FlightData)
+		log.Println("Battery:", pkt.BatteryPercentage, "%")
+	})
 
-		drone.On(tello.VideoFrameEvent, func(data interface{}) {
-			pkt := data.([]byte)
-			if _, err := ffmpegIn.Write(pkt); err != nil {
+	work := func() {
+		// workはドライバーの起動に成功した後に呼ばれる
+		conn.started()
+		if config.Config.DroneVideoPort != telloVideoPort {
+			// ドライバーは起動時に11111番ポートで接続要求を送るので、設定したポートで送り直す
+			if err := drone.SendCommand(connectionRequest(config.Config.DroneVideoPort)); err != nil {
 				log.Println(err)
 			}
-		})
-
-		drone.Once(tello.FlightDataEvent, func(data interface{}) {
-			pkt := data.(*tello.FlightData)
-			log.Println("Battery:", pkt.BatteryPercentage, "%")
-		})
+		}
+		go droneManager.watchConnection()
 	}
 	robot := gobot.NewRobot("tello", []gobot.Connection{}, []gobot.Device{drone}, work)
 	// goroutineを使わないと以降のコードが実行されない
 	// ->非同期に実行
 	go robot.Start()
-	// goroutineを使うとドローンとコネクションできているか確認できない
-	// コネクションしない状態でtakeoffなどを呼ぶと、invalid memory errorが出る可能性あり
-	time.Sleep(WaitDroneStartSec * time.Second)
+	// 接続できなかった場合もwatchConnectionが再接続を続ける
+	if !conn.wait(config.Config.DroneConnectTimeout) {
+		log.Printf("drone is not connected after %s, keep trying in background", config.Config.DroneConnectTimeout)
+	}
 	return droneManager
 }
 
-// 巡回と停止を兼ねている
-func (d *DroneManager) Patrol() {
-	go func() {
-		isAquire := d.patrolSem.TryAcquire(1)
-		if !isAquire {
-			d.patrolQuit <- true
-			d.isPatrolling = false
-			log.Println("パトロール終了")
-			return
+// FlightDataの途絶を検知して接続要求を再送する
+func (d *DroneManager) watchConnection() {
+	t := time.NewTicker(connectionCheckInterval)
+	defer t.Stop()
+	for now := range t.C {
+		resend := d.conn.tick(now, config.Config.DroneConnectTimeout,
+			config.Config.DroneLostTimeout, config.Config.DroneReconnectInterval)
+		if !resend {
+			continue
 		}
-		defer d.patrolSem.Release(1)
-
-		log.Println("パトロール開始")
-		d.isPatrolling = true
-		status := 0
-		t := time.NewTicker(3 * time.Second)
-
-		for {
-			select {
-			case <-t.C:
-				d.Hover()
-				switch status {
-				case 1:
-					log.Println("前")
-					d.Forward(d.Speed)
-				case 2:
-					log.Println("右")
-					d.Right(d.Speed)
-				case 3:
-					log.Println("後")
-					d.Backward(d.Speed)
-				case 4:
-					log.Println("左")
-					d.Left(d.Speed)
-				case 5:
-					status = 0
-				}
-				status++
-			case <-d.patrolQuit:
-				t.Stop()
-				d.Hover()
-				d.isPatrolling = false
-				return
-			}
+		log.Println("action=watchConnection reconnecting")
+		// 接続応答を受け取るとドライバーがConnectedEventを発行する
+		if err := d.driver.SendCommand(connectionRequest(config.Config.DroneVideoPort)); err != nil {
+			log.Println(err)
 		}
-	}()
+	}
 }
 
-func (d *DroneManager) StartPatrol() {
-	if !d.isPatrolling {
-		d.Patrol()
-	}
+func (d *DroneManager) ConnectionStatus() ConnectionStatus {
+	return d.conn.status()
 }
 
-func (d *DroneManager) StopPatrol() {
-	if d.isPatrolling {
-		d.Patrol()
-	}
+func (d *DroneManager) IsConnected() bool {
+	return d.conn.check() == nil
 }
 
-// 画像への装飾を加えるメソッド
-func (d *DroneManager) StreamVideo() {
-	go func(d *DroneManager) {
-		classifier := gocv.NewCascadeClassifier()
-		defer classifier.Close()
+// バッテリー残量が少ない場合は離陸しない
+func (d *DroneManager) TakeOff() error {
+	if err := d.Safety.CheckTakeOff(); err != nil {
+		return err
+	}
+	return d.Drone.TakeOff()
+}
 
-		if !classifier.Load(faceDetectXMLFile) {
-			log.Printf("Error reading cascade file: %s", faceDetectXMLFile)
-			return
-		}
+func (d *DroneManager) ThrowTakeOff() error {
+	if err := d.Safety.CheckTakeOff(); err != nil {
+		return err
+	}
+	return d.Drone.ThrowTakeOff()
+}
 
-		// color for the rect when faces detected
-		blue := color.RGBA{0, 0, 255, 0}
+// 操作画面で設定している速度
+func (d *DroneManager) CurrentSpeed() int {
+	return int(atomic.LoadInt32(&d.speed))
+}
 
-		for {
-			buf := make([]byte, frameSize)
-			if _, err := io.ReadFull(d.ffmpegOut, buf); err != nil {
-				log.Println(err)
-			}
-			img, _ := gocv.NewMatFromBytes(frameY, frameX, gocv.MatTypeCV8UC3, buf)
+func (d *DroneManager) SetSpeed(speed int) {
+	atomic.StoreInt32(&d.speed, int32(speed))
+}
 
-			if img.Empty() {
-				continue
-			}
+// 最新のテレメトリー
+func (d *DroneManager) Telemetry() Telemetry {
+	t := d.telemetry.get()
+	t.Connection = d.conn.status().State
+	t.Position = d.position.get()
+	return t
+}
 
-			if d.faceDetectTrackingOn {
-				d.StopPatrol()
-				// detect faces
-				rects := classifier.DetectMultiScale(img)
-				fmt.Printf("found %d faces\n", len(rects))
-				// 顔が検出されない場合は、一時停止
-				if len(rects) == 0 {
-					fmt.Println("顔が見つかりません")
-					d.Hover()
-				}
-
-				// draw a rectangle around each face on the original image
-				for _, r := range rects {
-					gocv.Rectangle(&img, r, blue, 3)
-					// Pt is shorthand for Point{X, Y}
-					pt := image.Pt(r.Max.X, r.Min.Y-5)
-					gocv.PutText(&img, "Human", pt, gocv.FontHersheyPlain, 1.2, blue, 2)
-					// 顔を追跡する
-					d.chaseFace(r)
-					break // 認識する顔を１つに留める
-				}
-			}
+// テレメトリーなどのイベントを購読する
+// 不要になったら返り値の関数で購読を解除すること
+func (d *DroneManager) SubscribeEvents() (<-chan Event, func()) {
+	return d.events.Subscribe()
+}
 
-			// IMEncodeの返り値がバイト配列から*NativeByteBufferになったため、コードを変更
-			// https://github.com/hybridgroup/gocv/commit/5dbdee404ae6dff1e291080c80973ffd1abdd056
-			jpegBuf, _ := gocv.IMEncode(".jpg", img)
-			jpegBytes := jpegBuf.GetBytes()
-
-			if d.isSnapShot {
-				log.Println("スナップショットが保存されました")
-				backupFileName := snapshotsFolder + time.Now().Format(time.RFC3339) + ".jpg"
-				err := ioutil.WriteFile(backupFileName, jpegBytes, 0644)
-				if err != nil {
-					log.Printf("cannot save snapshot: %s", err.Error())
-				}
-				snapshotFileName := snapshotsFolder + "snapshot.jpg"
-				ioutil.WriteFile(snapshotFileName, jpegBytes, 0644)
-				d.isSnapShot = false
-			}
+// フレームを使う処理(検出・配信・スナップショット)を別々のgoroutineで動かす
+// フレームはデコーダーがFramesに配信する
+func (d *DroneManager) StreamVideo() {
+	go d.detectFrames()
+	go d.streamFrames()
+	go d.snapshotFrames()
+}
 
-			d.Stream.UpdateJPEG(jpegBytes)
-		}
-	}(d)
+// プロセスを終了する前に、録画中のファイルを保存してデコーダーを止める
+func (d *DroneManager) Shutdown() {
+	if _, err := d.Recorder.Stop(); err != nil && err != ErrNotRecording {
+		log.Printf("action=Shutdown err=%s", err.Error())
+	}
+	d.FlightLog.End()
+	d.decoder.Stop()
 }
 
-func (d *DroneManager) EnableFaceDetectTracking() {
-	d.faceDetectTrackingOn = true
+func (d *DroneManager) DecoderStatus() DecoderStatus {
+	return d.decoder.Status()
 }
 
-func (d *DroneManager) DisableFaceDetectTracking() {
-	d.faceDetectTrackingOn = false
-	d.Hover()
+// 追跡する物体を探して機体を動かす
+// 検出が映像より遅い場合は、最新のフレームだけを処理する
+func (d *DroneManager) detectFrames() {
+	frames, unsubscribe := d.Frames.Subscribe("detector", 1, DropOldest)
+	defer unsubscribe()
+	for frame := range frames {
+		img, err := frame.Mat()
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		tracking := d.IsFaceDetectTracking()
+		detections, target, found := d.Target.Process(img, tracking, frame.Time)
+		img.Close()
+		d.overlay.set(detections, target, found)
+		if !tracking {
+			continue
+		}
+		if found {
+			// 物体を追跡する
+			d.chaseFace(target.Rect)
+		} else {
+			// 物体が検出されない場合は、一時停止
+			fmt.Println("追跡する物体が見つかりません")
+			d.faceTracker.Reset()
+			d.tracking.Hover()
+			d.FlightLog.Record(LogTracking, trackingDecision{Moves: []string{"hover"}})
+		}
+	}
 }
 
-func (d *DroneManager) chaseFace(r image.Rectangle) {
-	move := false
-	// 前後左右での追跡
-	faceCenterX := (r.Max.X + r.Min.Y) / 2
-	faceCenterY := (r.Max.Y + r.Min.Y) / 2
-	diffX := frameCenterX - faceCenterX
-	diffY := frameCenterY - faceCenterY
-
-	if diffX > 20 {
-		d.Left(10)
-		fmt.Println("左に移動")
-		move = true
+// 最新の検出結果を重ねてJPEGにする
+func (d *DroneManager) encodeFrame(frame Frame) ([]byte, error) {
+	img, err := frame.Mat()
+	if err != nil {
+		return nil, err
 	}
-	if diffX < -20 {
-		d.Right(10)
-		fmt.Println("右に移動")
-		move = true
+	defer img.Close()
+	d.overlay.draw(&img)
+	// IMEncodeの返り値がバイト配列から*NativeByteBufferになったため、コードを変更
+	// https://github.com/hybridgroup/gocv/commit/5dbdee404ae6dff1e291080c80973ffd1abdd056
+	jpegBuf, err := gocv.IMEncode(".jpg", img)
+	if err != nil {
+		return nil, err
 	}
-	if diffY > 30 {
-		d.Up(10)
-		fmt.Println("上に移動")
-		move = true
+	defer jpegBuf.Close()
+	return append([]byte{}, jpegBuf.GetBytes()...), nil
+}
+
+// MJPEGで配信する
+func (d *DroneManager) streamFrames() {
+	frames, unsubscribe := d.Frames.Subscribe("stream", 1, DropOldest)
+	defer unsubscribe()
+	for frame := range frames {
+		jpegBytes, err := d.encodeFrame(frame)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		d.Stream.UpdateJPEG(jpegBytes)
 	}
-	if diffY < -30 {
-		d.Down(10)
-		fmt.Print("下に移動")
-		move = true
+}
+
+// 要求があれば次のフレームをスナップショットとして保存する
+func (d *DroneManager) snapshotFrames() {
+	frames, unsubscribe := d.Frames.Subscribe("snapshot", 1, DropOldest)
+	defer unsubscribe()
+	for frame := range frames {
+		var done chan struct{}
+		select {
+		case done = <-d.snapshotRequest:
+		default:
+			continue
+		}
+		jpegBytes, err := d.encodeFrame(frame)
+		if err != nil {
+			log.Printf("cannot save snapshot: %s", err.Error())
+			close(done)
+			continue
+		}
+		log.Println("スナップショットが保存されました")
+		backupFileName := snapshotsFolder + time.Now().Format(time.RFC3339) + ".jpg"
+		err = ioutil.WriteFile(backupFileName, jpegBytes, 0644)
+		if err != nil {
+			log.Printf("cannot save snapshot: %s", err.Error())
+		}
+		snapshotFileName := snapshotsFolder + "snapshot.jpg"
+		ioutil.WriteFile(snapshotFileName, jpegBytes, 0644)
+		close(done)
 	}
+}
+
+// 映像に重ねる検出結果
+// 検出は配信より遅いことがあるので、最後の結果を配信するフレームに描く
+type videoOverlay struct {
+	mux        sync.Mutex
+	detections []Detection
+	target     Detection
+	found      bool
+}
+
+func (o *videoOverlay) set(detections []Detection, target Detection, found bool) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	o.detections = detections
+	o.target = target
+	o.found = found
+}
 
-	// 前後での追跡
-	faceWidth := r.Max.X - r.Min.X
-	faceHeight := r.Max.Y - r.Min.Y
-	faceArea := faceWidth * faceHeight
-	percentF := math.Round(float64(faceArea) / float64(frameArea) * 100)
-	fmt.Println(percentF)
-
-	if percentF > 15 {
-		d.Backward(10)
-		fmt.Println("後ろに移動")
-		move = true
+func (o *videoOverlay) draw(img *gocv.Mat) {
+	// color for the rect when objects detected
+	blue := color.RGBA{0, 0, 255, 0}
+	// 追跡していない物体(クリックすると追跡する物体を選べる)
+	green := color.RGBA{0, 255, 0, 0}
+
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	for _, det := range o.detections {
+		gocv.Rectangle(img, det.Rect, green, 1)
 	}
-	if percentF < 5 {
-		d.Forward(10)
-		fmt.Println("前に移動")
-		move = true
+	if o.found {
+		r := o.target.Rect
+		gocv.Rectangle(img, r, blue, 3)
+		// Pt is shorthand for Point{X, Y}
+		pt := image.Pt(r.Max.X, r.Min.Y-5)
+		gocv.PutText(img, o.target.Label, pt, gocv.FontHersheyPlain, 1.2, blue, 2)
 	}
+}
 
-	if !move {
-		d.Hover()
-	}
+func (d *DroneManager) EnableFaceDetectTracking() {
+	d.faceTracker.Reset()
+	atomic.StoreInt32(&d.faceDetectTracking, 1)
+	d.Control.Handover(BehaviorTracking)
+}
+
+func (d *DroneManager) DisableFaceDetectTracking() {
+	atomic.StoreInt32(&d.faceDetectTracking, 0)
+	d.tracking.Hover()
+	d.Control.Release(BehaviorTracking)
+}
+
+func (d *DroneManager) IsFaceDetectTracking() bool {
+	return atomic.LoadInt32(&d.faceDetectTracking) == 1
 }
 
+// 次のフレームをスナップショットとして保存する
 func (d *DroneManager) TakeSnapshot() {
-	d.isSnapShot = true
+	// 同時に呼ばれても要求は1つずつ出す
+	d.snapshotMux.Lock()
+	defer d.snapshotMux.Unlock()
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
+	done := make(chan struct{})
+	d.snapshotRequest <- done
 	// 2秒経っても処理が終わらなければ中断する
-	for {
-		if !d.isSnapShot || ctx.Err() != nil {
-			break
+	select {
+	case <-done:
+	case <-ctx.Done():
+		// 映像が届いていない場合は要求を取り下げる
+		select {
+		case <-d.snapshotRequest:
+		default:
 		}
 	}
-	d.isSnapShot = false
 }
@@ -0,0 +1,129 @@
+package models
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"gobot.io/x/gobot"
+	"gobot.io/x/gobot/platforms/dji/tello"
+)
+
+// 送られたコマンドを記録するだけのドローン
+type fakeDrone struct {
+	mux      sync.Mutex
+	commands []string
+}
+
+func (f *fakeDrone) record(command string) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.commands = append(f.commands, command)
+	return nil
+}
+
+func (f *fakeDrone) Commands() []string {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return append([]string{}, f.commands...)
+}
+
+func (f *fakeDrone) Name() string                   { return "fake" }
+func (f *fakeDrone) SetName(string)                 {}
+func (f *fakeDrone) Start() error                   { return nil }
+func (f *fakeDrone) Halt() error                    { return nil }
+func (f *fakeDrone) Connection() gobot.Connection   { return nil }
+func (f *fakeDrone) TakeOff() error                 { return f.record("takeoff") }
+func (f *fakeDrone) ThrowTakeOff() error            { return f.record("throw_takeoff") }
+func (f *fakeDrone) Land() error                    { return f.record("land") }
+func (f *fakeDrone) Hover()                         { f.record("hover") }
+func (f *fakeDrone) CeaseRotation()                 { f.record("cease_rotation") }
+func (f *fakeDrone) Up(val int) error               { return f.record("up") }
+func (f *fakeDrone) Down(val int) error             { return f.record("down") }
+func (f *fakeDrone) Forward(val int) error          { return f.record("forward") }
+func (f *fakeDrone) Backward(val int) error         { return f.record("backward") }
+func (f *fakeDrone) Left(val int) error             { return f.record("left") }
+func (f *fakeDrone) Right(val int) error            { return f.record("right") }
+func (f *fakeDrone) Clockwise(val int) error        { return f.record("clockwise") }
+func (f *fakeDrone) CounterClockwise(val int) error { return f.record("counter_clockwise") }
+func (f *fakeDrone) FrontFlip() error               { return f.record("front_flip") }
+func (f *fakeDrone) BackFlip() error                { return f.record("back_flip") }
+func (f *fakeDrone) LeftFlip() error                { return f.record("left_flip") }
+func (f *fakeDrone) RightFlip() error               { return f.record("right_flip") }
+func (f *fakeDrone) Bounce() error                  { return f.record("bounce") }
+func (f *fakeDrone) StartVideo() error              { return nil }
+func (f *fakeDrone) SetExposure(level int) error    { return nil }
+func (f *fakeDrone) SendCommand(cmd string) error   { return nil }
+
+func (f *fakeDrone) SetVideoEncoderRate(rate tello.VideoBitRate) error { return nil }
+func (f *fakeDrone) On(name string, fn func(s interface{})) error      { return nil }
+func (f *fakeDrone) Once(name string, fn func(s interface{})) error    { return nil }
+
+// ドライバーや映像処理を起動せずに、コマンドを記録するDroneManagerを作る
+// フライトログはテストごとの一時ディレクトリに記録する
+func newTestDroneManager(t *testing.T) (*DroneManager, *fakeDrone) {
+	fake := &fakeDrone{}
+	d := &DroneManager{
+		Drone:           fake,
+		speed:           DefaultSpeed,
+		snapshotRequest: make(chan chan struct{}, 1),
+		events:          newEventHub(),
+		FlightLog:       NewFlightRecorder(t.TempDir()),
+	}
+	d.Control = newControlArbiter(d, 50*time.Millisecond)
+	d.tracking = d.Control.Drone(BehaviorTracking)
+	d.faceTracker = NewFaceTracker(testTrackerConfig)
+	d.Patrol = NewPatroller(d.Control.Drone(BehaviorPatrol), d.Control, d.CurrentSpeed, d.events.Publish)
+	d.Safety = newSafetySupervisor(d)
+	return d, fake
+}
+
+// HTTPハンドラーから同時に操作されても競合しないこと(go test -raceで確認する)
+func TestDroneManagerConcurrentControls(t *testing.T) {
+	d, _ := newTestDroneManager(t)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				d.SetSpeed(i*10 + j%10)
+				_ = d.CurrentSpeed()
+				if j%2 == 0 {
+					d.EnableFaceDetectTracking()
+				} else {
+					d.DisableFaceDetectTracking()
+				}
+				_ = d.IsFaceDetectTracking()
+			}
+		}(i)
+	}
+	wg.Wait()
+	d.DisableFaceDetectTracking()
+	if d.IsFaceDetectTracking() {
+		t.Error("face tracking should be disabled")
+	}
+}
+
+func TestTakeSnapshot(t *testing.T) {
+	d, _ := newTestDroneManager(t)
+	saved := make(chan struct{})
+	// 映像処理の代わりに要求を受け取って保存したことにする
+	go func() {
+		done := <-d.snapshotRequest
+		close(done)
+		close(saved)
+	}()
+	start := time.Now()
+	d.TakeSnapshot()
+	<-saved
+	if time.Since(start) >= 2*time.Second {
+		t.Error("TakeSnapshot should return as soon as the frame is saved")
+	}
+
+	// 映像が届いていない場合はタイムアウトして要求を取り下げる
+	d.TakeSnapshot()
+	if len(d.snapshotRequest) != 0 {
+		t.Error("pending snapshot request should be withdrawn after timeout")
+	}
+}
@@ -0,0 +1,329 @@
+package models
+
+import (
+	"math"
+	"sync"
+	"time"
+	"udemy_drone/go_tello_edu/config"
+
+	"gobot.io/x/gobot"
+	"gobot.io/x/gobot/platforms/dji/tello"
+)
+
+// ドライランで使う機体のモデル(simulatorと同じ値)
+const (
+	dryRunHorizontalSpeed = 2.0 // m/s (スティック最大時)
+	dryRunVerticalSpeed   = 1.0 // m/s
+	dryRunYawRate         = 90.0
+	dryRunTakeOffHeight   = 1.0
+	dryRunLandingSpeed    = 0.5
+	dryRunFlipTime        = time.Second
+	dryRunFlyingDrain     = 100.0 / (10 * 60) // %/s
+	dryRunStep            = 100 * time.Millisecond
+	dryRunPathInterval    = 500 * time.Millisecond
+	// シェイクゲームのコースは1秒に2回振るものとして計算する
+	dryRunShakeInterval = 500 * time.Millisecond
+	// 終わらないミッションを打ち切る時間
+	dryRunMaxDuration = 10 * time.Minute
+)
+
+// ドライランで記録したコマンド
+type DryRunCommand struct {
+	Time    float64 `json:"time"`
+	Command string  `json:"command"`
+	Value   int     `json:"value,omitempty"`
+	Step    int     `json:"step"`
+}
+
+// ドライランで推定した機体の位置
+type DryRunPoint struct {
+	Time    float64 `json:"time"`
+	X       float64 `json:"x"`
+	Y       float64 `json:"y"`
+	Z       float64 `json:"z"`
+	Yaw     float64 `json:"yaw"`
+	Battery float64 `json:"battery"`
+}
+
+type DryRunResult struct {
+	Name         string          `json:"name"`
+	Duration     float64         `json:"duration"`
+	StartBattery float64         `json:"start_battery"`
+	EndBattery   float64         `json:"end_battery"`
+	BatteryUsed  float64         `json:"battery_used"`
+	MaxHeight    float64         `json:"max_height"`
+	MaxRadius    float64         `json:"max_radius"`
+	Completed    bool            `json:"completed"`
+	Warnings     []string        `json:"warnings"`
+	Timeline     []DryRunCommand `json:"timeline"`
+	Path         []DryRunPoint   `json:"path"`
+}
+
+// 実機に送らずにコマンドを記録し、簡単なモデルで機体の動きを計算するDrone
+type RecordingDrone struct {
+	mux      sync.Mutex
+	name     string
+	now      time.Time
+	start    time.Time
+	speed    int
+	step     func() int
+	commands []DryRunCommand
+
+	// 離陸地点からの位置(m)と機首方位(deg)
+	x, y, z, yaw float64
+	// -1.0~1.0のスティック入力
+	rx, ry, ly, lx float64
+	flying         bool
+	takingOff      bool
+	landing        bool
+	flipUntil      time.Time
+	battery        float64
+}
+
+var _ CourseDrone = (*RecordingDrone)(nil)
+
+func NewRecordingDrone(battery float64, speed int) *RecordingDrone {
+	start := time.Now()
+	return &RecordingDrone{name: "dryrun", now: start, start: start, battery: battery, speed: speed}
+}
+
+// 仮想時計の現在時刻
+func (r *RecordingDrone) Now() time.Time {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return r.now
+}
+
+// 仮想時計をdtだけ進めて機体の状態を更新する
+func (r *RecordingDrone) Advance(dt time.Duration) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.now = r.now.Add(dt)
+	sec := dt.Seconds()
+	if !r.flying {
+		return
+	}
+	r.battery = math.Max(0, r.battery-dryRunFlyingDrain*sec)
+	switch {
+	case r.takingOff:
+		r.z = math.Min(dryRunTakeOffHeight, r.z+dryRunVerticalSpeed*sec)
+		r.takingOff = r.z < dryRunTakeOffHeight
+	case r.landing:
+		r.z = math.Max(0, r.z-dryRunLandingSpeed*sec)
+		if r.z == 0 {
+			r.flying, r.landing = false, false
+			r.rx, r.ry, r.ly, r.lx = 0, 0, 0, 0
+		}
+	case r.now.Before(r.flipUntil):
+	default:
+		r.yaw = math.Mod(r.yaw+r.lx*dryRunYawRate*sec+360, 360)
+		rad := r.yaw * math.Pi / 180
+		forward := r.ry * dryRunHorizontalSpeed
+		side := r.rx * dryRunHorizontalSpeed
+		r.x += (forward*math.Cos(rad) - side*math.Sin(rad)) * sec
+		r.y += (forward*math.Sin(rad) + side*math.Cos(rad)) * sec
+		r.z = math.Max(0, r.z+r.ly*dryRunVerticalSpeed*sec)
+	}
+}
+
+func (r *RecordingDrone) point() DryRunPoint {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return DryRunPoint{
+		Time:    r.now.Sub(r.start).Seconds(),
+		X:       r.x,
+		Y:       r.y,
+		Z:       r.z,
+		Yaw:     r.yaw,
+		Battery: r.battery,
+	}
+}
+
+// ロック済みの状態で呼び出すこと
+func (r *RecordingDrone) record(command string, value int) {
+	step := 0
+	if r.step != nil {
+		step = r.step()
+	}
+	r.commands = append(r.commands, DryRunCommand{
+		Time:    r.now.Sub(r.start).Seconds(),
+		Command: command,
+		Value:   value,
+		Step:    step,
+	})
+}
+
+func (r *RecordingDrone) stick(command string, val int, axis *float64, sign float64) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.record(command, val)
+	*axis = sign * float64(val) / 100
+	return nil
+}
+
+func (r *RecordingDrone) flip(command string) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.record(command, 0)
+	r.flipUntil = r.now.Add(dryRunFlipTime)
+	return nil
+}
+
+func (r *RecordingDrone) Telemetry() Telemetry {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return Telemetry{
+		Time:       r.now,
+		Connection: StateConnected,
+		Battery:    int(math.Ceil(r.battery)),
+		Height:     r.z,
+		Flying:     r.flying,
+		OnGround:   !r.flying,
+		Position:   Position{X: r.x, Y: r.y, Z: r.z},
+	}
+}
+
+func (r *RecordingDrone) CurrentSpeed() int { return r.speed }
+
+func (r *RecordingDrone) Name() string                 { return r.name }
+func (r *RecordingDrone) SetName(n string)             { r.name = n }
+func (r *RecordingDrone) Start() error                 { return nil }
+func (r *RecordingDrone) Halt() error                  { return nil }
+func (r *RecordingDrone) Connection() gobot.Connection { return nil }
+
+func (r *RecordingDrone) TakeOff() error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.record("takeOff", 0)
+	if !r.flying {
+		r.flying, r.takingOff = true, true
+	}
+	return nil
+}
+
+func (r *RecordingDrone) ThrowTakeOff() error {
+	return r.TakeOff()
+}
+
+func (r *RecordingDrone) Land() error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.record("land", 0)
+	if r.flying {
+		r.landing = true
+	}
+	return nil
+}
+
+func (r *RecordingDrone) Hover() {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.record("hover", 0)
+	r.rx, r.ry, r.ly, r.lx = 0, 0, 0, 0
+}
+
+func (r *RecordingDrone) CeaseRotation() {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.record("ceaseRotation", 0)
+	r.lx = 0
+}
+
+func (r *RecordingDrone) Up(val int) error       { return r.stick("up", val, &r.ly, 1) }
+func (r *RecordingDrone) Down(val int) error     { return r.stick("down", val, &r.ly, -1) }
+func (r *RecordingDrone) Forward(val int) error  { return r.stick("forward", val, &r.ry, 1) }
+func (r *RecordingDrone) Backward(val int) error { return r.stick("backward", val, &r.ry, -1) }
+func (r *RecordingDrone) Left(val int) error     { return r.stick("left", val, &r.rx, -1) }
+func (r *RecordingDrone) Right(val int) error    { return r.stick("right", val, &r.rx, 1) }
+func (r *RecordingDrone) Clockwise(val int) error {
+	return r.stick("clockwise", val, &r.lx, 1)
+}
+func (r *RecordingDrone) CounterClockwise(val int) error {
+	return r.stick("counterClockwise", val, &r.lx, -1)
+}
+
+func (r *RecordingDrone) FrontFlip() error { return r.flip("frontFlip") }
+func (r *RecordingDrone) BackFlip() error  { return r.flip("backFlip") }
+func (r *RecordingDrone) LeftFlip() error  { return r.flip("leftFlip") }
+func (r *RecordingDrone) RightFlip() error { return r.flip("rightFlip") }
+func (r *RecordingDrone) Bounce() error    { return r.flip("bounce") }
+
+func (r *RecordingDrone) StartVideo() error                                 { return nil }
+func (r *RecordingDrone) SetVideoEncoderRate(rate tello.VideoBitRate) error { return nil }
+func (r *RecordingDrone) SetExposure(level int) error                       { return nil }
+func (r *RecordingDrone) SendCommand(cmd string) error                      { return nil }
+func (r *RecordingDrone) On(name string, f func(s interface{})) error       { return nil }
+func (r *RecordingDrone) Once(name string, f func(s interface{})) error     { return nil }
+
+// ミッションを実機に送らずに実行し、コマンドの時系列と推定した飛行経路を返す
+// CourseRunnerと同じ間隔でRunを呼び、仮想時計を進める
+func DryRun(m *Mission, battery float64, speed int) *DryRunResult {
+	fence := geofenceFromConfig()
+	drone := NewRecordingDrone(battery, speed)
+	course := &MissionCourse{
+		Course:  Course{Name: m.Name, Drone: drone, Clock: drone.Now},
+		Mission: m,
+	}
+	// コースのロック中に呼ばれるので直接参照する
+	drone.step = func() int { return course.step + 1 }
+
+	result := &DryRunResult{Name: m.Name, StartBattery: battery, Warnings: []string{}}
+	course.Start()
+	nextPoint := time.Duration(0)
+	var elapsed time.Duration
+	for ; elapsed <= dryRunMaxDuration; elapsed += dryRunStep {
+		if elapsed >= nextPoint {
+			result.Path = append(result.Path, drone.point())
+			nextPoint += dryRunPathInterval
+		}
+		if elapsed%dryRunShakeInterval == 0 {
+			course.Shake()
+		}
+		course.Run()
+		if !course.Running() {
+			break
+		}
+		drone.Advance(dryRunStep)
+	}
+	// 着陸が終わるまで進める
+	for drone.Telemetry().Flying && elapsed <= dryRunMaxDuration {
+		drone.Advance(dryRunStep)
+		elapsed += dryRunStep
+		if elapsed >= nextPoint {
+			result.Path = append(result.Path, drone.point())
+			nextPoint += dryRunPathInterval
+		}
+	}
+	last := drone.point()
+	result.Path = append(result.Path, last)
+
+	result.Completed = course.Progress().Completed
+	result.Duration = last.Time
+	result.EndBattery = last.Battery
+	result.BatteryUsed = battery - last.Battery
+	result.Timeline = drone.commands
+	for _, p := range result.Path {
+		result.MaxHeight = math.Max(result.MaxHeight, p.Z)
+		result.MaxRadius = math.Max(result.MaxRadius, math.Hypot(p.X, p.Y))
+	}
+
+	if !result.Completed {
+		result.Warnings = append(result.Warnings, "mission did not finish within "+dryRunMaxDuration.String())
+	}
+	if drone.Telemetry().Flying {
+		result.Warnings = append(result.Warnings, "drone is still flying at the end of the mission")
+	}
+	for _, p := range result.Path {
+		if reason := fence.violation(Position{X: p.X, Y: p.Y, Z: p.Z}, 0); reason != "" {
+			result.Warnings = append(result.Warnings, "geofence "+reason+" limit would be exceeded")
+			break
+		}
+	}
+	if min := config.Config.SafetyTakeOffMinBattery; min > 0 && battery < float64(min) {
+		result.Warnings = append(result.Warnings, "battery is below the takeoff minimum")
+	}
+	if land := config.Config.SafetyBatteryLand; land > 0 && result.EndBattery <= float64(land) {
+		result.Warnings = append(result.Warnings, "battery would reach the auto-land level")
+	}
+	return result
+}
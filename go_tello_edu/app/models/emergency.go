@@ -0,0 +1,74 @@
+package models
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+	"udemy_drone/go_tello_edu/config"
+)
+
+var ErrEmergencyStop = errors.New("commands are locked by emergency stop")
+
+// 緊急停止の状態
+// 停止後しばらくは着陸以外のコマンドを拒否し、
+// 実行中だった巡回やコースのgoroutineが後からコマンドを送っても機体が動かないようにする
+type emergencyStop struct {
+	mux   sync.Mutex
+	until time.Time
+	// 緊急停止時に呼ぶ処理(実行中のコースの中断など)
+	handlers []func()
+}
+
+func (e *emergencyStop) lock(d time.Duration) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	e.until = time.Now().Add(d)
+}
+
+func (e *emergencyStop) check() error {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	if time.Now().Before(e.until) {
+		return ErrEmergencyStop
+	}
+	return nil
+}
+
+// 緊急停止時に呼ぶ処理を登録する
+// 処理はコースや巡回のロックを待たずに呼ばれるので、ブロックしないこと
+func (d *DroneManager) OnEmergency(f func()) {
+	d.emergency.mux.Lock()
+	defer d.emergency.mux.Unlock()
+	d.emergency.handlers = append(d.emergency.handlers, f)
+}
+
+// 緊急停止
+// 先にコマンドをロックしてからホバリングして着陸し、自律動作を全て止める
+// (gobotのtelloドライバーにはモーターを即時停止するコマンドがないため、着陸で止める)
+// 着陸は接続状態やロックを確認するDroneを通さずにドライバーへ直接送る
+// 通信断の間は届いたかわからないので、再接続後に安全機能が再送する
+func (d *DroneManager) Emergency() error {
+	log.Println("action=Emergency")
+	d.emergency.lock(config.Config.EmergencyLockout)
+	d.Control.ClaimFor(BehaviorEmergency, config.Config.EmergencyLockout)
+
+	// ドライバーの起動前に送るとgobotの内部でpanicするので、起動前だけは送らない
+	err := d.conn.checkStarted()
+	if err == nil {
+		d.driver.Hover()
+		err = d.driver.Land()
+	}
+	err = d.Safety.landSent(err)
+
+	d.emergency.mux.Lock()
+	handlers := append([]func(){}, d.emergency.handlers...)
+	d.emergency.mux.Unlock()
+	for _, f := range handlers {
+		f()
+	}
+	d.Patrol.Stop()
+	d.DisableFaceDetectTracking()
+	d.Safety.report("emergency", SafetyLand, d.Telemetry().Battery)
+	return err
+}
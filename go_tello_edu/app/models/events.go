@@ -0,0 +1,119 @@
+package models
+
+import (
+	"sync"
+)
+
+// ブラウザなどに通知するイベント
+type Event struct {
+	Name string      `json:"name"`
+	Data interface{} `json:"data"`
+}
+
+const eventBufferSize = 16
+
+// 複数の購読者にイベントを配信する
+// 受信が遅い購読者のためにドローン側の処理が止まらないよう、バッファが一杯の場合は破棄する
+// 安全機能のように取りこぼせない購読者はSubscribeReliableで購読する
+type eventHub struct {
+	mux         sync.Mutex
+	subscribers map[chan Event]struct{}
+	queues      map[*eventQueue]struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subscribers: map[chan Event]struct{}{}, queues: map[*eventQueue]struct{}{}}
+}
+
+func (h *eventHub) Publish(name string, data interface{}) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	e := Event{Name: name, Data: data}
+	for ch := range h.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+	for q := range h.queues {
+		q.push(e)
+	}
+}
+
+// 購読を開始する
+// 不要になったら返り値の関数で購読を解除すること
+func (h *eventHub) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, eventBufferSize)
+	h.mux.Lock()
+	h.subscribers[ch] = struct{}{}
+	h.mux.Unlock()
+	return ch, func() {
+		h.mux.Lock()
+		defer h.mux.Unlock()
+		if _, ok := h.subscribers[ch]; ok {
+			delete(h.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// 上限のないイベントのキュー
+// Publishは接続状態のロック中などからも呼ばれるので、購読者が遅くても待たせない
+type eventQueue struct {
+	mux    sync.Mutex
+	events []Event
+	signal chan struct{}
+	done   chan struct{}
+}
+
+func (q *eventQueue) push(e Event) {
+	q.mux.Lock()
+	q.events = append(q.events, e)
+	q.mux.Unlock()
+	select {
+	case q.signal <- struct{}{}:
+	default:
+	}
+}
+
+// キューのイベントを順にchに送る
+func (q *eventQueue) forward(ch chan<- Event) {
+	defer close(ch)
+	for {
+		select {
+		case <-q.done:
+			return
+		case <-q.signal:
+		}
+		q.mux.Lock()
+		events := q.events
+		q.events = nil
+		q.mux.Unlock()
+		for _, e := range events {
+			select {
+			case ch <- e:
+			case <-q.done:
+				return
+			}
+		}
+	}
+}
+
+// イベントを破棄せずに購読する
+// 受信が遅れてもイベントはキューに溜まり、届いた順に全て受け取れる
+// 不要になったら返り値の関数で購読を解除すること(解除後は残りのイベントを破棄する)
+func (h *eventHub) SubscribeReliable() (<-chan Event, func()) {
+	q := &eventQueue{signal: make(chan struct{}, 1), done: make(chan struct{})}
+	ch := make(chan Event)
+	go q.forward(ch)
+	h.mux.Lock()
+	h.queues[q] = struct{}{}
+	h.mux.Unlock()
+	var once sync.Once
+	return ch, func() {
+		h.mux.Lock()
+		delete(h.queues, q)
+		h.mux.Unlock()
+		once.Do(func() { close(q.done) })
+	}
+}
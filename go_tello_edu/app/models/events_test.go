@@ -0,0 +1,47 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEventHubReliableSubscriber(t *testing.T) {
+	hub := newEventHub()
+	lossy, unsubscribeLossy := hub.Subscribe()
+	defer unsubscribeLossy()
+	reliable, unsubscribe := hub.SubscribeReliable()
+
+	const n = eventBufferSize * 4
+	for i := 0; i < n; i++ {
+		hub.Publish(ConnectionEvent, i)
+	}
+	if len(lossy) != eventBufferSize {
+		t.Errorf("lossy subscriber has %d events, want %d", len(lossy), eventBufferSize)
+	}
+	for i := 0; i < n; i++ {
+		select {
+		case e := <-reliable:
+			if e.Data != i {
+				t.Fatalf("event %d = %v", i, e.Data)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for event %d", i)
+		}
+	}
+
+	// 解除したらチャネルが閉じる
+	hub.Publish(ConnectionEvent, n)
+	unsubscribe()
+	unsubscribe()
+	deadline := time.After(time.Second)
+	for {
+		select {
+		case _, ok := <-reliable:
+			if !ok {
+				return
+			}
+		case <-deadline:
+			t.Fatal("channel was not closed")
+		}
+	}
+}
@@ -0,0 +1,8 @@
+package models
+
+import "errors"
+
+// Windowsでは名前付きパイプをファイルとして作れないので、gocvのデコーダーは使えない
+func mkfifo(path string) error {
+	return errors.New("named pipes are not supported on windows")
+}
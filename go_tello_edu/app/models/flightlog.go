@@ -0,0 +1,204 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// フライトログに記録する種類
+const (
+	LogFlightData = "flight_data"
+	LogCommand    = "command"
+	LogCourse     = "course"
+	LogTracking   = "tracking"
+)
+
+const (
+	flightLogExt       = ".jsonl"
+	flightLogIDFormat  = "20060102-150405"
+	takeOffGracePeriod = 30 * time.Second
+)
+
+var (
+	ErrFlightLogNotFound = errors.New("flight log not found")
+	flightLogIDPattern   = regexp.MustCompile(`^\d{8}-\d{6}$`)
+)
+
+type FlightLogEntry struct {
+	Time time.Time   `json:"time"`
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+}
+
+type FlightLogInfo struct {
+	ID        string    `json:"id"`
+	StartTime time.Time `json:"start_time"`
+	Size      int64     `json:"size"`
+	Active    bool      `json:"active"`
+}
+
+// 1回の飛行(離陸から着陸まで)ごとにJSONLファイルへ記録する
+type FlightRecorder struct {
+	mux        sync.Mutex
+	dir        string
+	file       *os.File
+	enc        *json.Encoder
+	id         string
+	startedAt  time.Time
+	seenFlying bool
+	onEnd      []func(id string)
+}
+
+func NewFlightRecorder(dir string) *FlightRecorder {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Printf("cannot create flight log dir: %s", err.Error())
+	}
+	return &FlightRecorder{dir: dir}
+}
+
+// 新しいフライトログを開始する(記録中の場合は何もしない)
+func (f *FlightRecorder) Begin() {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.begin()
+}
+
+func (f *FlightRecorder) begin() {
+	if f.file != nil {
+		return
+	}
+	now := time.Now()
+	id := now.Format(flightLogIDFormat)
+	file, err := os.OpenFile(filepath.Join(f.dir, id+flightLogExt), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		log.Printf("cannot create flight log: %s", err.Error())
+		return
+	}
+	log.Printf("action=FlightRecorder.Begin id=%s", id)
+	f.file = file
+	f.enc = json.NewEncoder(file)
+	f.id = id
+	f.startedAt = now
+	f.seenFlying = false
+}
+
+// フライトログを閉じたとき(飛行が終わったとき)に呼ぶ関数を登録する
+// 関数はフライトログのIDを受け取り、別のgoroutineで呼ばれる
+func (f *FlightRecorder) OnEnd(fn func(id string)) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.onEnd = append(f.onEnd, fn)
+}
+
+// 記録中のフライトログを閉じる
+func (f *FlightRecorder) End() {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.end()
+}
+
+func (f *FlightRecorder) end() {
+	if f.file == nil {
+		return
+	}
+	log.Printf("action=FlightRecorder.End id=%s", f.id)
+	if err := f.file.Close(); err != nil {
+		log.Println(err)
+	}
+	for _, fn := range f.onEnd {
+		go fn(f.id)
+	}
+	f.file = nil
+	f.enc = nil
+	f.id = ""
+}
+
+// 記録中のフライトログのID(記録していない場合は空)
+func (f *FlightRecorder) CurrentID() string {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.id
+}
+
+// 記録中の場合のみエントリーを書き込む
+func (f *FlightRecorder) Record(kind string, data interface{}) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.record(kind, data)
+}
+
+func (f *FlightRecorder) record(kind string, data interface{}) {
+	if f.enc == nil {
+		return
+	}
+	if err := f.enc.Encode(FlightLogEntry{Time: time.Now(), Type: kind, Data: data}); err != nil {
+		log.Printf("cannot write flight log: %s", err.Error())
+	}
+}
+
+// FlightDataを記録し、飛行状態の変化でログを開始・終了する
+func (f *FlightRecorder) RecordFlightData(t Telemetry) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if t.Flying {
+		f.begin()
+	}
+	f.record(LogFlightData, t)
+	if f.file == nil {
+		return
+	}
+	if t.Flying {
+		f.seenFlying = true
+		return
+	}
+	// 着陸した、または離陸コマンドを送ったのに飛ばなかった
+	if f.seenFlying || time.Since(f.startedAt) > takeOffGracePeriod {
+		f.end()
+	}
+}
+
+func (f *FlightRecorder) List() ([]FlightLogInfo, error) {
+	files, err := ioutil.ReadDir(f.dir)
+	if err != nil {
+		return nil, err
+	}
+	current := f.CurrentID()
+	logs := []FlightLogInfo{}
+	for _, file := range files {
+		id := strings.TrimSuffix(file.Name(), flightLogExt)
+		if file.IsDir() || !strings.HasSuffix(file.Name(), flightLogExt) || !flightLogIDPattern.MatchString(id) {
+			continue
+		}
+		start, _ := time.ParseInLocation(flightLogIDFormat, id, time.Local)
+		logs = append(logs, FlightLogInfo{
+			ID:        id,
+			StartTime: start,
+			Size:      file.Size(),
+			Active:    id == current,
+		})
+	}
+	sort.Slice(logs, func(i, j int) bool { return logs[i].ID > logs[j].ID })
+	return logs, nil
+}
+
+// フライトログのファイルパスを返す
+// IDの形式を確認してディレクトリ外のファイルを参照できないようにする
+func (f *FlightRecorder) Path(id string) (string, error) {
+	if !flightLogIDPattern.MatchString(id) {
+		return "", ErrFlightLogNotFound
+	}
+	path := filepath.Join(f.dir, id+flightLogExt)
+	if _, err := os.Stat(path); err != nil {
+		return "", ErrFlightLogNotFound
+	}
+	return path, nil
+}
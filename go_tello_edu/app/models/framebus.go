@@ -0,0 +1,151 @@
+package models
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+// ffmpegでデコードした映像の1フレーム(BGR24)
+// Dataは複数の購読者で共有するので書き換えないこと
+type Frame struct {
+	Seq    uint64
+	Time   time.Time
+	Width  int
+	Height int
+	Data   []byte
+}
+
+// フレームのコピーからMatを作成する(描画してよい)
+// 使い終わったらCloseすること
+func (f Frame) Mat() (gocv.Mat, error) {
+	return gocv.NewMatFromBytes(f.Height, f.Width, gocv.MatTypeCV8UC3, append([]byte{}, f.Data...))
+}
+
+// バッファが一杯のときにどのフレームを捨てるか
+type DropPolicy int
+
+const (
+	// 古いフレームを捨てて最新のフレームを入れる(表示や検出など)
+	DropOldest DropPolicy = iota
+	// 新しいフレームを捨てる(録画など、受け取ったフレームの順番を崩したくない場合)
+	DropNewest
+)
+
+func (p DropPolicy) String() string {
+	if p == DropNewest {
+		return "newest"
+	}
+	return "oldest"
+}
+
+type frameSubscriber struct {
+	name      string
+	ch        chan Frame
+	policy    DropPolicy
+	delivered uint64
+	dropped   uint64
+}
+
+// デコードしたフレームを複数の購読者に配信する
+// 購読者ごとにバッファと捨て方を決め、受信が遅い購読者がいても映像の読み込みは止めない
+type FrameBus struct {
+	mux         sync.Mutex
+	seq         uint64
+	subscribers map[chan Frame]*frameSubscriber
+}
+
+func NewFrameBus() *FrameBus {
+	return &FrameBus{subscribers: map[chan Frame]*frameSubscriber{}}
+}
+
+// フレームに通し番号を付けて配信する。ブロックしない
+func (b *FrameBus) Publish(f Frame) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.seq++
+	f.Seq = b.seq
+	for _, s := range b.subscribers {
+		s.send(f)
+	}
+}
+
+// FrameBusをロック済みの状態で呼び出すこと
+func (s *frameSubscriber) send(f Frame) {
+	select {
+	case s.ch <- f:
+		s.delivered++
+		return
+	default:
+	}
+	if s.policy == DropNewest {
+		s.dropped++
+		return
+	}
+	// 受信側と取り合いになっても、どちらかのフレームを捨てるだけでブロックはしない
+	select {
+	case <-s.ch:
+		s.dropped++
+	default:
+	}
+	select {
+	case s.ch <- f:
+		s.delivered++
+	default:
+		s.dropped++
+	}
+}
+
+// 購読を開始する。nameは状態の表示に使う
+// 不要になったら返り値の関数で購読を解除すること
+func (b *FrameBus) Subscribe(name string, buffer int, policy DropPolicy) (<-chan Frame, func()) {
+	if buffer < 1 {
+		buffer = 1
+	}
+	ch := make(chan Frame, buffer)
+	b.mux.Lock()
+	b.subscribers[ch] = &frameSubscriber{name: name, ch: ch, policy: policy}
+	b.mux.Unlock()
+	return ch, func() {
+		b.mux.Lock()
+		defer b.mux.Unlock()
+		if _, ok := b.subscribers[ch]; ok {
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+type FrameSubscriberStats struct {
+	Name      string `json:"name"`
+	Buffer    int    `json:"buffer"`
+	Policy    string `json:"policy"`
+	Queued    int    `json:"queued"`
+	Delivered uint64 `json:"delivered"`
+	Dropped   uint64 `json:"dropped"`
+}
+
+type FrameBusStats struct {
+	Published   uint64                 `json:"published"`
+	Subscribers []FrameSubscriberStats `json:"subscribers"`
+}
+
+func (b *FrameBus) Stats() FrameBusStats {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	stats := FrameBusStats{Published: b.seq, Subscribers: []FrameSubscriberStats{}}
+	for _, s := range b.subscribers {
+		stats.Subscribers = append(stats.Subscribers, FrameSubscriberStats{
+			Name:      s.name,
+			Buffer:    cap(s.ch),
+			Policy:    s.policy.String(),
+			Queued:    len(s.ch),
+			Delivered: s.delivered,
+			Dropped:   s.dropped,
+		})
+	}
+	sort.Slice(stats.Subscribers, func(i, j int) bool { return stats.Subscribers[i].Name < stats.Subscribers[j].Name })
+	return stats
+}
@@ -0,0 +1,69 @@
+package models
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFrameBusDropPolicy(t *testing.T) {
+	bus := NewFrameBus()
+	latest, unsubscribeLatest := bus.Subscribe("latest", 1, DropOldest)
+	defer unsubscribeLatest()
+	ordered, unsubscribeOrdered := bus.Subscribe("ordered", 2, DropNewest)
+	defer unsubscribeOrdered()
+
+	// 誰も受信していなくてもPublishはブロックしない
+	for i := 0; i < 5; i++ {
+		bus.Publish(Frame{})
+	}
+	if f := <-latest; f.Seq != 5 {
+		t.Errorf("DropOldest got frame %d, want 5", f.Seq)
+	}
+	if a, b := <-ordered, <-ordered; a.Seq != 1 || b.Seq != 2 {
+		t.Errorf("DropNewest got frames %d, %d, want 1, 2", a.Seq, b.Seq)
+	}
+
+	stats := bus.Stats()
+	if stats.Published != 5 || len(stats.Subscribers) != 2 {
+		t.Fatalf("stats = %+v", stats)
+	}
+	for _, s := range stats.Subscribers {
+		if s.Delivered+s.Dropped < 5 {
+			t.Errorf("%s: delivered %d + dropped %d < 5", s.Name, s.Delivered, s.Dropped)
+		}
+	}
+}
+
+func TestFrameBusSlowSubscriber(t *testing.T) {
+	bus := NewFrameBus()
+	_, unsubscribeSlow := bus.Subscribe("slow", 1, DropNewest)
+	fast, unsubscribeFast := bus.Subscribe("fast", 1, DropOldest)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	received := 0
+	go func() {
+		defer wg.Done()
+		for range fast {
+			received++
+		}
+	}()
+	start := time.Now()
+	for i := 0; i < 1000; i++ {
+		bus.Publish(Frame{})
+	}
+	if time.Since(start) > time.Second {
+		t.Error("a slow subscriber should not stall publishing")
+	}
+	unsubscribeSlow()
+	unsubscribeFast()
+	// 解除するとチャネルが閉じる
+	wg.Wait()
+	if received == 0 {
+		t.Error("fast subscriber received no frames")
+	}
+	if n := len(bus.Stats().Subscribers); n != 0 {
+		t.Errorf("%d subscribers left after unsubscribe", n)
+	}
+}
@@ -0,0 +1,258 @@
+package models
+
+import (
+	"errors"
+	"log"
+	"math"
+	"sync"
+	"udemy_drone/go_tello_edu/config"
+)
+
+const (
+	// 移動コマンドでこの距離(m)だけ進むと仮定してフェンスを越えるか判定する
+	geofenceLookahead = 0.5
+)
+
+var ErrGeofence = errors.New("command rejected: geofence limit")
+
+// 離陸地点を中心とした飛行範囲の制限(m)。0の項目は制限しない
+type Geofence struct {
+	MaxHeight float64 `json:"max_height"`
+	MaxRadius float64 `json:"max_radius"`
+	// 北・東方向の片側の長さ
+	BoxNorth float64 `json:"box_north"`
+	BoxEast  float64 `json:"box_east"`
+	// フェンスの内側に戻ったとみなす余裕
+	Margin float64 `json:"margin"`
+}
+
+func geofenceFromConfig() Geofence {
+	return Geofence{
+		MaxHeight: config.Config.GeofenceMaxHeight,
+		MaxRadius: config.Config.GeofenceMaxRadius,
+		BoxNorth:  config.Config.GeofenceBoxNorth,
+		BoxEast:   config.Config.GeofenceBoxEast,
+		Margin:    config.Config.GeofenceMargin,
+	}
+}
+
+// 制限を越えている項目を返す(越えていなければ空)
+// marginだけ内側を境界として判定する
+func (g Geofence) violation(p Position, margin float64) string {
+	switch {
+	case g.MaxHeight > 0 && p.Z > g.MaxHeight-margin:
+		return "height"
+	case g.MaxRadius > 0 && p.Radius() > g.MaxRadius-margin:
+		return "radius"
+	case g.BoxNorth > 0 && math.Abs(p.X) > g.BoxNorth-margin:
+		return "box"
+	case g.BoxEast > 0 && math.Abs(p.Y) > g.BoxEast-margin:
+		return "box"
+	}
+	return ""
+}
+
+func (g Geofence) horizontalViolation(p Position) bool {
+	return g.violation(Position{X: p.X, Y: p.Y}, 0) != ""
+}
+
+// フェンスの外に出る移動コマンドを拒否するDrone
+// 移動方向が推定できないコマンドは通し、フェンスを越えたらgeofenceGuard.watchが戻す
+type fencedDrone struct {
+	Drone
+	fence    Geofence
+	position *positionEstimator
+}
+
+func (f *fencedDrone) allowHorizontal(name string) error {
+	dir, ok := f.position.direction(name)
+	if !ok {
+		return nil
+	}
+	p := f.position.get()
+	next := Position{X: p.X + dir[0]*geofenceLookahead, Y: p.Y + dir[1]*geofenceLookahead}
+	// フェンスの外にいても内側へ向かう移動は許可する
+	if f.fence.horizontalViolation(next) && math.Hypot(next.X, next.Y) > p.Radius() {
+		log.Printf("action=fencedDrone command=%s rejected position=%+v", name, p)
+		return ErrGeofence
+	}
+	return nil
+}
+
+func (f *fencedDrone) move(name string, val int, fn func(int) error) error {
+	if err := f.allowHorizontal(name); err != nil {
+		return err
+	}
+	if err := fn(val); err != nil {
+		return err
+	}
+	f.position.command(name)
+	return nil
+}
+
+func (f *fencedDrone) Forward(val int) error {
+	return f.move("forward", val, f.Drone.Forward)
+}
+
+func (f *fencedDrone) Backward(val int) error {
+	return f.move("backward", val, f.Drone.Backward)
+}
+
+func (f *fencedDrone) Left(val int) error {
+	return f.move("left", val, f.Drone.Left)
+}
+
+func (f *fencedDrone) Right(val int) error {
+	return f.move("right", val, f.Drone.Right)
+}
+
+func (f *fencedDrone) Up(val int) error {
+	p := f.position.get()
+	if f.fence.MaxHeight > 0 && p.Z+geofenceLookahead > f.fence.MaxHeight {
+		log.Printf("action=fencedDrone command=up rejected position=%+v", p)
+		return ErrGeofence
+	}
+	return f.Drone.Up(val)
+}
+
+func (f *fencedDrone) Clockwise(val int) error {
+	if err := f.Drone.Clockwise(val); err != nil {
+		return err
+	}
+	f.position.command("clockwise")
+	return nil
+}
+
+func (f *fencedDrone) CounterClockwise(val int) error {
+	if err := f.Drone.CounterClockwise(val); err != nil {
+		return err
+	}
+	f.position.command("counterClockwise")
+	return nil
+}
+
+func (f *fencedDrone) Hover() {
+	f.Drone.Hover()
+	f.position.command("hover")
+}
+
+// フェンスを越えたら自律動作を止めて内側に戻す
+// 戻る方向は越えたときに一度だけ決める
+type geofenceGuard struct {
+	mux   sync.Mutex
+	drone *DroneManager
+	// 戻るためのコマンドを送るDrone
+	// fencedDroneを通すと戻る動きが最後の移動として記録され、次に選ぶ方向が逆になるので通さない
+	// (接続状態と緊急停止は確認する)
+	mover     Drone
+	fence     Geofence
+	returning string
+	// 水平方向に戻るコマンド。分からない場合は空で、ホバリングしたあとは操縦者に任せる
+	returnDir string
+	decided   bool
+	// 戻るコマンドを送った
+	moved bool
+}
+
+var oppositeMoves = map[string]string{
+	"forward":  "backward",
+	"backward": "forward",
+	"left":     "right",
+	"right":    "left",
+}
+
+// 原点に向かう水平移動のコマンドを選ぶ
+// 向きが推定できていない場合は最後の移動と逆向きに動く(最後の移動も分からなければ空)
+func (g *geofenceGuard) returnMove(p Position) string {
+	if _, ok := g.drone.position.direction("forward"); !ok || p.Radius() == 0 {
+		return oppositeMoves[g.drone.position.lastMovement()]
+	}
+	best, bestDot := "", 0.0
+	for name := range stickAngles {
+		dir, _ := g.drone.position.direction(name)
+		dot := -(dir[0]*p.X + dir[1]*p.Y) / p.Radius()
+		if dot > bestDot {
+			best, bestDot = name, dot
+		}
+	}
+	return best
+}
+
+// テレメトリーを取りこぼすと戻りすぎるので、破棄されない購読を使う
+func (g *geofenceGuard) watch() {
+	events, _ := g.drone.events.SubscribeReliable()
+	for e := range events {
+		if e.Name != TelemetryEvent {
+			continue
+		}
+		g.onTelemetry(e.Data.(Telemetry))
+	}
+}
+
+func (g *geofenceGuard) onTelemetry(t Telemetry) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	if !t.Flying {
+		g.returning = ""
+		return
+	}
+	p := t.Position
+	vertical := g.fence.MaxHeight > 0 && p.Z > g.fence.MaxHeight-g.fence.Margin
+	horizontal := g.fence.violation(Position{X: p.X, Y: p.Y}, g.fence.Margin) != ""
+	if g.returning == "" {
+		reason := g.fence.violation(p, 0)
+		if reason == "" {
+			return
+		}
+		g.returning = reason
+		g.decided = false
+		g.moved = false
+		// 自律動作を止めてホバリングする
+		g.drone.Safety.Intervene("geofence_"+reason, SafetyHover)
+	}
+	if horizontal && !g.decided {
+		g.returnDir = g.returnMove(p)
+		g.decided = true
+		if g.returnDir == "" {
+			log.Printf("action=geofenceGuard return direction unknown, leaving control to the pilot position=%+v", p)
+		}
+	}
+
+	// 余裕を持って内側に入るまで戻し続ける
+	if !vertical && !horizontal {
+		log.Printf("action=geofenceGuard returned position=%+v", p)
+		if g.moved {
+			g.mover.Hover()
+		}
+		g.returning = ""
+		return
+	}
+	if vertical {
+		g.move("down")
+	}
+	if horizontal && g.returnDir != "" {
+		g.move(g.returnDir)
+	}
+}
+
+func (g *geofenceGuard) move(name string) {
+	speed := config.Config.GeofenceReturnSpeed
+	var err error
+	switch name {
+	case "down":
+		err = g.mover.Down(speed)
+	case "forward":
+		err = g.mover.Forward(speed)
+	case "backward":
+		err = g.mover.Backward(speed)
+	case "left":
+		err = g.mover.Left(speed)
+	case "right":
+		err = g.mover.Right(speed)
+	}
+	if err != nil {
+		log.Printf("action=geofenceGuard move=%s err=%s", name, err.Error())
+		return
+	}
+	g.moved = true
+}
@@ -0,0 +1,62 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+	"udemy_drone/go_tello_edu/config"
+)
+
+func newTestGeofenceGuard(t *testing.T) (*geofenceGuard, *DroneManager, *fakeDrone) {
+	d, fake, _ := newTestLinkedDroneManager(t, StateConnected)
+	fence := Geofence{MaxHeight: 3, MaxRadius: 5, Margin: 0.5}
+	mover := d.Drone
+	d.Drone = &fencedDrone{Drone: mover, fence: fence, position: d.position}
+	return &geofenceGuard{drone: d, mover: mover, fence: fence}, d, fake
+}
+
+func flyingAt(p Position) Telemetry {
+	return Telemetry{Flying: true, Position: p}
+}
+
+// 戻る方向は越えたときに決め、戻る動きでは変わらない
+func TestGeofenceGuardReturnsWithoutOscillating(t *testing.T) {
+	defer func(speed int) { config.Config.GeofenceReturnSpeed = speed }(config.Config.GeofenceReturnSpeed)
+	config.Config.GeofenceReturnSpeed = 20
+
+	g, d, fake := newTestGeofenceGuard(t)
+	if err := d.Forward(10); err != nil {
+		t.Fatal(err)
+	}
+	g.onTelemetry(flyingAt(Position{X: 5.2}))
+	g.onTelemetry(flyingAt(Position{X: 5.0}))
+	g.onTelemetry(flyingAt(Position{X: 4.8}))
+	if got := d.position.lastMovement(); got != "forward" {
+		t.Errorf("last movement = %q, want forward", got)
+	}
+	g.onTelemetry(flyingAt(Position{X: 4.0}))
+	want := []string{"forward", "hover", "backward", "backward", "backward", "hover"}
+	if got := fake.Commands(); !reflect.DeepEqual(got, want) {
+		t.Errorf("commands = %v, want %v", got, want)
+	}
+	if g.returning != "" {
+		t.Errorf("still returning: %s", g.returning)
+	}
+}
+
+// 戻る方向が分からなければ一度だけホバリングして操縦者に任せる
+func TestGeofenceGuardUnknownDirection(t *testing.T) {
+	g, _, fake := newTestGeofenceGuard(t)
+	g.onTelemetry(flyingAt(Position{Y: 5.2}))
+	g.onTelemetry(flyingAt(Position{Y: 5.4}))
+	g.onTelemetry(flyingAt(Position{Y: 4.0}))
+	if got, want := fake.Commands(), []string{"hover"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("commands = %v, want %v", got, want)
+	}
+
+	// 高さは方向が分からなくても下げられる
+	g.onTelemetry(flyingAt(Position{Z: 3.2}))
+	g.onTelemetry(flyingAt(Position{Z: 2.0}))
+	if got, want := fake.Commands(), []string{"hover", "hover", "down", "hover"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("commands = %v, want %v", got, want)
+	}
+}
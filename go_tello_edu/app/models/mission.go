@@ -0,0 +1,156 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// ミッションの各ステップで実行する動作
+const (
+	StepTakeOff = "takeoff"
+	StepLand    = "land"
+	StepHover   = "hover"
+	StepMove    = "move"
+	StepRotate  = "rotate"
+	StepFlip    = "flip"
+	StepWait    = "wait"
+)
+
+// ミッションファイル(JSON)の形式
+//
+//	{
+//	  "name": "Course A",
+//	  "steps": [
+//	    {"action": "takeoff"},
+//	    {"action": "wait", "until": {"height_over": 0.5}, "timeout": 10},
+//	    {"action": "rotate", "direction": "clockwise", "speed": 30, "duration": 1},
+//	    {"action": "flip", "direction": "front"},
+//	    {"action": "land"}
+//	  ]
+//	}
+type Mission struct {
+	ID    int           `json:"id,omitempty"`
+	Name  string        `json:"name"`
+	Steps []MissionStep `json:"steps"`
+}
+
+type MissionStep struct {
+	Action string `json:"action"`
+	// move: forward, backward, left, right, up, down
+	// rotate: clockwise, counter_clockwise
+	// flip: front, back, left, right
+	Direction string `json:"direction,omitempty"`
+	Speed     int    `json:"speed,omitempty"`
+	// move, rotate, wait, hoverを続ける秒数(moveとrotateは終了後に停止する)
+	Duration float64 `json:"duration,omitempty"`
+	// waitで条件を満たすまで待つ
+	Until *MissionCondition `json:"until,omitempty"`
+	// untilを満たさないまま経過したら次のステップに進む秒数(0なら無制限)
+	Timeout float64 `json:"timeout,omitempty"`
+	// 条件を満たしている場合はこのステップを飛ばす
+	SkipIf *MissionCondition `json:"skip_if,omitempty"`
+}
+
+// ミッションの条件。指定した項目を全て満たすとtrue
+type MissionCondition struct {
+	// ミッション開始からの秒数
+	ElapsedOver  float64 `json:"elapsed_over,omitempty"`
+	ElapsedUnder float64 `json:"elapsed_under,omitempty"`
+	// 高さ(m)
+	HeightOver  float64 `json:"height_over,omitempty"`
+	HeightUnder float64 `json:"height_under,omitempty"`
+	// バッテリー残量(%)
+	BatteryUnder int   `json:"battery_under,omitempty"`
+	Flying       *bool `json:"flying,omitempty"`
+	// シェイクゲームでスマートフォンを振った回数(コース開始から数える)
+	Shakes int `json:"shakes,omitempty"`
+}
+
+func (c *MissionCondition) met(elapsed time.Duration, shakes int, t Telemetry) bool {
+	sec := elapsed.Seconds()
+	switch {
+	case c.ElapsedOver > 0 && sec <= c.ElapsedOver,
+		c.Shakes > 0 && shakes < c.Shakes,
+		c.ElapsedUnder > 0 && sec >= c.ElapsedUnder,
+		c.HeightOver > 0 && t.Height <= c.HeightOver,
+		c.HeightUnder > 0 && t.Height >= c.HeightUnder,
+		c.BatteryUnder > 0 && t.Battery >= c.BatteryUnder,
+		c.Flying != nil && t.Flying != *c.Flying:
+		return false
+	}
+	return true
+}
+
+func (s MissionStep) duration() time.Duration {
+	return time.Duration(s.Duration * float64(time.Second))
+}
+
+func (m *Mission) Validate() error {
+	if m.Name == "" {
+		return fmt.Errorf("mission name is empty")
+	}
+	if len(m.Steps) == 0 {
+		return fmt.Errorf("mission %q has no steps", m.Name)
+	}
+	for i, s := range m.Steps {
+		if err := s.validate(); err != nil {
+			return fmt.Errorf("mission %q step %d: %w", m.Name, i+1, err)
+		}
+	}
+	return nil
+}
+
+func (s MissionStep) validate() error {
+	switch s.Action {
+	case StepTakeOff, StepLand, StepHover:
+	case StepMove:
+		switch s.Direction {
+		case "forward", "backward", "left", "right", "up", "down":
+		default:
+			return fmt.Errorf("unknown move direction %q", s.Direction)
+		}
+		if s.Duration <= 0 {
+			return fmt.Errorf("move needs duration")
+		}
+	case StepRotate:
+		if s.Direction != "clockwise" && s.Direction != "counter_clockwise" {
+			return fmt.Errorf("unknown rotate direction %q", s.Direction)
+		}
+		if s.Duration <= 0 {
+			return fmt.Errorf("rotate needs duration")
+		}
+	case StepFlip:
+		switch s.Direction {
+		case "front", "back", "left", "right":
+		default:
+			return fmt.Errorf("unknown flip direction %q", s.Direction)
+		}
+	case StepWait:
+		if s.Until == nil && s.Duration <= 0 {
+			return fmt.Errorf("wait needs until or duration")
+		}
+	default:
+		return fmt.Errorf("unknown action %q", s.Action)
+	}
+	if s.Speed < 0 || s.Speed > 100 {
+		return fmt.Errorf("speed must be 0-100")
+	}
+	return nil
+}
+
+func LoadMission(path string) (*Mission, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := &Mission{}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := m.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return m, nil
+}
@@ -0,0 +1,274 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const PatrolEvent = "patrol"
+
+var (
+	ErrPatrolPatternNotFound = errors.New("patrol pattern not found")
+	ErrInvalidPatrol         = errors.New("invalid patrol pattern")
+)
+
+// 巡回の1区間
+// Directionに移動しながらRotationに回転し、Duration秒続けた後でホバリングする
+type PatrolLeg struct {
+	// forward, backward, left, right, up, down(空ならその場でホバリング)
+	Direction string `json:"direction,omitempty"`
+	// clockwise, counter_clockwise(移動と同時に回転する)
+	Rotation string `json:"rotation,omitempty"`
+	// 0なら操作画面で設定している速度
+	Speed    int     `json:"speed,omitempty"`
+	Duration float64 `json:"duration"`
+}
+
+// 巡回のパターン。Legsを順番に飛び、Loops回繰り返す(0なら停止するまで繰り返す)
+//
+//	{"name": "custom", "loops": 2, "legs": [
+//	  {"direction": "forward", "duration": 2},
+//	  {"direction": "right", "rotation": "clockwise", "speed": 20, "duration": 3}
+//	]}
+type PatrolPattern struct {
+	Name  string      `json:"name"`
+	Legs  []PatrolLeg `json:"legs"`
+	Loops int         `json:"loops,omitempty"`
+}
+
+// 組み込みの巡回パターン
+// 往復で離陸地点に戻るように、同じ速度で打ち消し合う区間を組み合わせている
+var patrolPatterns = map[string]PatrolPattern{
+	// 3秒ごとに前、右、後ろ、左と移動して一休みする(以前のPatrolと同じ動き)
+	"square": {Name: "square", Legs: []PatrolLeg{
+		{Direction: "forward", Duration: 3},
+		{Direction: "right", Duration: 3},
+		{Direction: "backward", Duration: 3},
+		{Direction: "left", Duration: 3},
+		{Duration: 3},
+	}},
+	// 前進しながら旋回して円を描く
+	"circle": {Name: "circle", Legs: []PatrolLeg{
+		{Direction: "forward", Rotation: "clockwise", Duration: 12},
+		{Duration: 3},
+	}},
+	// 左右に振れながら前進し、まっすぐ戻る
+	"zigzag": {Name: "zigzag", Legs: []PatrolLeg{
+		{Direction: "right", Duration: 2},
+		{Direction: "forward", Duration: 2},
+		{Direction: "left", Duration: 2},
+		{Direction: "forward", Duration: 2},
+		{Direction: "right", Duration: 2},
+		{Direction: "forward", Duration: 2},
+		{Direction: "left", Duration: 2},
+		{Direction: "backward", Duration: 6},
+		{Duration: 3},
+	}},
+}
+
+func PatrolPatternByName(name string) (PatrolPattern, error) {
+	p, ok := patrolPatterns[name]
+	if !ok {
+		return PatrolPattern{}, ErrPatrolPatternNotFound
+	}
+	// 呼び出し側でLoopsなどを変更しても組み込みのパターンに影響しないようにする
+	p.Legs = append([]PatrolLeg{}, p.Legs...)
+	return p, nil
+}
+
+// 組み込みの巡回パターンを名前順で返す
+func PatrolPatterns() []PatrolPattern {
+	patterns := []PatrolPattern{}
+	for _, p := range patrolPatterns {
+		patterns = append(patterns, p)
+	}
+	sort.Slice(patterns, func(i, j int) bool { return patterns[i].Name < patterns[j].Name })
+	return patterns
+}
+
+func (p *PatrolPattern) Validate() error {
+	if len(p.Legs) == 0 {
+		return fmt.Errorf("%w: no legs", ErrInvalidPatrol)
+	}
+	if p.Loops < 0 {
+		return fmt.Errorf("%w: loops must not be negative", ErrInvalidPatrol)
+	}
+	for i, l := range p.Legs {
+		if err := l.validate(); err != nil {
+			return fmt.Errorf("%w: leg %d: %s", ErrInvalidPatrol, i+1, err.Error())
+		}
+	}
+	return nil
+}
+
+func (l PatrolLeg) validate() error {
+	switch l.Direction {
+	case "", "forward", "backward", "left", "right", "up", "down":
+	default:
+		return fmt.Errorf("unknown move direction %q", l.Direction)
+	}
+	switch l.Rotation {
+	case "", "clockwise", "counter_clockwise":
+	default:
+		return fmt.Errorf("unknown rotation %q", l.Rotation)
+	}
+	if l.Duration <= 0 {
+		return fmt.Errorf("leg needs duration")
+	}
+	if l.Speed < 0 || l.Speed > 100 {
+		return fmt.Errorf("speed must be 0-100")
+	}
+	return nil
+}
+
+func (l PatrolLeg) duration() time.Duration {
+	return time.Duration(l.Duration * float64(time.Second))
+}
+
+// 巡回の進み具合(LoopとLegは1から数える)
+type PatrolStatus struct {
+	Running bool   `json:"running"`
+	Pattern string `json:"pattern,omitempty"`
+	Loop    int    `json:"loop"`
+	Loops   int    `json:"loops"`
+	Leg     int    `json:"leg"`
+	Legs    int    `json:"legs"`
+}
+
+// 巡回の開始・停止を管理する
+// 巡回のgoroutineはcontextで止め、Stopは機体がホバリングしてgoroutineが終わるまで待つ
+// HTTPハンドラーや安全機能など複数のgoroutineから同時に呼び出してよい
+type Patroller struct {
+	drone   Drone
+	control *ControlArbiter
+	speed   func() int
+	publish func(name string, data interface{})
+
+	// Start/Stopを1つずつ実行する
+	lifecycle sync.Mutex
+	cancel    context.CancelFunc
+	done      chan struct{}
+
+	mux    sync.Mutex
+	status PatrolStatus
+}
+
+// 巡回中はcontrolにBehaviorPatrolとして登録する(nilなら登録しない)
+// speedは速度を指定していない区間で使う速度、publishは進み具合の通知先
+func NewPatroller(drone Drone, control *ControlArbiter, speed func() int, publish func(name string, data interface{})) *Patroller {
+	return &Patroller{drone: drone, control: control, speed: speed, publish: publish}
+}
+
+// 巡回を開始する
+// 巡回中の場合は止めてから新しいパターンで開始する
+func (p *Patroller) Start(pattern PatrolPattern) error {
+	if err := pattern.Validate(); err != nil {
+		return err
+	}
+	p.lifecycle.Lock()
+	defer p.lifecycle.Unlock()
+	p.stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	p.cancel = cancel
+	p.done = done
+	p.setStatus(PatrolStatus{Running: true, Pattern: pattern.Name, Loops: pattern.Loops, Legs: len(pattern.Legs)})
+	p.control.Handover(BehaviorPatrol)
+	go func() {
+		defer close(done)
+		p.run(ctx, pattern)
+	}()
+	return nil
+}
+
+// 巡回を止めてホバリングする。巡回していなければ何もしない
+func (p *Patroller) Stop() {
+	p.lifecycle.Lock()
+	defer p.lifecycle.Unlock()
+	p.stop()
+}
+
+// lifecycleをロック済みの状態で呼び出すこと
+func (p *Patroller) stop() {
+	if p.cancel == nil {
+		return
+	}
+	p.cancel()
+	<-p.done
+	p.cancel = nil
+	p.done = nil
+	p.control.Release(BehaviorPatrol)
+
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if p.status.Running {
+		p.status.Running = false
+		p.publish(PatrolEvent, p.status)
+		log.Println("パトロール終了")
+	}
+}
+
+func (p *Patroller) Status() PatrolStatus {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	return p.status
+}
+
+func (p *Patroller) setStatus(status PatrolStatus) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	p.status = status
+	p.publish(PatrolEvent, status)
+}
+
+func (p *Patroller) run(ctx context.Context, pattern PatrolPattern) {
+	log.Printf("パトロール開始 pattern=%s loops=%d", pattern.Name, pattern.Loops)
+	status := p.Status()
+	for loop := 1; pattern.Loops == 0 || loop <= pattern.Loops; loop++ {
+		for i, leg := range pattern.Legs {
+			if ctx.Err() != nil {
+				p.drone.Hover()
+				return
+			}
+			status.Loop = loop
+			status.Leg = i + 1
+			p.setStatus(status)
+
+			p.drone.Hover()
+			if err := p.move(leg); err != nil {
+				log.Printf("action=patrol pattern=%s leg=%d err=%s", pattern.Name, i+1, err.Error())
+			}
+			t := time.NewTimer(leg.duration())
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				p.drone.Hover()
+				return
+			case <-t.C:
+			}
+		}
+	}
+	// BehaviorPatrolを解除する前にホバリングする
+	p.drone.Hover()
+	status.Running = false
+	p.setStatus(status)
+	p.control.Release(BehaviorPatrol)
+	log.Println("パトロール終了")
+}
+
+func (p *Patroller) move(leg PatrolLeg) error {
+	speed := leg.Speed
+	if speed == 0 {
+		speed = p.speed()
+	}
+	if err := moveDrone(p.drone, leg.Direction, speed); err != nil {
+		return err
+	}
+	return moveDrone(p.drone, leg.Rotation, speed)
+}
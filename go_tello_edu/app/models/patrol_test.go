@@ -0,0 +1,119 @@
+package models
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func waitPatrolStopped(t *testing.T, p *Patroller) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for p.Status().Running {
+		if time.Now().After(deadline) {
+			t.Fatal("patrol did not finish")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPatrollerFinishesLoops(t *testing.T) {
+	d, fake := newTestDroneManager(t)
+	pattern := PatrolPattern{Name: "test", Loops: 2, Legs: []PatrolLeg{
+		{Direction: "forward", Duration: 0.01},
+		{Direction: "left", Rotation: "clockwise", Duration: 0.01},
+	}}
+	if err := d.Patrol.Start(pattern); err != nil {
+		t.Fatal(err)
+	}
+	waitPatrolStopped(t, d.Patrol)
+
+	want := []string{
+		"hover", "forward", "hover", "left", "clockwise",
+		"hover", "forward", "hover", "left", "clockwise",
+		"hover",
+	}
+	if got := fake.Commands(); !reflect.DeepEqual(got, want) {
+		t.Errorf("commands = %v, want %v", got, want)
+	}
+	want2 := PatrolStatus{Pattern: "test", Loop: 2, Loops: 2, Leg: 2, Legs: 2}
+	if got := d.Patrol.Status(); got != want2 {
+		t.Errorf("status = %+v, want %+v", got, want2)
+	}
+}
+
+func TestPatrollerStartValidates(t *testing.T) {
+	d, fake := newTestDroneManager(t)
+	err := d.Patrol.Start(PatrolPattern{Name: "bad", Legs: []PatrolLeg{{Direction: "sideways", Duration: 1}}})
+	if err == nil {
+		t.Fatal("invalid pattern should be rejected")
+	}
+	if d.Patrol.Status().Running || len(fake.Commands()) != 0 {
+		t.Error("invalid pattern should not start patrol")
+	}
+}
+
+// Stopから戻った後は巡回のgoroutineがコマンドを送らず、最後のコマンドはホバリングになること
+func TestPatrollerStopHovers(t *testing.T) {
+	d, fake := newTestDroneManager(t)
+	pattern, _ := PatrolPatternByName("square")
+	if err := d.Patrol.Start(pattern); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	d.Patrol.Stop()
+
+	commands := fake.Commands()
+	if len(commands) == 0 || commands[len(commands)-1] != "hover" {
+		t.Errorf("last command should be hover: %v", commands)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if after := fake.Commands(); len(after) != len(commands) {
+		t.Errorf("commands sent after Stop: %v", after[len(commands):])
+	}
+	if d.Patrol.Status().Running {
+		t.Error("patrol should not be running after Stop")
+	}
+	// 2回目のStopは何もしない
+	d.Patrol.Stop()
+}
+
+// HTTPハンドラーや安全機能から同時に開始・停止しても巡回は1つだけ動くこと
+func TestPatrollerConcurrentStartStop(t *testing.T) {
+	d, fake := newTestDroneManager(t)
+	pattern := PatrolPattern{Name: "test", Legs: []PatrolLeg{
+		{Direction: "forward", Duration: 0.005},
+		{Direction: "backward", Duration: 0.005},
+	}}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				switch (i + j) % 3 {
+				case 0:
+					if err := d.Patrol.Start(pattern); err != nil {
+						t.Error(err)
+					}
+				case 1:
+					d.Patrol.Stop()
+				case 2:
+					_ = d.Patrol.Status()
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	d.Patrol.Stop()
+
+	commands := fake.Commands()
+	time.Sleep(20 * time.Millisecond)
+	if after := fake.Commands(); len(after) != len(commands) {
+		t.Errorf("commands sent after Stop: %v", after[len(commands):])
+	}
+	if d.Patrol.Status().Running {
+		t.Error("patrol should not be running after Stop")
+	}
+}
@@ -0,0 +1,131 @@
+package models
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// FlightDataが途切れたときに積分しすぎないようにする
+	maxPositionStep = 500 * time.Millisecond
+	// スティック操作による移動方向を学習する最低速度(m/s)
+	minLearnSpeed = 0.2
+	// 複数方向のスティックを同時に操作している
+	stickMixed = "mixed"
+)
+
+// 離陸地点からの推定位置(m)
+// Xは北、Yは東、Zは高さ
+type Position struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+	Z float64 `json:"z"`
+}
+
+func (p Position) Radius() float64 {
+	return math.Hypot(p.X, p.Y)
+}
+
+// 機首から見た各コマンドの移動方向(度)
+var stickAngles = map[string]float64{
+	"forward":  0,
+	"right":    90,
+	"backward": 180,
+	"left":     270,
+}
+
+// FlightDataの速度を積分して離陸地点からの位置を推定する
+// Telloは機首の向きを送ってこないので、スティック操作中に実際に動いた方向から向きを推定し
+// ジオフェンスの判定や戻る方向の決定に使う
+type positionEstimator struct {
+	mux      sync.Mutex
+	pos      Position
+	last     time.Time
+	flying   bool
+	stick    string
+	heading  float64
+	headed   bool
+	lastMove string
+}
+
+func newPositionEstimator() *positionEstimator {
+	return &positionEstimator{}
+}
+
+func (e *positionEstimator) update(t Telemetry) Position {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	if !t.Flying {
+		// 地上にいる間は離陸地点を原点にし直す
+		e.pos = Position{Z: t.Height}
+		e.flying = false
+		e.last = t.Time
+		e.headed = false
+		return e.pos
+	}
+	if e.flying {
+		dt := t.Time.Sub(e.last)
+		if dt > maxPositionStep {
+			dt = maxPositionStep
+		}
+		e.pos.X += t.NorthSpeed * dt.Seconds()
+		e.pos.Y += t.EastSpeed * dt.Seconds()
+	}
+	e.pos.Z = t.Height
+	e.flying = true
+	e.last = t.Time
+
+	speed := math.Hypot(t.NorthSpeed, t.EastSpeed)
+	if e.stick != "" && e.stick != stickMixed && speed > minLearnSpeed {
+		e.heading = math.Atan2(t.EastSpeed, t.NorthSpeed)*180/math.Pi - stickAngles[e.stick]
+		e.headed = true
+	}
+	return e.pos
+}
+
+// 送ったコマンドを記録する
+// 水平移動は1方向のときだけ向きの推定に使い、回転すると向きが分からなくなる
+func (e *positionEstimator) command(name string) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	switch name {
+	case "forward", "backward", "left", "right":
+		if e.stick == "" || e.stick == name {
+			e.stick = name
+		} else {
+			e.stick = stickMixed
+		}
+		e.lastMove = name
+	case "hover":
+		e.stick = ""
+	case "clockwise", "counterClockwise":
+		e.headed = false
+		e.stick = stickMixed
+	}
+}
+
+func (e *positionEstimator) get() Position {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	return e.pos
+}
+
+// コマンドで動く方向(北, 東)の単位ベクトル。まだ分からない場合はfalse
+func (e *positionEstimator) direction(name string) ([2]float64, bool) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	angle, ok := stickAngles[name]
+	if !ok || !e.headed {
+		return [2]float64{}, false
+	}
+	rad := (e.heading + angle) * math.Pi / 180
+	return [2]float64{math.Cos(rad), math.Sin(rad)}, true
+}
+
+// 最後に送った水平移動のコマンド
+func (e *positionEstimator) lastMovement() string {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	return e.lastMove
+}
@@ -0,0 +1,67 @@
+package models
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestPositionEstimatorIntegrates(t *testing.T) {
+	e := newPositionEstimator()
+	start := time.Now()
+	e.update(Telemetry{Time: start, Height: 0.3})
+	e.update(Telemetry{Time: start, Flying: true, NorthSpeed: 1, Height: 1})
+	p := e.update(Telemetry{Time: start.Add(200 * time.Millisecond), Flying: true, NorthSpeed: 1, EastSpeed: -0.5, Height: 1.2})
+	if math.Abs(p.X-0.2) > 1e-9 || math.Abs(p.Y+0.1) > 1e-9 || p.Z != 1.2 {
+		t.Errorf("position = %+v, want {0.2 -0.1 1.2}", p)
+	}
+	// FlightDataが途切れた間は最大maxPositionStepまでしか積分しない
+	p = e.update(Telemetry{Time: start.Add(3 * time.Second), Flying: true, NorthSpeed: 1})
+	if math.Abs(p.X-0.7) > 1e-9 {
+		t.Errorf("x = %v after a gap, want 0.7", p.X)
+	}
+	// 着陸したら原点に戻す
+	if p = e.update(Telemetry{Time: start.Add(4 * time.Second)}); p.Radius() != 0 {
+		t.Errorf("position = %+v after landing", p)
+	}
+}
+
+func TestPositionEstimatorHeading(t *testing.T) {
+	e := newPositionEstimator()
+	start := time.Now()
+	fly := func(i int, north, east float64) {
+		e.update(Telemetry{Time: start.Add(time.Duration(i) * 100 * time.Millisecond), Flying: true, NorthSpeed: north, EastSpeed: east})
+	}
+	fly(0, 0, 0)
+	if _, ok := e.direction("forward"); ok {
+		t.Fatal("heading is known before moving")
+	}
+
+	// 右に動かしたら東に進んだので、機首は北を向いている
+	e.command("right")
+	fly(1, 0, 1)
+	dir, ok := e.direction("forward")
+	if !ok || math.Abs(dir[0]-1) > 1e-9 || math.Abs(dir[1]) > 1e-9 {
+		t.Errorf("forward = %v, %t, want north", dir, ok)
+	}
+	if dir, _ := e.direction("left"); math.Abs(dir[1]+1) > 1e-9 {
+		t.Errorf("left = %v, want west", dir)
+	}
+
+	// 複数方向の操作では学習しない
+	e.command("forward")
+	fly(2, -1, 0)
+	if dir, _ := e.direction("forward"); math.Abs(dir[0]-1) > 1e-9 {
+		t.Errorf("forward = %v after mixed sticks, want north", dir)
+	}
+	e.command("hover")
+	if got := e.lastMovement(); got != "forward" {
+		t.Errorf("last movement = %q, want forward", got)
+	}
+
+	// 回転すると向きが分からなくなる
+	e.command("clockwise")
+	if _, ok := e.direction("forward"); ok {
+		t.Error("heading is still known after rotating")
+	}
+}
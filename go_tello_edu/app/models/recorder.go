@@ -0,0 +1,501 @@
+package models
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"udemy_drone/go_tello_edu/config"
+
+	"gocv.io/x/gocv"
+)
+
+const (
+	RecordingEvent = "recording"
+
+	recordingExt       = ".mp4"
+	recordingRawExt    = ".h264"
+	recordingAnnotated = "_annotated"
+	// 録画中のファイル(一覧には出さない)
+	recordingTempPrefix = ".recording-"
+	// 注釈付きの映像をエンコードする前に溜めておくフレーム数
+	recordingFrameBuffer = 30
+)
+
+var (
+	ErrRecording         = errors.New("already recording")
+	ErrNotRecording      = errors.New("not recording")
+	ErrRecordingNotFound = errors.New("recording not found")
+	// 飛行中ならフライトログのID、そうでなければ録画を始めた時刻。同じIDの録画が既にあれば-2, -3...を付ける
+	recordingNamePattern = regexp.MustCompile(`^(\d{8}-\d{6})(-\d+)?(_annotated)?\.(mp4|h264)$`)
+	// 録画中に終了した場合に残るファイル
+	recordingTempPattern = regexp.MustCompile(`^` + regexp.QuoteMeta(recordingTempPrefix) + `(\d{8}-\d{6})(_annotated\.mp4|\.h264)$`)
+)
+
+type RecordingConfig struct {
+	Dir        string
+	FfmpegPath string
+	// 生のH.264には時刻が入っていないので、このフレームレートとしてMP4にする
+	FrameRate float64
+	// startRecordingで指定しなかった場合に注釈付きの映像も録画するか
+	Annotated bool
+	// 注釈付きの映像をエンコードするffmpegの出力オプション
+	AnnotatedArgs []string
+	// ffmpegに追加する環境変数(KEY=value)
+	Env []string
+}
+
+func recordingConfigFromConfig() RecordingConfig {
+	c := config.Config
+	return RecordingConfig{
+		Dir:           c.RecordingDir,
+		FfmpegPath:    c.FfmpegPath,
+		FrameRate:     c.RecordingFrameRate,
+		Annotated:     c.RecordingAnnotated,
+		AnnotatedArgs: c.RecordingAnnotatedArgs,
+	}
+}
+
+type RecordingInfo struct {
+	Name string `json:"name"`
+	ID   string `json:"id"`
+	// 飛行中に録画した場合はフライトログのID
+	FlightID  string    `json:"flight_id,omitempty"`
+	Time      time.Time `json:"time"`
+	Size      int64     `json:"size"`
+	Annotated bool      `json:"annotated"`
+	// MP4に変換できなかった生のH.264
+	Raw bool `json:"raw"`
+}
+
+type RecorderStatus struct {
+	Recording bool `json:"recording"`
+	// MP4に変換している
+	Saving    bool      `json:"saving"`
+	FlightID  string    `json:"flight_id,omitempty"`
+	StartTime time.Time `json:"start_time"`
+	Annotated bool      `json:"annotated"`
+	Packets   uint64    `json:"packets"`
+	Bytes     int64     `json:"bytes"`
+	// 注釈付きの映像に書き込んだフレーム数
+	Frames uint64 `json:"frames"`
+	// 最後に保存したファイル
+	Files     []string `json:"files"`
+	LastError string   `json:"last_error,omitempty"`
+}
+
+// ドローンから受け取ったH.264をそのまま保存し、録画を止めたらMP4にする(再エンコードしない)
+// 注釈付きの映像は、検出結果を描いたフレームをffmpegでエンコードして別のファイルに保存する
+type VideoRecorder struct {
+	conf      RecordingConfig
+	flightLog *FlightRecorder
+	frames    *FrameBus
+	draw      func(*gocv.Mat)
+	notify    func(name string, data interface{})
+
+	mux     sync.Mutex
+	session *recordingSession
+	status  RecorderStatus
+}
+
+type recordingSession struct {
+	id  string
+	raw *os.File
+	// SPSを受け取るまでは書き込まない
+	keyframe bool
+	// 注釈付きの映像のエンコード(録画しない場合はnil)
+	unsubscribe func()
+	encoded     chan error
+}
+
+// drawは注釈付きの映像に検出結果を描く関数、notifyは状態の通知先
+// 前回録画中に終了して残ったファイルは、バックグラウンドで保存し直す
+// 飛行が終わったら、その飛行の録画を止める
+func NewVideoRecorder(conf RecordingConfig, flightLog *FlightRecorder, frames *FrameBus,
+	draw func(*gocv.Mat), notify func(name string, data interface{})) *VideoRecorder {
+	r := &VideoRecorder{
+		conf:      conf,
+		flightLog: flightLog,
+		frames:    frames,
+		draw:      draw,
+		notify:    notify,
+		status:    RecorderStatus{Files: []string{}},
+	}
+	// 録画を始める前に残っているファイルを調べる
+	if ids := r.leftovers(); len(ids) > 0 {
+		go r.recoverLeftovers(ids)
+	}
+	flightLog.OnEnd(r.stopFlight)
+	return r
+}
+
+func (r *VideoRecorder) tempPath(id, suffix string) string {
+	return filepath.Join(r.conf.Dir, recordingTempPrefix+id+suffix)
+}
+
+func (r *VideoRecorder) Start(annotated bool) error {
+	r.mux.Lock()
+	if r.session != nil || r.status.Saving {
+		r.mux.Unlock()
+		return ErrRecording
+	}
+	if err := os.MkdirAll(r.conf.Dir, 0755); err != nil {
+		r.mux.Unlock()
+		return err
+	}
+	now := time.Now()
+	s := &recordingSession{id: now.Format(flightLogIDFormat)}
+	raw, err := os.Create(r.tempPath(s.id, recordingRawExt))
+	if err != nil {
+		r.mux.Unlock()
+		return err
+	}
+	s.raw = raw
+	if annotated {
+		var frames <-chan Frame
+		frames, s.unsubscribe = r.frames.Subscribe("recording", recordingFrameBuffer, DropNewest)
+		s.encoded = make(chan error, 1)
+		go r.encodeAnnotated(r.tempPath(s.id, recordingAnnotated+recordingExt), frames, s.encoded)
+	}
+	r.session = s
+	r.status = RecorderStatus{
+		Recording: true,
+		FlightID:  r.flightLog.CurrentID(),
+		StartTime: now,
+		Annotated: annotated,
+		Files:     []string{},
+	}
+	status := r.currentStatus()
+	r.mux.Unlock()
+
+	log.Printf("action=VideoRecorder.Start id=%s annotated=%t", s.id, annotated)
+	r.notify(RecordingEvent, status)
+	return nil
+}
+
+// 録画を止めてファイルを保存する
+// MP4に変換できなかった場合は生のH.264を残してエラーを返す
+func (r *VideoRecorder) Stop() (RecorderStatus, error) {
+	return r.stop(func(RecorderStatus) bool { return true })
+}
+
+// 飛行が終わったら、その飛行と結び付いた録画を止める
+func (r *VideoRecorder) stopFlight(flightID string) {
+	status, err := r.stop(func(status RecorderStatus) bool { return status.FlightID == flightID })
+	if err == nil {
+		log.Printf("action=VideoRecorder.stopFlight flight_id=%s files=%v", flightID, status.Files)
+	}
+}
+
+// matchがfalseを返す録画は止めない
+func (r *VideoRecorder) stop(match func(RecorderStatus) bool) (RecorderStatus, error) {
+	r.mux.Lock()
+	s := r.session
+	if s == nil || !match(r.status) {
+		status := r.currentStatus()
+		r.mux.Unlock()
+		return status, ErrNotRecording
+	}
+	// 以降のパケットは書き込まない
+	r.session = nil
+	r.status.Recording = false
+	r.status.Saving = true
+	flightID := r.status.FlightID
+	status := r.currentStatus()
+	r.mux.Unlock()
+	r.notify(RecordingEvent, status)
+
+	files, err := r.save(s, flightID)
+	if err == nil && len(files) == 0 {
+		err = ErrNoVideoFrame
+	}
+	r.mux.Lock()
+	r.status.Saving = false
+	r.status.Files = files
+	if err != nil {
+		r.status.LastError = err.Error()
+	}
+	status = r.currentStatus()
+	r.mux.Unlock()
+
+	log.Printf("action=VideoRecorder.Stop id=%s files=%v", s.id, files)
+	if err != nil {
+		log.Printf("action=VideoRecorder.Stop id=%s err=%s", s.id, err.Error())
+	}
+	r.notify(RecordingEvent, status)
+	return status, err
+}
+
+func (r *VideoRecorder) save(s *recordingSession, flightID string) ([]string, error) {
+	var err error
+	if s.unsubscribe != nil {
+		// 購読を解除するとエンコードが終わる
+		s.unsubscribe()
+		err = <-s.encoded
+	}
+	s.raw.Close()
+
+	id := flightID
+	if id == "" {
+		id = s.id
+	}
+	files, saveErr := r.saveTemp(s.id, id)
+	if saveErr != nil {
+		err = saveErr
+	}
+	return files, err
+}
+
+// 録画中のファイルをidの名前で保存する
+func (r *VideoRecorder) saveTemp(tempID, id string) ([]string, error) {
+	var err error
+	id = r.uniqueID(id)
+	files := []string{}
+	rawPath := r.tempPath(tempID, recordingRawExt)
+	if info, statErr := os.Stat(rawPath); statErr == nil && info.Size() > 0 {
+		name := id + recordingExt
+		if muxErr := r.muxMP4(rawPath, filepath.Join(r.conf.Dir, name)); muxErr != nil {
+			name = id + recordingRawExt
+			if renameErr := os.Rename(rawPath, filepath.Join(r.conf.Dir, name)); renameErr != nil {
+				muxErr = renameErr
+			}
+			err = muxErr
+		}
+		files = append(files, name)
+	}
+	os.Remove(rawPath)
+
+	annotatedPath := r.tempPath(tempID, recordingAnnotated+recordingExt)
+	if _, statErr := os.Stat(annotatedPath); statErr == nil {
+		name := id + recordingAnnotated + recordingExt
+		if renameErr := os.Rename(annotatedPath, filepath.Join(r.conf.Dir, name)); renameErr != nil {
+			if err == nil {
+				err = renameErr
+			}
+		} else {
+			files = append(files, name)
+		}
+	}
+	return files, err
+}
+
+// 録画中に終了して残ったファイルの録画ID
+func (r *VideoRecorder) leftovers() []string {
+	files, err := ioutil.ReadDir(r.conf.Dir)
+	if err != nil {
+		return nil
+	}
+	ids := []string{}
+	seen := map[string]bool{}
+	for _, file := range files {
+		m := recordingTempPattern.FindStringSubmatch(file.Name())
+		if file.IsDir() || m == nil || seen[m[1]] {
+			continue
+		}
+		seen[m[1]] = true
+		ids = append(ids, m[1])
+	}
+	return ids
+}
+
+// 残ったファイルを録画を始めた時刻の名前で保存する
+func (r *VideoRecorder) recoverLeftovers(ids []string) {
+	for _, id := range ids {
+		files, err := r.saveTemp(id, id)
+		log.Printf("action=VideoRecorder.recover id=%s files=%v", id, files)
+		if err != nil {
+			log.Printf("action=VideoRecorder.recover id=%s err=%s", id, err.Error())
+		}
+	}
+}
+
+// 同じ飛行で何度か録画した場合は-2, -3...を付ける
+func (r *VideoRecorder) uniqueID(id string) string {
+	for n := 1; ; n++ {
+		candidate := id
+		if n > 1 {
+			candidate = id + "-" + strconv.Itoa(n)
+		}
+		used := false
+		for _, suffix := range []string{recordingExt, recordingRawExt, recordingAnnotated + recordingExt} {
+			if _, err := os.Stat(filepath.Join(r.conf.Dir, candidate+suffix)); err == nil {
+				used = true
+			}
+		}
+		if !used {
+			return candidate
+		}
+	}
+}
+
+// 生のH.264を再エンコードせずにMP4にする
+func (r *VideoRecorder) muxMP4(rawPath, path string) error {
+	cmd := ffmpegCommand(r.conf.FfmpegPath, r.conf.Env, "-hide_banner", "-loglevel", "error", "-y",
+		"-f", "h264", "-framerate", strconv.FormatFloat(r.conf.FrameRate, 'f', -1, 64), "-i", rawPath,
+		"-c", "copy", "-movflags", "+faststart", path)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(path)
+		return fmt.Errorf("ffmpeg: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// 検出結果を描いたフレームをffmpegに渡してエンコードする
+// フレームの大きさが分かってから(最初のフレームを受け取ってから)ffmpegを起動する
+// フレームの間隔は一定ではないので、ffmpegが受け取った時刻をタイムスタンプにする
+func (r *VideoRecorder) encodeAnnotated(path string, frames <-chan Frame, done chan<- error) {
+	var cmd *exec.Cmd
+	var stdin io.WriteCloser
+	var stderr bytes.Buffer
+	var err error
+	// エラーになっても購読を解除されるまではフレームを受け取る
+	for frame := range frames {
+		if err != nil {
+			continue
+		}
+		if cmd == nil {
+			args := []string{"-hide_banner", "-loglevel", "error", "-y",
+				"-f", "rawvideo", "-pix_fmt", "bgr24", "-s", strconv.Itoa(frame.Width) + "x" + strconv.Itoa(frame.Height),
+				"-use_wallclock_as_timestamps", "1", "-i", "pipe:0"}
+			cmd = ffmpegCommand(r.conf.FfmpegPath, r.conf.Env, append(append(args, r.conf.AnnotatedArgs...), path)...)
+			cmd.Stderr = &stderr
+			if stdin, err = cmd.StdinPipe(); err == nil {
+				err = cmd.Start()
+			}
+			if err != nil {
+				cmd = nil
+				continue
+			}
+		}
+		img, matErr := frame.Mat()
+		if matErr != nil {
+			continue
+		}
+		r.draw(&img)
+		_, err = stdin.Write(img.ToBytes())
+		img.Close()
+		r.mux.Lock()
+		r.status.Frames++
+		r.mux.Unlock()
+	}
+	if cmd != nil {
+		stdin.Close()
+		if waitErr := cmd.Wait(); waitErr != nil {
+			err = waitErr
+		}
+	}
+	if err != nil {
+		os.Remove(path)
+		err = fmt.Errorf("ffmpeg: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	done <- err
+}
+
+// ドローンから受け取ったH.264のパケットを書き込む(録画していなければ何もしない)
+func (r *VideoRecorder) Write(pkt []byte) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	s := r.session
+	if s == nil {
+		return
+	}
+	// 途中から書き込むと次のキーフレームまで再生できないので、SPSが届くまで待つ
+	if !s.keyframe {
+		if !containsSPS(pkt) {
+			return
+		}
+		s.keyframe = true
+	}
+	// 録画中に離陸した場合もフライトログと結び付ける
+	if r.status.FlightID == "" {
+		r.status.FlightID = r.flightLog.CurrentID()
+	}
+	if _, err := s.raw.Write(pkt); err != nil {
+		if r.status.LastError != err.Error() {
+			log.Printf("action=VideoRecorder.Write err=%s", err.Error())
+			r.status.LastError = err.Error()
+		}
+		return
+	}
+	r.status.Packets++
+	r.status.Bytes += int64(len(pkt))
+}
+
+// Annex BのH.264にSPS(NALユニットのタイプ7)が含まれているか
+func containsSPS(pkt []byte) bool {
+	for i := 0; i+3 < len(pkt); i++ {
+		if pkt[i] == 0 && pkt[i+1] == 0 && pkt[i+2] == 1 && pkt[i+3]&0x1f == 7 {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *VideoRecorder) Status() RecorderStatus {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return r.currentStatus()
+}
+
+// ロック済みの状態で呼び出すこと
+func (r *VideoRecorder) currentStatus() RecorderStatus {
+	status := r.status
+	status.Files = append([]string{}, r.status.Files...)
+	return status
+}
+
+func (r *VideoRecorder) List() ([]RecordingInfo, error) {
+	files, err := ioutil.ReadDir(r.conf.Dir)
+	if os.IsNotExist(err) {
+		return []RecordingInfo{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	recordings := []RecordingInfo{}
+	for _, file := range files {
+		m := recordingNamePattern.FindStringSubmatch(file.Name())
+		if file.IsDir() || m == nil {
+			continue
+		}
+		start, _ := time.ParseInLocation(flightLogIDFormat, m[1], time.Local)
+		info := RecordingInfo{
+			Name:      file.Name(),
+			ID:        m[1] + m[2],
+			Time:      start,
+			Size:      file.Size(),
+			Annotated: m[3] != "",
+			Raw:       m[4] == "h264",
+		}
+		if _, err := r.flightLog.Path(m[1]); err == nil {
+			info.FlightID = m[1]
+		}
+		recordings = append(recordings, info)
+	}
+	sort.Slice(recordings, func(i, j int) bool { return recordings[i].Name > recordings[j].Name })
+	return recordings, nil
+}
+
+// 録画のファイルパスを返す
+// ファイル名の形式を確認してディレクトリ外のファイルを参照できないようにする
+func (r *VideoRecorder) Path(name string) (string, error) {
+	if !recordingNamePattern.MatchString(name) {
+		return "", ErrRecordingNotFound
+	}
+	path := filepath.Join(r.conf.Dir, name)
+	if _, err := os.Stat(path); err != nil {
+		return "", ErrRecordingNotFound
+	}
+	return path, nil
+}
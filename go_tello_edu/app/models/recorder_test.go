@@ -0,0 +1,213 @@
+package models
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gocv.io/x/gocv"
+)
+
+// 終了時に録画中なら止める
+func newTestRecorder(t *testing.T, dir, mode string) (*VideoRecorder, *FlightRecorder) {
+	flightLog := NewFlightRecorder(filepath.Join(dir, "flight_logs"))
+	conf := RecordingConfig{Dir: filepath.Join(dir, "recordings"), FfmpegPath: os.Args[0], FrameRate: 30,
+		Env: []string{"FAKE_FFMPEG=" + mode}}
+	recorder := NewVideoRecorder(conf, flightLog, NewFrameBus(), func(*gocv.Mat) {}, func(string, interface{}) {})
+	t.Cleanup(func() { recorder.Stop() })
+	return recorder, flightLog
+}
+
+// Telloと同じ大きさのパケットに区切って書き込む
+func writeFixture(t *testing.T, recorder *VideoRecorder) []byte {
+	fixture, err := ioutil.ReadFile("testdata/tello.h264")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(fixture); i += 1460 {
+		end := i + 1460
+		if end > len(fixture) {
+			end = len(fixture)
+		}
+		recorder.Write(fixture[i:end])
+	}
+	return fixture
+}
+
+func TestVideoRecorderFlightLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recorder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	recorder, flightLog := newTestRecorder(t, dir, "copy")
+	flightLog.Begin()
+	defer flightLog.End()
+	id := flightLog.CurrentID()
+
+	if err := recorder.Start(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := recorder.Start(false); err != ErrRecording {
+		t.Errorf("err = %v, want ErrRecording", err)
+	}
+	// キーフレームより前のパケットは書き込まない
+	recorder.Write([]byte{0, 0, 0, 1, 0x41, 0x9a})
+	fixture := writeFixture(t, recorder)
+	status, err := recorder.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{id + ".mp4"}; !reflect.DeepEqual(status.Files, want) || status.FlightID != id {
+		t.Fatalf("status = %+v, want files %v", status, want)
+	}
+	path, err := recorder.Path(id + ".mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(path); !bytes.Equal(data, fixture) {
+		t.Errorf("recorded %d bytes, want the %d bytes of the fixture", len(data), len(fixture))
+	}
+	if _, err := recorder.Stop(); err != ErrNotRecording {
+		t.Errorf("err = %v, want ErrNotRecording", err)
+	}
+
+	// 同じ飛行で録画し直すと別のファイルになる
+	recorder.Start(false)
+	writeFixture(t, recorder)
+	if status, err := recorder.Stop(); err != nil || !reflect.DeepEqual(status.Files, []string{id + "-2.mp4"}) {
+		t.Fatalf("status = %+v, err = %v", status, err)
+	}
+	recordings, err := recorder.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recordings) != 2 {
+		t.Fatalf("recordings = %+v", recordings)
+	}
+	for _, rec := range recordings {
+		if rec.FlightID != id || rec.Raw || rec.Size != int64(len(fixture)) {
+			t.Errorf("recording = %+v", rec)
+		}
+	}
+	files, _ := ioutil.ReadDir(filepath.Join(dir, "recordings"))
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), recordingTempPrefix) {
+			t.Errorf("%s is left", file.Name())
+		}
+	}
+	if _, err := recorder.Path("../flight_logs/" + id + ".jsonl"); err != ErrRecordingNotFound {
+		t.Errorf("err = %v, want ErrRecordingNotFound", err)
+	}
+}
+
+func TestVideoRecorderMuxFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recorder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	recorder, _ := newTestRecorder(t, dir, "exit")
+
+	// MP4にできなくても生のH.264は残す
+	recorder.Start(false)
+	writeFixture(t, recorder)
+	status, err := recorder.Stop()
+	if err == nil || status.LastError == "" {
+		t.Fatalf("status = %+v, want an error", status)
+	}
+	recordings, _ := recorder.List()
+	if len(recordings) != 1 || !recordings[0].Raw || recordings[0].FlightID != "" ||
+		status.Files[0] != recordings[0].Name {
+		t.Fatalf("recordings = %+v, status = %+v", recordings, status)
+	}
+
+	// 映像を受け取っていなければファイルを作らない
+	recorder.Start(false)
+	if status, err := recorder.Stop(); err != ErrNoVideoFrame || len(status.Files) != 0 {
+		t.Errorf("status = %+v, err = %v, want ErrNoVideoFrame", status, err)
+	}
+}
+
+// 飛行が終わったら、その飛行の録画を止めて保存する
+func TestVideoRecorderStopsWhenFlightEnds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recorder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	recorder, flightLog := newTestRecorder(t, dir, "copy")
+
+	if err := recorder.Start(false); err != nil {
+		t.Fatal(err)
+	}
+	// 録画中に離陸した
+	flightLog.Begin()
+	id := flightLog.CurrentID()
+	writeFixture(t, recorder)
+	flightLog.End()
+	waitFor(t, "recording saved", func() bool {
+		status := recorder.Status()
+		return !status.Recording && !status.Saving && len(status.Files) > 0
+	})
+	if status := recorder.Status(); !reflect.DeepEqual(status.Files, []string{id + ".mp4"}) {
+		t.Errorf("status = %+v, want %s.mp4", status, id)
+	}
+}
+
+// 録画中に終了して残ったファイルは、起動時に録画を始めた時刻の名前で保存する
+func TestVideoRecorderRecoversLeftovers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recorder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	recordings := filepath.Join(dir, "recordings")
+	if err := os.MkdirAll(recordings, 0755); err != nil {
+		t.Fatal(err)
+	}
+	fixture, err := ioutil.ReadFile("testdata/tello.h264")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := "20240102-030405"
+	for name, data := range map[string][]byte{
+		recordingTempPrefix + id + recordingRawExt:                   fixture,
+		recordingTempPrefix + id + recordingAnnotated + recordingExt: []byte("annotated"),
+		// 録画のファイルではない
+		recordingTempPrefix + "notes.txt": []byte("notes"),
+	} {
+		if err := ioutil.WriteFile(filepath.Join(recordings, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	recorder, _ := newTestRecorder(t, dir, "copy")
+	want := []string{id + "_annotated.mp4", id + ".mp4"}
+	var got []string
+	waitFor(t, "leftovers saved", func() bool {
+		list, err := recorder.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = []string{}
+		for _, rec := range list {
+			got = append(got, rec.Name)
+		}
+		return reflect.DeepEqual(got, want)
+	})
+	files, _ := ioutil.ReadDir(recordings)
+	for _, file := range files {
+		if recordingTempPattern.MatchString(file.Name()) {
+			t.Errorf("%s is left", file.Name())
+		}
+	}
+	path, _ := recorder.Path(id + ".mp4")
+	if data, _ := ioutil.ReadFile(path); !bytes.Equal(data, fixture) {
+		t.Errorf("recovered %d bytes, want the %d bytes of the fixture", len(data), len(fixture))
+	}
+}
@@ -0,0 +1,230 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+var (
+	ErrCourseNotFound = errors.New("course not found")
+	ErrCourseExists   = errors.New("course id already exists")
+	ErrCourseRunning  = errors.New("course is running")
+)
+
+type CourseSummary struct {
+	ID      int    `json:"id"`
+	Name    string `json:"name"`
+	Steps   int    `json:"steps"`
+	Running bool   `json:"running"`
+}
+
+type registeredCourse struct {
+	course *MissionCourse
+	path   string
+}
+
+// ミッションファイルのディレクトリと同期したコースの一覧
+// APIから追加・更新・削除したコースはディレクトリに保存する
+type CourseRegistry struct {
+	mux     sync.RWMutex
+	dir     string
+	drone   *DroneManager
+	courses map[int]*registeredCourse
+}
+
+// ディレクトリ内の*.jsonをファイル名順に読み込む
+// IDを指定していないミッションにはファイル名順に空いている番号を振り、
+// 再起動しても同じ番号になるようにファイルに保存する
+func NewCourseRegistry(dir string, drone *DroneManager) *CourseRegistry {
+	r := &CourseRegistry{dir: dir, drone: drone, courses: map[int]*registeredCourse{}}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Printf("cannot create missions dir: %s", err.Error())
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		log.Println(err)
+	}
+	sort.Strings(paths)
+	var noID []*registeredCourse
+	for _, path := range paths {
+		m, err := LoadMission(path)
+		if err != nil {
+			log.Printf("action=NewCourseRegistry err=%s", err.Error())
+			continue
+		}
+		c := &registeredCourse{course: NewMissionCourse(m, drone), path: path}
+		if _, ok := r.courses[m.ID]; m.ID <= 0 || ok {
+			if ok {
+				log.Printf("action=NewCourseRegistry duplicate id=%d mission=%s", m.ID, m.Name)
+			}
+			noID = append(noID, c)
+			continue
+		}
+		r.courses[m.ID] = c
+	}
+	for _, c := range noID {
+		c.course.Mission.ID = r.nextID()
+		r.courses[c.course.Mission.ID] = c
+		if err := saveMission(c.path, c.course.Mission); err != nil {
+			log.Printf("action=NewCourseRegistry id=%d err=%s", c.course.Mission.ID, err.Error())
+		}
+	}
+	for id, c := range r.courses {
+		log.Printf("action=NewCourseRegistry id=%d mission=%s", id, c.course.Name)
+	}
+	drone.OnEmergency(r.abortAll)
+	drone.Safety.OnStop(r.abortAll)
+	return r
+}
+
+// ロック済みの状態で呼び出すこと
+// 登録されておらず、保存先のファイルもない番号を返す
+func (r *CourseRegistry) nextID() int {
+	id := 1
+	for r.courses[id] != nil || r.exists(id) {
+		id++
+	}
+	return id
+}
+
+func (r *CourseRegistry) coursePath(id int) string {
+	return filepath.Join(r.dir, fmt.Sprintf("course_%d.json", id))
+}
+
+func (r *CourseRegistry) exists(id int) bool {
+	_, err := os.Stat(r.coursePath(id))
+	return err == nil
+}
+
+func (r *CourseRegistry) abortAll() {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	for _, c := range r.courses {
+		c.course.Abort()
+	}
+}
+
+func (r *CourseRegistry) List() []CourseSummary {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	list := []CourseSummary{}
+	for id, c := range r.courses {
+		list = append(list, CourseSummary{
+			ID:      id,
+			Name:    c.course.Name,
+			Steps:   len(c.course.Mission.Steps),
+			Running: c.course.Running(),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// 実行用のコース
+func (r *CourseRegistry) Course(id int) (BaseCourse, error) {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	c, ok := r.courses[id]
+	if !ok {
+		return nil, ErrCourseNotFound
+	}
+	return c.course, nil
+}
+
+func (r *CourseRegistry) Get(id int) (*Mission, error) {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	c, ok := r.courses[id]
+	if !ok {
+		return nil, ErrCourseNotFound
+	}
+	return c.course.Mission, nil
+}
+
+// 新しいコースを保存する。IDが0の場合は空いている番号を振る
+// 引数のミッションは変更せず、保存したミッションを返す
+func (r *CourseRegistry) Create(m *Mission) (*Mission, error) {
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	saved := *m
+	if saved.ID <= 0 {
+		saved.ID = r.nextID()
+	} else if _, ok := r.courses[saved.ID]; ok || r.exists(saved.ID) {
+		return nil, ErrCourseExists
+	}
+	m = &saved
+	c := &registeredCourse{
+		course: NewMissionCourse(m, r.drone),
+		path:   r.coursePath(m.ID),
+	}
+	if err := saveMission(c.path, m); err != nil {
+		return nil, err
+	}
+	r.courses[m.ID] = c
+	log.Printf("action=CourseRegistry.Create id=%d mission=%s", m.ID, m.Name)
+	return m, nil
+}
+
+// 実行中のコースは変更できない
+func (r *CourseRegistry) Update(id int, m *Mission) (*Mission, error) {
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	c, ok := r.courses[id]
+	if !ok {
+		return nil, ErrCourseNotFound
+	}
+	if c.course.Running() {
+		return nil, ErrCourseRunning
+	}
+	m.ID = id
+	if err := saveMission(c.path, m); err != nil {
+		return nil, err
+	}
+	c.course = NewMissionCourse(m, r.drone)
+	log.Printf("action=CourseRegistry.Update id=%d mission=%s", m.ID, m.Name)
+	return m, nil
+}
+
+func (r *CourseRegistry) Delete(id int) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	c, ok := r.courses[id]
+	if !ok {
+		return ErrCourseNotFound
+	}
+	if c.course.Running() {
+		return ErrCourseRunning
+	}
+	if err := os.Remove(c.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	delete(r.courses, id)
+	log.Printf("action=CourseRegistry.Delete id=%d", id)
+	return nil
+}
+
+// 一時ファイルに書いてから置き換え、書き込み途中のファイルを読み込まないようにする
+func saveMission(path string, m *Mission) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(b, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
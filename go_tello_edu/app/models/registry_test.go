@@ -0,0 +1,74 @@
+package models
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func newTestRegistry(t *testing.T, dir string) *CourseRegistry {
+	d, _ := newTestDroneManager(t)
+	d.emergency = &emergencyStop{}
+	return NewCourseRegistry(dir, d)
+}
+
+func testMission(id int, name string) *Mission {
+	return &Mission{ID: id, Name: name, Steps: []MissionStep{{Action: StepTakeOff}, {Action: StepLand}}}
+}
+
+// 起動時に振った番号はファイルに保存し、再起動しても変わらない
+func TestCourseRegistryPersistsAssignedIDs(t *testing.T) {
+	dir := t.TempDir()
+	if err := saveMission(filepath.Join(dir, "a.json"), testMission(0, "A")); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveMission(filepath.Join(dir, "b.json"), testMission(1, "B")); err != nil {
+		t.Fatal(err)
+	}
+	r := newTestRegistry(t, dir)
+	if m, err := r.Get(2); err != nil || m.Name != "A" {
+		t.Fatalf("course 2 = %+v, %v", m, err)
+	}
+	m, err := LoadMission(filepath.Join(dir, "a.json"))
+	if err != nil || m.ID != 2 {
+		t.Fatalf("saved mission = %+v, %v", m, err)
+	}
+
+	// Bを消してもAの番号は変わらない
+	if err := r.Delete(1); err != nil {
+		t.Fatal(err)
+	}
+	r = newTestRegistry(t, dir)
+	if m, err := r.Get(2); err != nil || m.Name != "A" {
+		t.Errorf("course 2 after restart = %+v, %v", m, err)
+	}
+}
+
+func TestCourseRegistryCreate(t *testing.T) {
+	dir := t.TempDir()
+	// 読み込めないファイルが使っている番号は振らない
+	if err := ioutil.WriteFile(filepath.Join(dir, "course_1.json"), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r := newTestRegistry(t, dir)
+
+	m := testMission(0, "new")
+	created, err := r.Create(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.ID != 2 || m.ID != 0 {
+		t.Errorf("created id = %d, caller's id = %d, want 2 and 0", created.ID, m.ID)
+	}
+
+	for _, id := range []int{1, 2} {
+		m := testMission(id, "dup")
+		if _, err := r.Create(m); !errors.Is(err, ErrCourseExists) {
+			t.Errorf("Create(id=%d) err = %v, want ErrCourseExists", id, err)
+		}
+		if m.ID != id {
+			t.Errorf("caller's id changed to %d", m.ID)
+		}
+	}
+}
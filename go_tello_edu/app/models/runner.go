@@ -0,0 +1,217 @@
+package models
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	CourseEvent        = "course"
+	courseTickInterval = 100 * time.Millisecond
+)
+
+// コースランナーの状態
+type RunnerState string
+
+const (
+	RunnerIdle     RunnerState = "idle"
+	RunnerRunning  RunnerState = "running"
+	RunnerPaused   RunnerState = "paused"
+	RunnerFinished RunnerState = "finished"
+	RunnerAborted  RunnerState = "aborted"
+)
+
+var (
+	ErrRunnerBusy       = errors.New("another course is running")
+	ErrRunnerNotRunning = errors.New("no course is running")
+)
+
+type RunnerStatus struct {
+	State    RunnerState   `json:"state"`
+	CourseID int           `json:"course_id,omitempty"`
+	Course   *CourseStatus `json:"course,omitempty"`
+}
+
+// サーバー側のタイマーでコースを進める
+// ブラウザからのポーリング間隔に左右されずに、一定の間隔でRunを呼ぶ
+type CourseRunner struct {
+	mux    sync.Mutex
+	drone  *DroneManager
+	state  RunnerState
+	id     int
+	course BaseCourse
+	quit   chan struct{}
+	resume chan struct{}
+	// コースが終了・中断したときに呼ぶ処理
+	onDone []func(RunnerStatus)
+}
+
+func NewCourseRunner(drone *DroneManager) *CourseRunner {
+	r := &CourseRunner{drone: drone, state: RunnerIdle}
+	drone.OnEmergency(func() {
+		if err := r.Abort(); err == nil {
+			log.Println("action=CourseRunner aborted by emergency stop")
+		}
+	})
+	// 安全機能が止めた後にコースがコマンドを送り直さないようにする
+	drone.Safety.OnStop(func() {
+		if err := r.Abort(); err == nil {
+			log.Println("action=CourseRunner aborted by safety supervisor")
+		}
+	})
+	return r
+}
+
+// コースが終了・中断したときに呼ぶ処理を登録する
+// CourseEventは受信が遅いと破棄されるので、終了を確実に知りたい場合に使う
+// 処理はランナーのロックの外で呼ばれる
+func (r *CourseRunner) OnDone(f func(RunnerStatus)) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.onDone = append(r.onDone, f)
+}
+
+func (r *CourseRunner) done(status RunnerStatus) {
+	r.mux.Lock()
+	handlers := append([]func(RunnerStatus){}, r.onDone...)
+	r.mux.Unlock()
+	for _, f := range handlers {
+		f(status)
+	}
+}
+
+func (r *CourseRunner) Start(id int, course BaseCourse) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.state == RunnerRunning || r.state == RunnerPaused {
+		return ErrRunnerBusy
+	}
+	r.id = id
+	r.course = course
+	r.quit = make(chan struct{})
+	r.resume = nil
+	course.Start()
+	r.setState(RunnerRunning)
+	go r.run(course, r.quit)
+	return nil
+}
+
+func (r *CourseRunner) run(course BaseCourse, quit chan struct{}) {
+	t := time.NewTicker(courseTickInterval)
+	defer t.Stop()
+	last := 0
+	for {
+		select {
+		case <-quit:
+			return
+		case <-t.C:
+		}
+		r.mux.Lock()
+		resume := r.resume
+		r.mux.Unlock()
+		if resume != nil {
+			// 一時停止中はRunを呼ばない
+			select {
+			case <-quit:
+				return
+			case <-resume:
+			}
+			continue
+		}
+
+		course.Run()
+		p := course.Progress()
+		if p.Status != last {
+			last = p.Status
+			r.drone.events.Publish(CourseEvent, r.Status())
+		}
+		if !course.Running() {
+			r.mux.Lock()
+			finished := r.quit == quit
+			if finished {
+				r.setState(RunnerFinished)
+			}
+			status := r.status()
+			r.mux.Unlock()
+			if finished {
+				r.done(status)
+			}
+			return
+		}
+	}
+}
+
+func (r *CourseRunner) Pause() error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.state != RunnerRunning {
+		return ErrRunnerNotRunning
+	}
+	r.resume = make(chan struct{})
+	r.course.Pause()
+	r.setState(RunnerPaused)
+	return nil
+}
+
+func (r *CourseRunner) Resume() error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.state != RunnerPaused {
+		return ErrRunnerNotRunning
+	}
+	r.course.Resume()
+	close(r.resume)
+	r.resume = nil
+	r.setState(RunnerRunning)
+	return nil
+}
+
+// コースを中断してホバリングする
+func (r *CourseRunner) Abort() error {
+	r.mux.Lock()
+	if r.state != RunnerRunning && r.state != RunnerPaused {
+		r.mux.Unlock()
+		return ErrRunnerNotRunning
+	}
+	close(r.quit)
+	r.quit = nil
+	r.resume = nil
+	// Runの実行中でも待たないようにする
+	r.course.Abort()
+	r.drone.Hover()
+	r.setState(RunnerAborted)
+	status := r.status()
+	r.mux.Unlock()
+	r.done(status)
+	return nil
+}
+
+// ロック済みの状態で呼び出すこと
+func (r *CourseRunner) setState(state RunnerState) {
+	log.Printf("action=CourseRunner id=%d from=%s to=%s", r.id, r.state, state)
+	r.state = state
+	// 一時停止中は顔追跡や巡回に操作を譲る
+	if state == RunnerRunning {
+		r.drone.Control.Handover(BehaviorCourse)
+	} else {
+		r.drone.Control.Release(BehaviorCourse)
+	}
+	r.drone.events.Publish(CourseEvent, r.status())
+}
+
+func (r *CourseRunner) Status() RunnerStatus {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return r.status()
+}
+
+func (r *CourseRunner) status() RunnerStatus {
+	status := RunnerStatus{State: r.state, CourseID: r.id}
+	if r.course != nil {
+		p := r.course.Progress()
+		status.Course = &p
+	}
+	return status
+}
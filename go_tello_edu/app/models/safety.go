@@ -0,0 +1,235 @@
+package models
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+	"udemy_drone/go_tello_edu/config"
+)
+
+const (
+	SafetyEvent = "safety"
+	LogSafety   = "safety"
+)
+
+// 安全機能が実行する動作
+type SafetyAction string
+
+const (
+	SafetyNone          SafetyAction = "none"
+	SafetyWarn          SafetyAction = "warn"
+	SafetyHover         SafetyAction = "hover"
+	SafetyLand          SafetyAction = "land"
+	SafetyRefuseTakeOff SafetyAction = "refuse_takeoff"
+)
+
+var ErrTakeOffRefused = errors.New("takeoff refused: battery too low")
+
+type SafetyNotice struct {
+	Time       time.Time       `json:"time"`
+	Reason     string          `json:"reason"`
+	Action     SafetyAction    `json:"action"`
+	Battery    int             `json:"battery"`
+	Connection ConnectionState `json:"connection"`
+}
+
+// FlightDataと接続状態を監視して、バッテリー低下や通信断のときに自動で対処する
+type SafetySupervisor struct {
+	mux         sync.Mutex
+	drone       *DroneManager
+	triggered   map[string]bool
+	pendingLand bool
+	flying      bool
+	last        *SafetyNotice
+	// ホバリング・着陸させるときに呼ぶ処理(実行中のコースの中断など)
+	handlers []func()
+}
+
+func newSafetySupervisor(drone *DroneManager) *SafetySupervisor {
+	return &SafetySupervisor{drone: drone, triggered: map[string]bool{}}
+}
+
+func parseSafetyAction(s string) SafetyAction {
+	switch SafetyAction(s) {
+	case SafetyNone, SafetyWarn, SafetyHover, SafetyLand:
+		return SafetyAction(s)
+	}
+	log.Printf("unknown safety action %q, using %s", s, SafetyHover)
+	return SafetyHover
+}
+
+// イベントを購読して監視を続ける
+// 通信断などを取りこぼさないように、破棄されない購読を使う
+func (s *SafetySupervisor) watch() {
+	events, _ := s.drone.events.SubscribeReliable()
+	for e := range events {
+		switch e.Name {
+		case TelemetryEvent:
+			s.onTelemetry(e.Data.(Telemetry))
+		case ConnectionEvent:
+			s.onConnection(e.Data.(ConnectionState))
+		}
+	}
+}
+
+// 発動した安全動作(ロックを外してから実行する)
+type safetyTrigger struct {
+	reason string
+	action SafetyAction
+}
+
+func (s *SafetySupervisor) onTelemetry(t Telemetry) {
+	s.mux.Lock()
+	// 着陸したら次の飛行のために状態を戻す
+	if s.flying && !t.Flying {
+		s.triggered = map[string]bool{}
+		s.pendingLand = false
+	}
+	s.flying = t.Flying
+	var triggers []safetyTrigger
+	if t.Flying {
+		conf := config.Config
+		switch {
+		case conf.SafetyBatteryLand > 0 && t.Battery <= conf.SafetyBatteryLand:
+			triggers = s.trigger(triggers, "battery_land", SafetyLand)
+		case conf.SafetyBatteryHover > 0 && t.Battery <= conf.SafetyBatteryHover:
+			triggers = s.trigger(triggers, "battery_hover", SafetyHover)
+		case conf.SafetyBatteryWarn > 0 && t.Battery <= conf.SafetyBatteryWarn:
+			triggers = s.trigger(triggers, "battery_warn", SafetyWarn)
+		}
+		if t.TemperatureHigh {
+			triggers = s.trigger(triggers, "temperature_high", SafetyWarn)
+		}
+	}
+	s.mux.Unlock()
+
+	for _, tr := range triggers {
+		s.act(tr.reason, tr.action, t.Battery)
+	}
+}
+
+func (s *SafetySupervisor) onConnection(state ConnectionState) {
+	s.mux.Lock()
+	var triggers []safetyTrigger
+	retryLand := false
+	switch state {
+	case StateLost:
+		if s.flying {
+			triggers = s.trigger(triggers, "lost_link", parseSafetyAction(config.Config.SafetyLostLinkAction))
+		}
+	case StateConnected:
+		delete(s.triggered, "lost_link")
+		retryLand = s.pendingLand
+	}
+	s.mux.Unlock()
+
+	for _, tr := range triggers {
+		s.act(tr.reason, tr.action, s.drone.Telemetry().Battery)
+	}
+	// 通信断の間に送った着陸コマンドは届いていないかもしれないので、もう一度送る
+	if retryLand {
+		log.Println("action=SafetySupervisor retry land after reconnect")
+		s.land()
+	}
+}
+
+// ロック済みの状態で呼び出すこと
+// まだ発動していない動作をtriggersに追加する
+func (s *SafetySupervisor) trigger(triggers []safetyTrigger, reason string, action SafetyAction) []safetyTrigger {
+	if action == SafetyNone || s.triggered[reason] {
+		return triggers
+	}
+	s.triggered[reason] = true
+	return append(triggers, safetyTrigger{reason: reason, action: action})
+}
+
+// 安全機能がホバリング・着陸させるときに呼ぶ処理を登録する
+// 緊急停止と同じく、ブロックしないこと
+func (s *SafetySupervisor) OnStop(f func()) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.handlers = append(s.handlers, f)
+}
+
+// 安全機能以外(コマンドウォッチドッグなど)から機体を止める
+// 着陸コマンドを送れなかった場合はエラーを返し、再接続後に再送する
+func (s *SafetySupervisor) Intervene(reason string, action SafetyAction) error {
+	return s.act(reason, action, s.drone.Telemetry().Battery)
+}
+
+// ロックせずに呼び出すこと
+// (巡回の停止は巡回のgoroutineが送っているコマンドの完了を待つ)
+func (s *SafetySupervisor) act(reason string, action SafetyAction, battery int) (err error) {
+	if action == SafetyHover || action == SafetyLand {
+		// 自律動作を止めてから機体を止める
+		s.mux.Lock()
+		handlers := append([]func(){}, s.handlers...)
+		s.mux.Unlock()
+		for _, f := range handlers {
+			f()
+		}
+		s.drone.Patrol.Stop()
+		s.drone.DisableFaceDetectTracking()
+		s.drone.Hover()
+	}
+	if action == SafetyLand {
+		err = s.land()
+	}
+	s.report(reason, action, battery)
+	return err
+}
+
+// 着陸コマンドを送る
+// 送れなかった場合や通信断の間に送った場合は、再接続したときに再送する
+func (s *SafetySupervisor) land() error {
+	return s.landSent(s.drone.Land())
+}
+
+// 着陸コマンドを送った結果を記録して、再送が必要か判断する
+func (s *SafetySupervisor) landSent(err error) error {
+	if err != nil {
+		log.Printf("action=SafetySupervisor land failed err=%s", err.Error())
+	}
+	connected := s.drone.IsConnected()
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.pendingLand = err != nil || !connected
+	return err
+}
+
+func (s *SafetySupervisor) report(reason string, action SafetyAction, battery int) {
+	notice := SafetyNotice{
+		Time:       time.Now(),
+		Reason:     reason,
+		Action:     action,
+		Battery:    battery,
+		Connection: s.drone.ConnectionStatus().State,
+	}
+	s.mux.Lock()
+	s.last = &notice
+	s.mux.Unlock()
+	log.Printf("action=SafetySupervisor reason=%s safety_action=%s battery=%d", reason, action, battery)
+	s.drone.events.Publish(SafetyEvent, notice)
+	s.drone.FlightLog.Record(LogSafety, notice)
+}
+
+// 離陸してよいかを確認する
+func (s *SafetySupervisor) CheckTakeOff() error {
+	t := s.drone.Telemetry()
+	min := config.Config.SafetyTakeOffMinBattery
+	// まだFlightDataを受信していない、または接続していない場合は判断できないので許可する
+	// (接続していなければ離陸コマンド自体がErrNotConnectedになる)
+	if min <= 0 || t.Time.IsZero() || t.Connection != StateConnected || t.Battery >= min {
+		return nil
+	}
+	s.report("battery_takeoff", SafetyRefuseTakeOff, t.Battery)
+	return ErrTakeOffRefused
+}
+
+// 最後に実行した安全動作
+func (s *SafetySupervisor) LastNotice() *SafetyNotice {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.last
+}
@@ -0,0 +1,103 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+	"time"
+	"udemy_drone/go_tello_edu/config"
+)
+
+// 接続状態を確認するDroneと安全機能を持つDroneManagerを作る
+func newTestLinkedDroneManager(t *testing.T, state ConnectionState) (*DroneManager, *fakeDrone, *connection) {
+	d, fake := newTestDroneManager(t)
+	conn := newConnection()
+	conn.state = state
+	d.conn = conn
+	d.position = newPositionEstimator()
+	d.emergency = &emergencyStop{}
+	d.driver = fake
+	d.Drone = &connectedDrone{Drone: fake, conn: conn, stop: d.emergency}
+	d.Safety = newSafetySupervisor(d)
+	return d, fake, conn
+}
+
+// 通信断で着陸する設定なら、接続が途絶えていても着陸コマンドを送り、再接続したら再送する
+func TestSafetyLostLinkLands(t *testing.T) {
+	defer func(action string) { config.Config.SafetyLostLinkAction = action }(config.Config.SafetyLostLinkAction)
+	config.Config.SafetyLostLinkAction = "land"
+
+	d, fake, conn := newTestLinkedDroneManager(t, StateConnected)
+	s := d.Safety
+
+	s.onTelemetry(Telemetry{Flying: true, Battery: 80})
+	conn.state = StateLost
+	s.onConnection(StateLost)
+	if got, want := fake.Commands(), []string{"hover", "land"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("commands = %v, want %v", got, want)
+	}
+	if notice := s.LastNotice(); notice == nil || notice.Reason != "lost_link" || notice.Action != SafetyLand {
+		t.Errorf("notice = %+v", notice)
+	}
+
+	conn.state = StateConnected
+	s.onConnection(StateConnected)
+	s.onConnection(StateConnected)
+	if got, want := fake.Commands(), []string{"hover", "land", "land"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("commands after reconnect = %v, want %v", got, want)
+	}
+}
+
+// 緊急停止は通信断の間もドライバーに直接着陸を送り、他のコマンドはロックする
+func TestEmergencyLandsWhileLinkLost(t *testing.T) {
+	defer func(lockout time.Duration) { config.Config.EmergencyLockout = lockout }(config.Config.EmergencyLockout)
+	config.Config.EmergencyLockout = time.Minute
+
+	d, fake, conn := newTestLinkedDroneManager(t, StateReconnecting)
+	d.Safety.onTelemetry(Telemetry{Flying: true, Battery: 80})
+
+	if err := d.Emergency(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fake.Commands(), []string{"hover", "land"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("commands = %v, want %v", got, want)
+	}
+	if notice := d.Safety.LastNotice(); notice == nil || notice.Reason != "emergency" {
+		t.Errorf("notice = %+v", notice)
+	}
+
+	// 再接続したら着陸を再送し、移動はロックしたまま
+	conn.state = StateConnected
+	d.Safety.onConnection(StateConnected)
+	if err := d.Drone.Forward(10); err != ErrEmergencyStop {
+		t.Errorf("Forward() = %v, want ErrEmergencyStop", err)
+	}
+	if got, want := fake.Commands(), []string{"hover", "land", "land"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("commands after reconnect = %v, want %v", got, want)
+	}
+}
+
+// 安全機能が着陸させたら、実行中のコースを中断してコマンドを送らせない
+func TestSafetyLandAbortsCourse(t *testing.T) {
+	d, fake, _ := newTestLinkedDroneManager(t, StateConnected)
+	runner := NewCourseRunner(d)
+	course := NewMissionCourse(&Mission{Name: "hover", Steps: []MissionStep{{Action: StepHover, Duration: 10}}}, d)
+	if err := runner.Start(1, course); err != nil {
+		t.Fatal(err)
+	}
+	defer runner.Abort()
+	waitFor(t, "course running", func() bool { return course.Running() })
+
+	if err := d.Safety.Intervene("test", SafetyLand); err != nil {
+		t.Fatal(err)
+	}
+	if status := runner.Status(); status.State != RunnerAborted {
+		t.Errorf("runner = %s, want %s", status.State, RunnerAborted)
+	}
+	// コースはRunが終わったところで止まる
+	waitFor(t, "course stopped", func() bool { return !course.Running() })
+	n := len(fake.Commands())
+	time.Sleep(3 * courseTickInterval)
+	if got := fake.Commands(); len(got) != n {
+		t.Errorf("commands after land = %v", got[n:])
+	}
+}
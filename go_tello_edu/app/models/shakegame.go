@@ -0,0 +1,240 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxPlayerNameLength = 20
+	// 終了したセッションを結果の表示用に残しておく時間
+	shakeSessionTTL = time.Hour
+)
+
+var (
+	ErrShakeSessionNotFound = errors.New("shake session not found")
+	ErrShakeSessionInactive = errors.New("shake session is not playing")
+	ErrPlayerNameRequired   = errors.New("player name is required")
+)
+
+// シェイクゲームのセッションの状態
+type ShakeState string
+
+const (
+	ShakePlaying  ShakeState = "playing"
+	ShakeFinished ShakeState = "finished"
+	ShakeAborted  ShakeState = "aborted"
+)
+
+type ShakeSession struct {
+	ID       string        `json:"id"`
+	Player   string        `json:"player"`
+	CourseID int           `json:"course_id"`
+	State    ShakeState    `json:"state"`
+	Shakes   int           `json:"shakes"`
+	Started  time.Time     `json:"started"`
+	Time     time.Duration `json:"time,omitempty"`
+	Rank     int           `json:"rank,omitempty"`
+	ended    time.Time
+}
+
+type LeaderboardEntry struct {
+	Player   string        `json:"player"`
+	CourseID int           `json:"course_id"`
+	Course   string        `json:"course"`
+	Time     time.Duration `json:"time"`
+	Date     time.Time     `json:"date"`
+}
+
+// コースを完了するまでの時間のランキング(JSONファイルに保存する)
+type Leaderboard struct {
+	mux     sync.Mutex
+	path    string
+	entries []LeaderboardEntry
+}
+
+func NewLeaderboard(path string) *Leaderboard {
+	l := &Leaderboard{path: path, entries: []LeaderboardEntry{}}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("cannot read leaderboard: %s", err.Error())
+		}
+		return l
+	}
+	if err := json.Unmarshal(b, &l.entries); err != nil {
+		log.Printf("cannot read leaderboard: %s", err.Error())
+	}
+	return l
+}
+
+// 記録を追加してコース内の順位を返す
+func (l *Leaderboard) Add(e LeaderboardEntry) int {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.entries = append(l.entries, e)
+	sort.SliceStable(l.entries, func(i, j int) bool { return l.entries[i].Time < l.entries[j].Time })
+	b, err := json.MarshalIndent(l.entries, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(l.path, b, 0644)
+	}
+	if err != nil {
+		log.Printf("cannot save leaderboard: %s", err.Error())
+	}
+	rank := 0
+	for _, entry := range l.entries {
+		if entry.CourseID != e.CourseID {
+			continue
+		}
+		rank++
+		if entry == e {
+			break
+		}
+	}
+	return rank
+}
+
+// courseIDが0の場合は全てのコースの記録を返す
+func (l *Leaderboard) Top(courseID, limit int) []LeaderboardEntry {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	top := []LeaderboardEntry{}
+	for _, e := range l.entries {
+		if courseID != 0 && e.CourseID != courseID {
+			continue
+		}
+		if limit > 0 && len(top) >= limit {
+			break
+		}
+		top = append(top, e)
+	}
+	return top
+}
+
+// スマートフォンを振ってコースを進めるゲーム
+// ドローンは1台なので、同時に遊べるのはCourseRunnerで実行中の1人だけ
+type ShakeGame struct {
+	mux         sync.Mutex
+	runner      *CourseRunner
+	courses     *CourseRegistry
+	sessions    map[string]*ShakeSession
+	active      *ShakeSession
+	course      BaseCourse
+	Leaderboard *Leaderboard
+}
+
+func NewShakeGame(runner *CourseRunner, courses *CourseRegistry, leaderboardFile string) *ShakeGame {
+	g := &ShakeGame{
+		runner:      runner,
+		courses:     courses,
+		sessions:    map[string]*ShakeSession{},
+		Leaderboard: NewLeaderboard(leaderboardFile),
+	}
+	// コースの終了を待って記録する
+	runner.OnDone(g.finish)
+	return g
+}
+
+// 新しいセッションでコースを開始する
+func (g *ShakeGame) Start(player string, courseID int) (ShakeSession, error) {
+	player = strings.TrimSpace(player)
+	if player == "" {
+		return ShakeSession{}, ErrPlayerNameRequired
+	}
+	if len([]rune(player)) > maxPlayerNameLength {
+		player = string([]rune(player)[:maxPlayerNameLength])
+	}
+	course, err := g.courses.Course(courseID)
+	if err != nil {
+		return ShakeSession{}, err
+	}
+
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	if err := g.runner.Start(courseID, course); err != nil {
+		return ShakeSession{}, err
+	}
+	g.prune(time.Now())
+	session := &ShakeSession{
+		ID:       newSessionID(),
+		Player:   player,
+		CourseID: courseID,
+		State:    ShakePlaying,
+		Started:  time.Now(),
+	}
+	g.sessions[session.ID] = session
+	g.active = session
+	g.course = course
+	log.Printf("action=ShakeGame.Start session=%s player=%s course=%d", session.ID, player, courseID)
+	return *session, nil
+}
+
+// 振った回数を1回増やす
+func (g *ShakeGame) Shake(id string) (ShakeSession, error) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	session, ok := g.sessions[id]
+	if !ok {
+		return ShakeSession{}, ErrShakeSessionNotFound
+	}
+	if session != g.active {
+		return *session, ErrShakeSessionInactive
+	}
+	session.Shakes = g.course.Shake()
+	return *session, nil
+}
+
+func (g *ShakeGame) Session(id string) (ShakeSession, error) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	session, ok := g.sessions[id]
+	if !ok {
+		return ShakeSession{}, ErrShakeSessionNotFound
+	}
+	return *session, nil
+}
+
+// ロック済みの状態で呼び出すこと
+// 終了してからshakeSessionTTLが経過したセッションを削除する
+func (g *ShakeGame) prune(now time.Time) {
+	for id, session := range g.sessions {
+		if session != g.active && !session.ended.IsZero() && now.Sub(session.ended) > shakeSessionTTL {
+			delete(g.sessions, id)
+		}
+	}
+}
+
+// CourseRunnerでコースが終了・中断したときに呼ばれる
+func (g *ShakeGame) finish(status RunnerStatus) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	session := g.active
+	if session == nil || status.CourseID != session.CourseID || status.Course == nil {
+		return
+	}
+	g.active = nil
+	g.course = nil
+	session.ended = time.Now()
+	if status.State != RunnerFinished || !status.Course.Completed {
+		session.State = ShakeAborted
+		log.Printf("action=ShakeGame session=%s aborted", session.ID)
+		return
+	}
+	session.State = ShakeFinished
+	session.Time = status.Course.Elapsed
+	session.Rank = g.Leaderboard.Add(LeaderboardEntry{
+		Player:   session.Player,
+		CourseID: session.CourseID,
+		Course:   status.Course.Name,
+		Time:     session.Time,
+		Date:     time.Now(),
+	})
+	log.Printf("action=ShakeGame session=%s player=%s time=%s rank=%d", session.ID, session.Player, session.Time, session.Rank)
+}
@@ -0,0 +1,62 @@
+package models
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestShakeGameSessions(t *testing.T) {
+	dir := t.TempDir()
+	d, _, _ := newTestLinkedDroneManager(t, StateConnected)
+	if err := saveMission(filepath.Join(dir, "quick.json"), testMission(1, "quick")); err != nil {
+		t.Fatal(err)
+	}
+	slow := &Mission{ID: 2, Name: "slow", Steps: []MissionStep{{Action: StepHover, Duration: 10}}}
+	if err := saveMission(filepath.Join(dir, "slow.json"), slow); err != nil {
+		t.Fatal(err)
+	}
+	runner := NewCourseRunner(d)
+	game := NewShakeGame(runner, NewCourseRegistry(dir, d), filepath.Join(dir, "leaderboard.json"))
+
+	// 完了したらCourseEventを購読していなくても記録される
+	first, err := game.Start("alice", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "finish", func() bool {
+		s, _ := game.Session(first.ID)
+		return s.State == ShakeFinished
+	})
+	if s, _ := game.Session(first.ID); s.Rank != 1 {
+		t.Errorf("session = %+v, want rank 1", s)
+	}
+
+	// 中断はAbortから戻る前に反映される
+	second, err := game.Start("bob", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := runner.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := game.Session(second.ID); s.State != ShakeAborted {
+		t.Errorf("session = %+v, want aborted", s)
+	}
+
+	// 終了してから時間が経ったセッションは次の開始時に削除する
+	game.mux.Lock()
+	game.sessions[first.ID].ended = time.Now().Add(-2 * shakeSessionTTL)
+	game.mux.Unlock()
+	if _, err := game.Start("carol", 2); err != nil {
+		t.Fatal(err)
+	}
+	defer runner.Abort()
+	if _, err := game.Session(first.ID); !errors.Is(err, ErrShakeSessionNotFound) {
+		t.Errorf("old session err = %v, want ErrShakeSessionNotFound", err)
+	}
+	if _, err := game.Session(second.ID); err != nil {
+		t.Errorf("recent session err = %v", err)
+	}
+}
@@ -0,0 +1,412 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"sync"
+	"time"
+	"udemy_drone/go_tello_edu/config"
+
+	"gocv.io/x/gocv"
+	"gocv.io/x/gocv/contrib"
+)
+
+const (
+	TargetEvent = "target"
+
+	// 毎フレーム検出器で探す
+	TargetModeDetect = "detect"
+	// 一度検出したらトラッカーで追い、定期的に検出し直す
+	TargetModeTrack = "track"
+
+	// ロックの要求が映像処理で受け付けられるまで待つ時間
+	targetLockTimeout = 2 * time.Second
+	// 座標だけで範囲を指定しなかった場合のラベル
+	targetLockLabel = "Target"
+)
+
+var (
+	ErrNoTarget      = errors.New("no object at the selected point")
+	ErrInvalidTarget = errors.New("invalid target config")
+	ErrNoVideoFrame  = errors.New("no video frame")
+)
+
+var (
+	TargetModes       = []string{TargetModeDetect, TargetModeTrack}
+	TrackerAlgorithms = []string{"kcf", "csrt", "mil"}
+)
+
+type TargetConfig struct {
+	Mode string `json:"mode"`
+	// kcf, csrt, mil
+	Algorithm string `json:"algorithm"`
+	// トラッカーで追っている間に検出し直す間隔
+	Redetect time.Duration `json:"redetect_ns"`
+	// ロックした物体を見失ってからロックを解除するまでの時間(0なら解除しない)
+	LostTimeout time.Duration `json:"lost_timeout_ns"`
+}
+
+func targetConfigFromConfig() TargetConfig {
+	c := config.Config
+	return TargetConfig{
+		Mode:        c.TargetMode,
+		Algorithm:   c.TargetAlgorithm,
+		Redetect:    c.TargetRedetect,
+		LostTimeout: c.TargetLostTimeout,
+	}
+}
+
+func (c TargetConfig) Validate() error {
+	switch c.Mode {
+	case TargetModeDetect, TargetModeTrack:
+	default:
+		return fmt.Errorf("%w: unknown mode %q", ErrInvalidTarget, c.Mode)
+	}
+	switch c.Algorithm {
+	case "kcf", "csrt", "mil":
+	default:
+		return fmt.Errorf("%w: unknown algorithm %q", ErrInvalidTarget, c.Algorithm)
+	}
+	if c.Redetect <= 0 || c.LostTimeout < 0 {
+		return fmt.Errorf("%w: redetect must be positive", ErrInvalidTarget)
+	}
+	return nil
+}
+
+// KCFとCSRTはopencv_contribが必要
+func newTracker(algorithm string) (gocv.Tracker, error) {
+	switch algorithm {
+	case "kcf":
+		return contrib.NewTrackerKCF(), nil
+	case "csrt":
+		return contrib.NewTrackerCSRT(), nil
+	case "mil":
+		return gocv.NewTrackerMIL(), nil
+	}
+	return nil, fmt.Errorf("%w: unknown algorithm %q", ErrInvalidTarget, algorithm)
+}
+
+type TargetStatus struct {
+	TargetConfig
+	Locked bool `json:"locked"`
+	// 追跡中の物体(見失っていればnil)
+	Target *Detection `json:"target"`
+}
+
+// 映像をクリックして追跡する物体を選ぶ要求
+type targetLock struct {
+	point image.Point
+	// 範囲の大きさ(0なら検出した物体からpointを含むものを選ぶ)
+	size   image.Point
+	result chan error
+}
+
+// 追跡する物体を映像のフレームごとに決める
+// トラッカーなどOpenCVのオブジェクトはProcessの中(映像処理のgoroutine)でだけ使う
+type TargetTracker struct {
+	mux        sync.Mutex
+	conf       TargetConfig
+	detect     func(img gocv.Mat) []Detection
+	newTracker func(algorithm string) (gocv.Tracker, error)
+	publish    func(name string, data interface{})
+
+	lockRequest chan *targetLock
+	lockMux     sync.Mutex
+
+	tracker gocv.Tracker
+	target  Detection
+	found   bool
+	locked  bool
+	// 最後に検出器で位置を確かめた時刻と、ロックした物体を見失った時刻
+	lastDetect time.Time
+	lostSince  time.Time
+	// 追跡していない間に検出した物体と、その時刻
+	idle       []Detection
+	idleDetect time.Time
+}
+
+// detectは検出器、publishは状態の変化の通知先
+func NewTargetTracker(conf TargetConfig, detect func(img gocv.Mat) []Detection, publish func(name string, data interface{})) *TargetTracker {
+	return &TargetTracker{
+		conf:        conf,
+		detect:      detect,
+		newTracker:  newTracker,
+		publish:     publish,
+		lockRequest: make(chan *targetLock, 1),
+	}
+}
+
+func (t *TargetTracker) Status() TargetStatus {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return t.status()
+}
+
+// ロック済みの状態で呼び出すこと
+func (t *TargetTracker) status() TargetStatus {
+	status := TargetStatus{TargetConfig: t.conf, Locked: t.locked}
+	if t.found {
+		target := t.target
+		status.Target = &target
+	}
+	return status
+}
+
+// 追跡モードやトラッカーの種類を変更する
+// トラッカーは作り直すので、ロック中の物体は次のフレームで検出し直す
+func (t *TargetTracker) SetConfig(conf TargetConfig) error {
+	if err := conf.Validate(); err != nil {
+		return err
+	}
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.conf = conf
+	t.closeTracker()
+	t.lost(time.Now())
+	log.Printf("action=TargetTracker mode=%s algorithm=%s", conf.Mode, conf.Algorithm)
+	return nil
+}
+
+// 映像の座標pointにある物体をロックして追跡する
+// sizeを指定した場合は、検出器で見つからない物体でもその範囲を追跡する
+func (t *TargetTracker) Lock(point, size image.Point) error {
+	// 同時に呼ばれても要求は1つずつ出す
+	t.lockMux.Lock()
+	defer t.lockMux.Unlock()
+	req := &targetLock{point: point, size: size, result: make(chan error, 1)}
+	t.lockRequest <- req
+	timer := time.NewTimer(targetLockTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-req.result:
+		return err
+	case <-timer.C:
+		// 映像が届いていない場合は要求を取り下げる
+		select {
+		case <-t.lockRequest:
+		default:
+			// 取り下げる前に受け付けられた
+			return <-req.result
+		}
+		return ErrNoVideoFrame
+	}
+}
+
+func (t *TargetTracker) Unlock() {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if !t.locked {
+		return
+	}
+	t.locked = false
+	t.closeTracker()
+	t.found = false
+	log.Println("action=TargetTracker unlocked")
+	t.publish(TargetEvent, t.status())
+}
+
+// フレームから追跡する物体を探す
+// activeは追跡中かどうか(追跡していなくてもロックした物体は追い続ける)
+// 追跡もロックもしていなければ、redetectの間隔で検出だけする
+// 返り値はこのフレームで検出器が見つけた物体と、追跡する物体
+func (t *TargetTracker) Process(img gocv.Mat, active bool, now time.Time) ([]Detection, Detection, bool) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	f := &targetFrame{img: img, detect: t.detect}
+	before := t.status()
+
+	select {
+	case req := <-t.lockRequest:
+		req.result <- t.lock(f, req, now)
+	default:
+	}
+
+	idle := !active && !t.locked
+	switch {
+	case idle:
+		t.closeTracker()
+		t.found = false
+		// 映像をクリックして選べるように、追跡していなくても間隔をあけて検出する
+		if f.done || now.Sub(t.idleDetect) >= t.conf.Redetect {
+			t.idle, t.idleDetect = f.detections(), now
+		}
+		f.detected = t.idle
+	case t.conf.Mode == TargetModeDetect && !t.locked:
+		t.closeTracker()
+		detections := f.detections()
+		t.found = len(detections) > 0
+		if t.found {
+			t.target = detections[0]
+		}
+	case t.tracker != nil:
+		t.follow(f, now)
+	default:
+		t.acquire(f, now)
+	}
+	if !idle {
+		t.idle, t.idleDetect = nil, time.Time{}
+	}
+
+	if after := t.status(); after.Locked != before.Locked || (after.Target == nil) != (before.Target == nil) {
+		t.publish(TargetEvent, after)
+	}
+	return f.detected, t.target, t.found
+}
+
+// 1フレームで検出器を何度も実行しないようにする
+type targetFrame struct {
+	img      gocv.Mat
+	detect   func(img gocv.Mat) []Detection
+	detected []Detection
+	done     bool
+}
+
+func (f *targetFrame) detections() []Detection {
+	if !f.done {
+		f.detected = f.detect(f.img)
+		f.done = true
+	}
+	return f.detected
+}
+
+func (f *targetFrame) bounds() image.Rectangle {
+	return image.Rect(0, 0, f.img.Cols(), f.img.Rows())
+}
+
+func (t *TargetTracker) lock(f *targetFrame, req *targetLock, now time.Time) error {
+	var target Detection
+	if req.size.X > 0 && req.size.Y > 0 {
+		min := req.point.Sub(req.size.Div(2))
+		target = Detection{Rect: image.Rectangle{Min: min, Max: min.Add(req.size)}.Intersect(f.bounds()), Label: targetLockLabel}
+		if target.Rect.Empty() {
+			return ErrNoTarget
+		}
+	} else {
+		// 重なっている場合は小さい方を選ぶ
+		found := false
+		for _, d := range f.detections() {
+			if !req.point.In(d.Rect) {
+				continue
+			}
+			if s, ts := d.Rect.Size(), target.Rect.Size(); !found || s.X*s.Y < ts.X*ts.Y {
+				target, found = d, true
+			}
+		}
+		if !found {
+			return ErrNoTarget
+		}
+	}
+	if err := t.start(f, target, now); err != nil {
+		return err
+	}
+	t.locked = true
+	log.Printf("action=TargetTracker locked label=%s rect=%v", target.Label, target.Rect)
+	return nil
+}
+
+// トラッカーで追い、定期的に、または見失ったときに検出器で位置を補正する
+func (t *TargetTracker) follow(f *targetFrame, now time.Time) {
+	rect, ok := t.tracker.Update(f.img)
+	rect = rect.Intersect(f.bounds())
+	ok = ok && !rect.Empty()
+	if ok {
+		t.target.Rect = rect
+		if now.Sub(t.lastDetect) < t.conf.Redetect {
+			return
+		}
+	}
+	if d, matched := matchTarget(f.detections(), t.target.Rect); matched {
+		if t.locked {
+			// クリックで範囲を指定した場合もラベルは変えない
+			d.Label = t.target.Label
+		}
+		if err := t.start(f, d, now); err == nil {
+			return
+		}
+	}
+	if ok {
+		// 検出器で見つからなくても(横を向いた顔など)トラッカーが追えていれば続ける
+		t.lastDetect = now
+		return
+	}
+	t.closeTracker()
+	t.lost(now)
+}
+
+// 追跡する物体がないときに検出器で探す
+func (t *TargetTracker) acquire(f *targetFrame, now time.Time) {
+	detections := f.detections()
+	if !t.locked {
+		if len(detections) > 0 {
+			t.start(f, detections[0], now)
+		}
+		return
+	}
+	// ロックした物体は最後に見えた位置の周辺で探す
+	s := t.target.Rect.Size()
+	if d, matched := matchTarget(detections, t.target.Rect.Inset(-(s.X+s.Y)/4)); matched {
+		d.Label = t.target.Label
+		if err := t.start(f, d, now); err == nil {
+			return
+		}
+	}
+	if t.conf.LostTimeout > 0 && now.Sub(t.lostSince) >= t.conf.LostTimeout {
+		t.locked = false
+		log.Printf("action=TargetTracker unlocked lost=%s", now.Sub(t.lostSince))
+	}
+}
+
+func (t *TargetTracker) start(f *targetFrame, target Detection, now time.Time) error {
+	tracker, err := t.newTracker(t.conf.Algorithm)
+	if err != nil {
+		return err
+	}
+	if !tracker.Init(f.img, target.Rect) {
+		tracker.Close()
+		return ErrNoTarget
+	}
+	t.closeTracker()
+	t.tracker = tracker
+	t.target = target
+	t.found = true
+	t.lastDetect = now
+	return nil
+}
+
+// 最後の位置(t.target.Rect)は残しておき、ロック中なら周辺を探す
+func (t *TargetTracker) lost(now time.Time) {
+	if t.found {
+		t.lostSince = now
+	}
+	t.found = false
+}
+
+func (t *TargetTracker) closeTracker() {
+	if t.tracker != nil {
+		t.tracker.Close()
+		t.tracker = nil
+	}
+}
+
+// rectと最も重なる(IoUが大きい)物体を返す
+func matchTarget(detections []Detection, rect image.Rectangle) (Detection, bool) {
+	best, bestIoU := Detection{}, 0.0
+	for _, d := range detections {
+		if iou := intersectionOverUnion(d.Rect, rect); iou > bestIoU {
+			best, bestIoU = d, iou
+		}
+	}
+	return best, bestIoU > 0
+}
+
+func intersectionOverUnion(a, b image.Rectangle) float64 {
+	area := func(r image.Rectangle) int { return r.Dx() * r.Dy() }
+	inter := area(a.Intersect(b))
+	union := area(a) + area(b) - inter
+	if union <= 0 {
+		return 0
+	}
+	return float64(inter) / float64(union)
+}
@@ -0,0 +1,208 @@
+package models
+
+import (
+	"image"
+	"testing"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+// Updateで決まった位置を返すトラッカー
+type fakeTracker struct {
+	rect image.Rectangle
+	ok   bool
+}
+
+func (f *fakeTracker) Close() error { return nil }
+
+func (f *fakeTracker) Init(img gocv.Mat, r image.Rectangle) bool {
+	f.rect, f.ok = r, true
+	return true
+}
+
+func (f *fakeTracker) Update(img gocv.Mat) (image.Rectangle, bool) { return f.rect, f.ok }
+
+type fakeDetector struct {
+	detections []Detection
+	calls      int
+}
+
+func (f *fakeDetector) detect(img gocv.Mat) []Detection {
+	f.calls++
+	return f.detections
+}
+
+func newTestTargetTracker(mode string) (*TargetTracker, *fakeDetector, *fakeTracker) {
+	detector := &fakeDetector{}
+	tracker := &fakeTracker{}
+	conf := TargetConfig{Mode: mode, Algorithm: "kcf", Redetect: time.Second, LostTimeout: 3 * time.Second}
+	t := NewTargetTracker(conf, detector.detect, func(string, interface{}) {})
+	t.newTracker = func(string) (gocv.Tracker, error) { return tracker, nil }
+	return t, detector, tracker
+}
+
+func testFrame() gocv.Mat {
+	return gocv.NewMatWithSize(frameY, frameX, gocv.MatTypeCV8UC3)
+}
+
+func TestTargetTrackerTrackMode(t *testing.T) {
+	target, detector, tracker := newTestTargetTracker(TargetModeTrack)
+	img := testFrame()
+	start := time.Now()
+	face := Detection{Rect: image.Rect(100, 100, 140, 140), Label: "Human"}
+	detector.detections = []Detection{face}
+
+	if _, got, found := target.Process(img, true, start); !found || got.Rect != face.Rect {
+		t.Fatalf("target = %v %v, want %v", got, found, face)
+	}
+	// 再検出の間隔まではトラッカーの位置を使う
+	tracker.rect = face.Rect.Add(image.Pt(10, 0))
+	for i := 1; i < 5; i++ {
+		_, got, found := target.Process(img, true, start.Add(time.Duration(i)*100*time.Millisecond))
+		if !found || got.Rect != tracker.rect {
+			t.Fatalf("frame %d: target = %v %v, want %v", i, got, found, tracker.rect)
+		}
+	}
+	if detector.calls != 1 {
+		t.Errorf("detect called %d times, want 1", detector.calls)
+	}
+	// 間隔が過ぎたら検出し直し、重なる物体に合わせる
+	target.Process(img, true, start.Add(time.Second))
+	if detector.calls != 2 {
+		t.Errorf("detect called %d times, want 2", detector.calls)
+	}
+	// トラッカーが見失ったらすぐに検出し直す
+	tracker.ok = false
+	detector.detections = nil
+	if _, _, found := target.Process(img, true, start.Add(1100*time.Millisecond)); found {
+		t.Error("target should be lost")
+	}
+	if detector.calls != 3 {
+		t.Errorf("detect called %d times, want 3", detector.calls)
+	}
+	// 追跡をやめたら物体を選べるように検出だけを間隔をあけて続ける
+	target.Process(img, false, start.Add(1200*time.Millisecond))
+	target.Process(img, false, start.Add(1300*time.Millisecond))
+	if detector.calls != 4 {
+		t.Errorf("detect called %d times while inactive, want 4", detector.calls)
+	}
+}
+
+// Lockは映像処理で受け付けられるまで待つので、Processを呼びながら結果を受け取る
+func lockTarget(target *TargetTracker, img gocv.Mat, point, size image.Point) error {
+	result := make(chan error)
+	go func() { result <- target.Lock(point, size) }()
+	for {
+		select {
+		case err := <-result:
+			return err
+		default:
+			target.Process(img, false, time.Now())
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func TestTargetTrackerLock(t *testing.T) {
+	target, detector, tracker := newTestTargetTracker(TargetModeDetect)
+	img := testFrame()
+	large := Detection{Rect: image.Rect(50, 50, 150, 150), Label: "large"}
+	small := Detection{Rect: image.Rect(90, 90, 110, 110), Label: "small"}
+	detector.detections = []Detection{large, small}
+
+	if err := lockTarget(target, img, image.Pt(10, 10), image.Point{}); err != ErrNoTarget {
+		t.Fatalf("err = %v, want ErrNoTarget", err)
+	}
+	// 重なっている場合は小さい方を選ぶ
+	if err := lockTarget(target, img, image.Pt(100, 100), image.Point{}); err != nil {
+		t.Fatal(err)
+	}
+	status := target.Status()
+	if !status.Locked || status.Target == nil || status.Target.Label != "small" {
+		t.Fatalf("status = %+v, want small locked", status)
+	}
+	// 追跡していなくてもロックした物体は追い続ける
+	tracker.rect = small.Rect.Add(image.Pt(5, 5))
+	if _, got, found := target.Process(img, false, time.Now()); !found || got.Rect != tracker.rect {
+		t.Errorf("target = %v %v, want %v", got, found, tracker.rect)
+	}
+	target.Unlock()
+	if status := target.Status(); status.Locked || status.Target != nil {
+		t.Errorf("status = %+v after unlock", status)
+	}
+
+	// 範囲を指定すると検出されていない場所もロックできる
+	if err := lockTarget(target, img, image.Pt(20, 20), image.Pt(20, 20)); err != nil {
+		t.Fatal(err)
+	}
+	if got := target.Status().Target; got == nil || got.Rect != image.Rect(10, 10, 30, 30) {
+		t.Errorf("target = %v, want (10,10)-(30,30)", got)
+	}
+}
+
+// 追跡していない間も、映像から選べるように間隔をあけて検出する
+func TestTargetTrackerIdleDetects(t *testing.T) {
+	target, detector, _ := newTestTargetTracker(TargetModeTrack)
+	img := testFrame()
+	start := time.Now()
+	face := Detection{Rect: image.Rect(100, 100, 140, 140), Label: "Human"}
+	detector.detections = []Detection{face}
+
+	for _, tt := range []struct {
+		at    time.Duration
+		calls int
+	}{
+		{0, 1},
+		// 間隔の間は前の検出結果を返す
+		{500 * time.Millisecond, 1},
+		{time.Second, 2},
+	} {
+		detections, _, found := target.Process(img, false, start.Add(tt.at))
+		if found || len(detections) != 1 || detections[0] != face {
+			t.Errorf("%s: detections = %v found = %t, want %v only", tt.at, detections, found, face)
+		}
+		if detector.calls != tt.calls {
+			t.Errorf("%s: detector calls = %d, want %d", tt.at, detector.calls, tt.calls)
+		}
+	}
+}
+
+func TestTargetTrackerLockedLost(t *testing.T) {
+	target, detector, tracker := newTestTargetTracker(TargetModeTrack)
+	img := testFrame()
+	face := Detection{Rect: image.Rect(100, 100, 140, 140), Label: "Human"}
+	other := Detection{Rect: image.Rect(250, 10, 290, 50), Label: "Human"}
+	detector.detections = []Detection{face}
+	if err := lockTarget(target, img, image.Pt(120, 120), image.Point{}); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	tracker.ok = false
+	detector.detections = []Detection{other}
+	if _, _, found := target.Process(img, true, start); found {
+		t.Fatal("target should be lost")
+	}
+	// ロック中は離れた物体に乗り換えない
+	if _, _, found := target.Process(img, true, start.Add(time.Second)); found {
+		t.Error("locked target should not switch to another object")
+	}
+	// 最後に見えた位置の近くで見つかれば追跡を再開する
+	detector.detections = []Detection{other, {Rect: face.Rect.Add(image.Pt(15, 0))}}
+	if _, got, found := target.Process(img, true, start.Add(2*time.Second)); !found || got.Rect != face.Rect.Add(image.Pt(15, 0)) {
+		t.Fatalf("target = %v %v, want reacquired", got, found)
+	}
+	if got := target.Status().Target.Label; got != "Human" {
+		t.Errorf("label = %q, want the locked label", got)
+	}
+
+	// lost_timeoutを過ぎたらロックを解除する
+	tracker.ok = false
+	detector.detections = nil
+	target.Process(img, true, start.Add(3*time.Second))
+	target.Process(img, true, start.Add(6*time.Second))
+	if target.Status().Locked {
+		t.Error("lock should be released after lost timeout")
+	}
+}
@@ -0,0 +1,82 @@
+package models
+
+import (
+	"sync"
+	"time"
+
+	"gobot.io/x/gobot/platforms/dji/tello"
+)
+
+const TelemetryEvent = "telemetry"
+
+// ブラウザに配信するドローンの状態
+// Telloの高さ・速度はデシメートル単位なのでメートルに変換する
+type Telemetry struct {
+	Time                time.Time       `json:"time"`
+	Connection          ConnectionState `json:"connection"`
+	Battery             int             `json:"battery"`
+	BatteryLow          bool            `json:"battery_low"`
+	Height              float64         `json:"height"`
+	NorthSpeed          float64         `json:"north_speed"`
+	EastSpeed           float64         `json:"east_speed"`
+	VerticalSpeed       float64         `json:"vertical_speed"`
+	GroundSpeed         float64         `json:"ground_speed"`
+	FlyTime             int             `json:"fly_time"`
+	FlyTimeLeft         int             `json:"fly_time_left"`
+	WifiStrength        int             `json:"wifi_strength"`
+	TemperatureHigh     bool            `json:"temperature_high"`
+	FlyMode             int             `json:"fly_mode"`
+	Flying              bool            `json:"flying"`
+	OnGround            bool            `json:"on_ground"`
+	Hovering            bool            `json:"hovering"`
+	ImuState            bool            `json:"imu_state"`
+	ImuCalibrationState int             `json:"imu_calibration_state"`
+	// 離陸地点からの推定位置
+	Position Position `json:"position"`
+}
+
+type telemetryState struct {
+	mux          sync.RWMutex
+	current      Telemetry
+	wifiStrength int
+}
+
+func (t *telemetryState) updateFlightData(fd *tello.FlightData, conn ConnectionState) Telemetry {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.current = Telemetry{
+		Time:                time.Now(),
+		Connection:          conn,
+		Battery:             int(fd.BatteryPercentage),
+		BatteryLow:          fd.BatteryLow || fd.BatteryLower,
+		Height:              float64(fd.Height) / 10,
+		NorthSpeed:          float64(fd.NorthSpeed) / 10,
+		EastSpeed:           float64(fd.EastSpeed) / 10,
+		VerticalSpeed:       float64(fd.VerticalSpeed) / 10,
+		GroundSpeed:         fd.GroundSpeed() / 10,
+		FlyTime:             int(fd.FlyTime),
+		FlyTimeLeft:         int(fd.DroneFlyTimeLeft),
+		WifiStrength:        t.wifiStrength,
+		TemperatureHigh:     fd.TemperatureHigh,
+		FlyMode:             int(fd.FlyMode),
+		Flying:              fd.Flying,
+		OnGround:            fd.OnGround,
+		Hovering:            fd.DroneHover,
+		ImuState:            fd.ImuState,
+		ImuCalibrationState: int(fd.ImuCalibrationState),
+	}
+	return t.current
+}
+
+func (t *telemetryState) updateWifi(wd *tello.WifiData) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.wifiStrength = int(wd.Strength)
+	t.current.WifiStrength = t.wifiStrength
+}
+
+func (t *telemetryState) get() Telemetry {
+	t.mux.RLock()
+	defer t.mux.RUnlock()
+	return t.current
+}
@@ -0,0 +1,243 @@
+package models
+
+import (
+	"fmt"
+	"image"
+	"log"
+	"math"
+	"sync"
+	"time"
+	"udemy_drone/go_tello_edu/config"
+)
+
+// フレームの間隔がこれより空いたら、前回までの積分・微分を使わない
+const trackingMaxFrameGap = 500 * time.Millisecond
+
+// PID制御
+// 入力は正規化したずれ(-1から1程度)、出力は速度(0-100)の単位
+type pidController struct {
+	Kp, Ki, Kd float64
+	// 積分が溜まりすぎないように、Ki*integralをこの範囲に収める
+	limit    float64
+	integral float64
+	prevErr  float64
+	started  bool
+}
+
+func (p *pidController) update(err, dt float64) float64 {
+	derivative := 0.0
+	if p.started && dt > 0 {
+		p.integral += err * dt
+		derivative = (err - p.prevErr) / dt
+	}
+	if p.Ki > 0 && p.limit > 0 {
+		max := p.limit / p.Ki
+		p.integral = math.Max(-max, math.Min(max, p.integral))
+	}
+	p.prevErr = err
+	p.started = true
+	return p.Kp*err + p.Ki*p.integral + p.Kd*derivative
+}
+
+func (p *pidController) reset() {
+	p.integral = 0
+	p.prevErr = 0
+	p.started = false
+}
+
+type TrackingGains struct {
+	Kp float64
+	Ki float64
+	Kd float64
+}
+
+type FaceTrackerConfig struct {
+	// trueなら左右のずれを回転で追う(falseなら左右に移動する)
+	Yaw bool
+	// 左右・上下・前後(顔の大きさ)のゲイン
+	X, Y, Distance TrackingGains
+	// 顔の面積の目標(画面に対する%)
+	TargetArea float64
+	// 出力する速度の上限と、1フレームで変える速度の上限
+	MaxSpeed int
+	MaxStep  int
+	// 顔の位置・大きさの平滑化(新しいフレームの重み、1なら平滑化しない)
+	Smoothing float64
+	// 正規化したずれがこの値未満なら0とみなす
+	Deadband float64
+}
+
+func faceTrackerConfigFromConfig() FaceTrackerConfig {
+	c := config.Config
+	return FaceTrackerConfig{
+		Yaw:        c.TrackingYaw,
+		X:          TrackingGains{Kp: c.TrackingXKp, Ki: c.TrackingXKi, Kd: c.TrackingXKd},
+		Y:          TrackingGains{Kp: c.TrackingYKp, Ki: c.TrackingYKi, Kd: c.TrackingYKd},
+		Distance:   TrackingGains{Kp: c.TrackingDistanceKp, Ki: c.TrackingDistanceKi, Kd: c.TrackingDistanceKd},
+		TargetArea: c.TrackingTargetArea,
+		MaxSpeed:   c.TrackingMaxSpeed,
+		MaxStep:    c.TrackingMaxStep,
+		Smoothing:  c.TrackingSmoothing,
+		Deadband:   c.TrackingDeadband,
+	}
+}
+
+// 各軸の速度
+// X: 右(Yawなら時計回り)が正、Y: 上が正、Z: 前が正
+type trackingOutput struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+	Z int `json:"z"`
+}
+
+// 顔の位置と大きさから、画面の中央に目標の大きさで映るように速度を決める
+type FaceTracker struct {
+	mux  sync.Mutex
+	conf FaceTrackerConfig
+	x    pidController
+	y    pidController
+	z    pidController
+	// 平滑化した顔の中心と面積(%)
+	centerX, centerY, area float64
+	last                   time.Time
+	out                    trackingOutput
+}
+
+func NewFaceTracker(conf FaceTrackerConfig) *FaceTracker {
+	// 0以下では顔の位置が更新されず、1を超えると発散する
+	// 設定ファイルの読み込みと同じ値を使う
+	if conf.Smoothing <= 0 || conf.Smoothing > 1 {
+		log.Printf("action=NewFaceTracker smoothing=%v must be in (0, 1], using %v", conf.Smoothing, config.DefaultTrackingSmoothing)
+		conf.Smoothing = config.DefaultTrackingSmoothing
+	}
+	limit := float64(conf.MaxSpeed)
+	return &FaceTracker{
+		conf: conf,
+		x:    pidController{Kp: conf.X.Kp, Ki: conf.X.Ki, Kd: conf.X.Kd, limit: limit},
+		y:    pidController{Kp: conf.Y.Kp, Ki: conf.Y.Ki, Kd: conf.Y.Kd, limit: limit},
+		z:    pidController{Kp: conf.Distance.Kp, Ki: conf.Distance.Ki, Kd: conf.Distance.Kd, limit: limit},
+	}
+}
+
+// 顔を見失ったときや追跡を始めるときに呼ぶ
+func (t *FaceTracker) Reset() {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.reset()
+}
+
+func (t *FaceTracker) reset() {
+	t.x.reset()
+	t.y.reset()
+	t.z.reset()
+	t.last = time.Time{}
+	t.out = trackingOutput{}
+}
+
+// 顔の矩形からフレームごとの判断を返す
+func (t *FaceTracker) Update(r image.Rectangle, now time.Time) trackingDecision {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	centerX := float64(r.Min.X+r.Max.X) / 2
+	centerY := float64(r.Min.Y+r.Max.Y) / 2
+	area := float64(r.Dx()*r.Dy()) / float64(frameArea) * 100
+
+	dt := 0.0
+	if t.last.IsZero() || now.Sub(t.last) > trackingMaxFrameGap {
+		t.reset()
+		t.centerX, t.centerY, t.area = centerX, centerY, area
+	} else {
+		dt = now.Sub(t.last).Seconds()
+		a := t.conf.Smoothing
+		t.centerX += a * (centerX - t.centerX)
+		t.centerY += a * (centerY - t.centerY)
+		t.area += a * (area - t.area)
+	}
+	t.last = now
+
+	// 正規化したずれ(顔が右・上・遠くにあると正)
+	cx, cy := float64(frameCenterX), float64(frameCenterY)
+	errX := t.deadband((t.centerX - cx) / cx)
+	errY := t.deadband((cy - t.centerY) / cy)
+	errZ := 0.0
+	if t.conf.TargetArea > 0 {
+		errZ = t.deadband((t.conf.TargetArea - t.area) / t.conf.TargetArea)
+	}
+
+	t.out = trackingOutput{
+		X: t.limit(t.out.X, t.x.update(errX, dt)),
+		Y: t.limit(t.out.Y, t.y.update(errY, dt)),
+		Z: t.limit(t.out.Z, t.z.update(errZ, dt)),
+	}
+	return trackingDecision{
+		Face:     r,
+		DiffX:    int(cx - t.centerX),
+		DiffY:    int(cy - t.centerY),
+		PercentF: math.Round(t.area),
+		Errors:   [3]float64{errX, errY, errZ},
+		Output:   t.out,
+	}
+}
+
+func (t *FaceTracker) deadband(err float64) float64 {
+	if math.Abs(err) < t.conf.Deadband {
+		return 0
+	}
+	return err
+}
+
+// 速度の上限と、前のフレームからの変化量の上限を適用する
+func (t *FaceTracker) limit(prev int, v float64) int {
+	max := float64(t.conf.MaxSpeed)
+	v = math.Max(-max, math.Min(max, v))
+	if t.conf.MaxStep > 0 {
+		step := float64(t.conf.MaxStep)
+		v = math.Max(float64(prev)-step, math.Min(float64(prev)+step, v))
+	}
+	return int(math.Round(v))
+}
+
+// 顔追跡での判断内容(フライトログに記録する)
+type trackingDecision struct {
+	Face     image.Rectangle `json:"face"`
+	DiffX    int             `json:"diff_x"`
+	DiffY    int             `json:"diff_y"`
+	PercentF float64         `json:"percent_f"`
+	// 正規化したずれ(左右、上下、前後)
+	Errors [3]float64     `json:"errors"`
+	Output trackingOutput `json:"output"`
+	Moves  []string       `json:"moves"`
+}
+
+// 判断した速度を機体に送る
+// 速度0の軸も送って、前のフレームの入力が残らないようにする
+func (d *DroneManager) chaseFace(r image.Rectangle) {
+	decision := d.faceTracker.Update(r, time.Now())
+	o := decision.Output
+	moves := []string{}
+	drive := func(v int, pos, neg string, fpos, fneg func(int) error) {
+		name, f := pos, fpos
+		if v < 0 {
+			name, f, v = neg, fneg, -v
+		}
+		if err := f(v); err != nil {
+			return
+		}
+		if v != 0 {
+			moves = append(moves, fmt.Sprintf("%s %d", name, v))
+		}
+	}
+	if d.faceTracker.conf.Yaw {
+		drive(o.X, "clockwise", "counter_clockwise", d.tracking.Clockwise, d.tracking.CounterClockwise)
+	} else {
+		drive(o.X, "right", "left", d.tracking.Right, d.tracking.Left)
+	}
+	drive(o.Y, "up", "down", d.tracking.Up, d.tracking.Down)
+	drive(o.Z, "forward", "backward", d.tracking.Forward, d.tracking.Backward)
+	if len(moves) == 0 {
+		moves = append(moves, "hover")
+	}
+	decision.Moves = moves
+	d.FlightLog.Record(LogTracking, decision)
+}
@@ -0,0 +1,182 @@
+package models
+
+import (
+	"image"
+	"math"
+	"testing"
+	"time"
+	"udemy_drone/go_tello_edu/config"
+)
+
+var testTrackerConfig = FaceTrackerConfig{
+	X:          TrackingGains{Kp: 40, Kd: 10},
+	Y:          TrackingGains{Kp: 40, Kd: 10},
+	Distance:   TrackingGains{Kp: 20, Kd: 5},
+	TargetArea: 10,
+	MaxSpeed:   30,
+	MaxStep:    10,
+	Smoothing:  1,
+	Deadband:   0.1,
+}
+
+// 中心(cx, cy)に面積がframeのpercent%の正方形の顔
+func faceRect(cx, cy int, percent float64) image.Rectangle {
+	side := int(math.Sqrt(float64(frameArea) * percent / 100))
+	return image.Rect(cx-side/2, cy-side/2, cx-side/2+side, cy-side/2+side)
+}
+
+// 同じ矩形を100ms間隔でn回入力して最後の出力を返す
+func feedFace(tracker *FaceTracker, r image.Rectangle, start time.Time, n int) trackingOutput {
+	var d trackingDecision
+	for i := 0; i < n; i++ {
+		d = tracker.Update(r, start.Add(time.Duration(i)*100*time.Millisecond))
+	}
+	return d.Output
+}
+
+func TestPIDController(t *testing.T) {
+	p := pidController{Kp: 2, Ki: 1, Kd: 0.5, limit: 10}
+	// 最初の入力では積分・微分を使わない
+	if got := p.update(1, 0.1); got != 2 {
+		t.Errorf("first output = %v, want 2", got)
+	}
+	// 2*0.5 + 1*(0.5*0.1) + 0.5*(0.5-1)/0.1
+	if got := p.update(0.5, 0.1); math.Abs(got-(1+0.05-2.5)) > 1e-9 {
+		t.Errorf("second output = %v, want %v", got, 1+0.05-2.5)
+	}
+	// 積分はKi*integralがlimitを超えないように抑える
+	for i := 0; i < 100; i++ {
+		p.update(1, 1)
+	}
+	if p.integral > 10 {
+		t.Errorf("integral = %v, should be limited to 10", p.integral)
+	}
+	p.reset()
+	if p.integral != 0 || p.started {
+		t.Error("reset should clear state")
+	}
+}
+
+func TestFaceTrackerCentered(t *testing.T) {
+	tracker := NewFaceTracker(testTrackerConfig)
+	out := feedFace(tracker, faceRect(frameCenterX, frameCenterY, 10), time.Now(), 5)
+	if out != (trackingOutput{}) {
+		t.Errorf("centered face at target size should not move: %+v", out)
+	}
+}
+
+// 以前はfaceCenterXをr.Min.Yから計算していたため、中央の顔でも左右に動いていた
+func TestFaceTrackerUsesHorizontalCenter(t *testing.T) {
+	tracker := NewFaceTracker(testTrackerConfig)
+	r := faceRect(frameCenterX, frameCenterY, 10)
+	if d := tracker.Update(r, time.Now()); d.Output.X != 0 || d.DiffX != 0 {
+		t.Errorf("face centered horizontally: diff_x=%d output=%+v", d.DiffX, d.Output)
+	}
+}
+
+func TestFaceTrackerDirections(t *testing.T) {
+	start := time.Now()
+	tests := []struct {
+		name string
+		face image.Rectangle
+		want func(o trackingOutput) bool
+	}{
+		{"right", faceRect(frameX-30, frameCenterY, 10), func(o trackingOutput) bool { return o.X > 0 && o.Y == 0 }},
+		{"left", faceRect(30, frameCenterY, 10), func(o trackingOutput) bool { return o.X < 0 && o.Y == 0 }},
+		{"above", faceRect(frameCenterX, 30, 10), func(o trackingOutput) bool { return o.Y > 0 && o.X == 0 }},
+		{"below", faceRect(frameCenterX, frameY-30, 10), func(o trackingOutput) bool { return o.Y < 0 && o.X == 0 }},
+		{"far", faceRect(frameCenterX, frameCenterY, 2), func(o trackingOutput) bool { return o.Z > 0 }},
+		{"near", faceRect(frameCenterX, frameCenterY, 30), func(o trackingOutput) bool { return o.Z < 0 }},
+	}
+	for _, tt := range tests {
+		out := feedFace(NewFaceTracker(testTrackerConfig), tt.face, start, 3)
+		if !tt.want(out) {
+			t.Errorf("%s: unexpected output %+v", tt.name, out)
+		}
+	}
+}
+
+func TestFaceTrackerRateLimit(t *testing.T) {
+	tracker := NewFaceTracker(testTrackerConfig)
+	start := time.Now()
+	r := faceRect(frameX-10, frameCenterY, 10)
+	prev := 0
+	for i := 0; i < 10; i++ {
+		out := tracker.Update(r, start.Add(time.Duration(i)*100*time.Millisecond)).Output
+		if out.X-prev > testTrackerConfig.MaxStep {
+			t.Fatalf("frame %d: output changed from %d to %d", i, prev, out.X)
+		}
+		if out.X > testTrackerConfig.MaxSpeed {
+			t.Fatalf("frame %d: output %d exceeds max speed", i, out.X)
+		}
+		prev = out.X
+	}
+	if prev != testTrackerConfig.MaxSpeed {
+		t.Errorf("output should reach max speed, got %d", prev)
+	}
+}
+
+func TestFaceTrackerSmoothing(t *testing.T) {
+	conf := testTrackerConfig
+	conf.Smoothing = 0.5
+	conf.MaxStep = 0
+	tracker := NewFaceTracker(conf)
+	start := time.Now()
+	tracker.Update(faceRect(frameCenterX, frameCenterY, 10), start)
+	// 1フレームだけ大きく外れても、平滑化で半分のずれとして扱う
+	d := tracker.Update(faceRect(frameX-20, frameCenterY, 10), start.Add(100*time.Millisecond))
+	want := frameCenterX - (frameCenterX+(frameX-20))/2
+	if d.DiffX != want {
+		t.Errorf("diff_x = %d, want %d", d.DiffX, want)
+	}
+}
+
+// 顔を見失った後やフレームが途切れた後は、前回の速度から続けない
+func TestFaceTrackerReset(t *testing.T) {
+	tracker := NewFaceTracker(testTrackerConfig)
+	start := time.Now()
+	feedFace(tracker, faceRect(frameX-10, frameCenterY, 10), start, 5)
+	tracker.Reset()
+	out := tracker.Update(faceRect(frameCenterX, frameCenterY, 10), start.Add(time.Second))
+	if out.Output != (trackingOutput{}) {
+		t.Errorf("output after reset = %+v", out.Output)
+	}
+
+	feedFace(tracker, faceRect(frameX-10, frameCenterY, 10), start.Add(2*time.Second), 5)
+	out = tracker.Update(faceRect(frameCenterX, frameCenterY, 10), start.Add(5*time.Second))
+	if out.Output != (trackingOutput{}) {
+		t.Errorf("output after frame gap = %+v", out.Output)
+	}
+}
+
+func TestChaseFaceSendsAllAxes(t *testing.T) {
+	d, fake := newTestDroneManager(t)
+	d.EnableFaceDetectTracking()
+	d.chaseFace(faceRect(frameX-10, frameCenterY, 10))
+	want := []string{"right", "up", "forward"}
+	got := fake.Commands()
+	if len(got) != len(want) {
+		t.Fatalf("commands = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("commands = %v, want %v", got, want)
+		}
+	}
+}
+
+// 平滑化の重みが範囲外なら設定ファイルと同じ既定値を使う
+func TestFaceTrackerInvalidSmoothing(t *testing.T) {
+	for _, smoothing := range []float64{0, -0.5, 1.5} {
+		conf := testTrackerConfig
+		conf.Smoothing = smoothing
+		tracker := NewFaceTracker(conf)
+		start := time.Now()
+		tracker.Update(faceRect(frameCenterX, frameCenterY, 10), start)
+		tracker.Update(faceRect(frameCenterX+40, frameCenterY, 10), start.Add(100*time.Millisecond))
+		want := float64(frameCenterX) + 40*config.DefaultTrackingSmoothing
+		if tracker.conf.Smoothing != config.DefaultTrackingSmoothing || math.Abs(tracker.centerX-want) > 1 {
+			t.Errorf("smoothing=%v: using %v, center x = %v, want %v", smoothing, tracker.conf.Smoothing, tracker.centerX, want)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"sync"
+	"time"
+	"udemy_drone/go_tello_edu/config"
+)
+
+const watchdogCheckInterval = 200 * time.Millisecond
+
+var ErrWatchdogSessionNotFound = errors.New("watchdog session not found")
+
+type WatchdogSession struct {
+	ID            string        `json:"id"`
+	Timeout       time.Duration `json:"timeout_ns"`
+	Action        SafetyAction  `json:"action"`
+	LastHeartbeat time.Time     `json:"last_heartbeat"`
+}
+
+// ブラウザからのハートビートが途絶えたら機体を止める(デッドマンスイッチ)
+// 操縦画面ごとにセッションを有効にし、タブを閉じたり通信が切れたりすると
+// timeout経過後にホバリング(セッションの指定によっては着陸)する
+type CommandWatchdog struct {
+	mux      sync.Mutex
+	drone    *DroneManager
+	sessions map[string]*WatchdogSession
+}
+
+func newCommandWatchdog(drone *DroneManager) *CommandWatchdog {
+	return &CommandWatchdog{drone: drone, sessions: map[string]*WatchdogSession{}}
+}
+
+func newSessionID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return time.Now().Format("150405.000000000")
+	}
+	return hex.EncodeToString(b)
+}
+
+// セッションを開始する
+// timeoutが0以下の場合、landがnilの場合は設定ファイルの値を使う
+func (w *CommandWatchdog) Enable(timeout time.Duration, land *bool) WatchdogSession {
+	if timeout <= 0 {
+		timeout = config.Config.WatchdogTimeout
+	}
+	if land == nil {
+		land = &config.Config.WatchdogLand
+	}
+	action := SafetyHover
+	if *land {
+		action = SafetyLand
+	}
+	session := &WatchdogSession{
+		ID:            newSessionID(),
+		Timeout:       timeout,
+		Action:        action,
+		LastHeartbeat: time.Now(),
+	}
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	w.sessions[session.ID] = session
+	log.Printf("action=CommandWatchdog.Enable session=%s timeout=%s safety_action=%s", session.ID, timeout, action)
+	return *session
+}
+
+// ハートビートを受け取る
+// タイムアウトして削除されたセッションの場合はErrWatchdogSessionNotFound
+func (w *CommandWatchdog) Heartbeat(id string) (WatchdogSession, error) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	session, ok := w.sessions[id]
+	if !ok {
+		return WatchdogSession{}, ErrWatchdogSessionNotFound
+	}
+	session.LastHeartbeat = time.Now()
+	return *session, nil
+}
+
+// セッションを終了する(画面側で明示的に無効にした場合)
+func (w *CommandWatchdog) Disable(id string) error {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if _, ok := w.sessions[id]; !ok {
+		return ErrWatchdogSessionNotFound
+	}
+	delete(w.sessions, id)
+	log.Printf("action=CommandWatchdog.Disable session=%s", id)
+	return nil
+}
+
+// タイムアウトしたセッションを取り除いて返す
+func (w *CommandWatchdog) expire(now time.Time) []WatchdogSession {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	var expired []WatchdogSession
+	for id, session := range w.sessions {
+		if now.Sub(session.LastHeartbeat) > session.Timeout {
+			expired = append(expired, *session)
+			delete(w.sessions, id)
+		}
+	}
+	return expired
+}
+
+func (w *CommandWatchdog) watch() {
+	ticker := time.NewTicker(watchdogCheckInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		for _, session := range w.expire(now) {
+			log.Printf("action=CommandWatchdog session=%s expired last_heartbeat=%s",
+				session.ID, session.LastHeartbeat.Format(time.RFC3339))
+			// 地上にいる場合は止める必要がない
+			if !w.drone.Telemetry().Flying {
+				continue
+			}
+			w.drone.Safety.Intervene("watchdog_timeout", session.Action)
+		}
+	}
+}
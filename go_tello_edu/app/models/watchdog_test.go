@@ -0,0 +1,34 @@
+package models
+
+import (
+	"testing"
+	"time"
+	"udemy_drone/go_tello_edu/config"
+)
+
+// 着陸するかはセッションごとに決め、指定しなければ設定ファイルの値を使う
+func TestCommandWatchdogActionPerSession(t *testing.T) {
+	defer func(land bool) { config.Config.WatchdogLand = land }(config.Config.WatchdogLand)
+	config.Config.WatchdogLand = false
+
+	d, _ := newTestDroneManager(t)
+	w := newCommandWatchdog(d)
+	land, hover := true, false
+	want := map[string]SafetyAction{
+		w.Enable(time.Second, &land).ID:  SafetyLand,
+		w.Enable(time.Second, &hover).ID: SafetyHover,
+		w.Enable(time.Second, nil).ID:    SafetyHover,
+	}
+	config.Config.WatchdogLand = true
+	want[w.Enable(time.Second, nil).ID] = SafetyLand
+
+	expired := w.expire(time.Now().Add(2 * time.Second))
+	if len(expired) != len(want) {
+		t.Fatalf("expired %d sessions, want %d", len(expired), len(want))
+	}
+	for _, s := range expired {
+		if s.Action != want[s.ID] {
+			t.Errorf("session %s: action = %s, want %s", s.ID, s.Action, want[s.ID])
+		}
+	}
+}
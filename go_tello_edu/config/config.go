@@ -3,27 +3,251 @@ package config
 import (
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"gopkg.in/ini.v1"
 )
 
 type ConfList struct {
-	LogFile string
-	Address string
-	Port    int
+	LogFile      string
+	FlightLogDir string
+	MissionsDir  string
+	Address      string
+	Port         int
+
+	DroneIP             string
+	DroneLocalPort      int
+	DroneVideoPort      int
+	DroneConnectTimeout time.Duration
+	// FlightDataが届かない場合に切断とみなすまでの時間
+	DroneLostTimeout       time.Duration
+	DroneReconnectInterval time.Duration
+
+	// 映像のデコード
+	VideoDecoder       string
+	FfmpegPath         string
+	FfmpegArgs         []string
+	VideoHwaccel       string
+	VideoHwaccelDevice string
+	VideoLogLevel      string
+	// デコード後の映像の大きさ(物体の検出や追跡はこの大きさで行う)
+	VideoWidth           int
+	VideoHeight          int
+	VideoRestartInterval time.Duration
+	VideoStallTimeout    time.Duration
+
+	// バッテリー残量(%)のしきい値。0で無効
+	SafetyBatteryWarn       int
+	SafetyBatteryHover      int
+	SafetyBatteryLand       int
+	SafetyTakeOffMinBattery int
+	SafetyLostLinkAction    string
+	// 緊急停止後に着陸以外のコマンドを拒否する時間
+	EmergencyLockout time.Duration
+
+	// 離陸地点からの飛行範囲(m)。0で無効
+	GeofenceMaxHeight   float64
+	GeofenceMaxRadius   float64
+	GeofenceBoxNorth    float64
+	GeofenceBoxEast     float64
+	GeofenceMargin      float64
+	GeofenceReturnSpeed int
+
+	// ブラウザからのハートビートが途絶えてから機体を止めるまでの時間
+	WatchdogTimeout time.Duration
+	WatchdogLand    bool
+
+	// シェイクゲームのランキングの保存先
+	LeaderboardFile string
+
+	// 手動操作のコマンドを送ってから、コースや巡回に操作を戻すまでの時間
+	ControlManualHold time.Duration
+
+	// 顔追跡のPID制御
+	TrackingYaw        bool
+	TrackingXKp        float64
+	TrackingXKi        float64
+	TrackingXKd        float64
+	TrackingYKp        float64
+	TrackingYKi        float64
+	TrackingYKd        float64
+	TrackingDistanceKp float64
+	TrackingDistanceKi float64
+	TrackingDistanceKd float64
+	TrackingTargetArea float64
+	TrackingMaxSpeed   int
+	TrackingMaxStep    int
+	TrackingSmoothing  float64
+	TrackingDeadband   float64
+
+	// 追跡する物体の検出器(haar, dnn, color)
+	DetectorType          string
+	DetectorModelsDir     string
+	DetectorHaarCascade   string
+	DetectorHaarLabel     string
+	DetectorDNNKind       string
+	DetectorDNNModel      string
+	DetectorDNNConfig     string
+	DetectorDNNLabels     string
+	DetectorDNNClasses    []int
+	DetectorDNNConfidence float64
+	DetectorDNNSize       int
+	DetectorDNNScale      float64
+	DetectorDNNMean       []float64
+	DetectorColorLower    []float64
+	DetectorColorUpper    []float64
+	DetectorColorMinArea  float64
+	DetectorColorLabel    string
+
+	// 追跡する物体をトラッカーで追う設定
+	TargetMode        string
+	TargetAlgorithm   string
+	TargetRedetect    time.Duration
+	TargetLostTimeout time.Duration
+
+	// 飛行の録画
+	RecordingDir           string
+	RecordingFrameRate     float64
+	RecordingAnnotated     bool
+	RecordingAnnotatedArgs []string
 }
 
 var Config ConfList
 
+// 顔追跡の平滑化の重み(設定がない場合や範囲外の場合に使う)
+const DefaultTrackingSmoothing = 0.5
+
+// カレントディレクトリから親ディレクトリへconfig.iniを探す
+// (go testはパッケージのディレクトリで実行されるため)
+func findConfigFile(name string) string {
+	dir, err := os.Getwd()
+	if err != nil {
+		return name
+	}
+	for {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return name
+		}
+		dir = parent
+	}
+}
+
 func init() { // パッケージがimportされたタイミングで実行
-	cfg, err := ini.Load("config.ini")
+	cfg, err := ini.Load(findConfigFile("config.ini"))
 	if err != nil {
 		log.Printf("Failed to read: %v", err)
 		os.Exit(1)
 	}
+	drone := cfg.Section("drone")
+	video := cfg.Section("video")
+	safety := cfg.Section("safety")
+	watchdog := cfg.Section("watchdog")
+	geofence := cfg.Section("geofence")
+	tracking := cfg.Section("tracking")
+	detector := cfg.Section("detector")
+	target := cfg.Section("target")
+	recording := cfg.Section("recording")
 	Config = ConfList{
-		LogFile: cfg.Section("go_tello_edu").Key("log_file").String(),
-		Address: cfg.Section("web").Key("address").String(),
-		Port:    cfg.Section("web").Key("port").MustInt(),
+		LogFile:      cfg.Section("go_tello_edu").Key("log_file").String(),
+		FlightLogDir: cfg.Section("go_tello_edu").Key("flight_log_dir").MustString("flight_logs"),
+		MissionsDir:  cfg.Section("go_tello_edu").Key("missions_dir").MustString("missions"),
+		Address:      cfg.Section("web").Key("address").String(),
+		Port:         cfg.Section("web").Key("port").MustInt(),
+
+		DroneIP:                drone.Key("ip").MustString("192.168.10.1"),
+		DroneLocalPort:         drone.Key("local_port").MustInt(8888),
+		DroneVideoPort:         drone.Key("video_port").MustInt(11111),
+		DroneConnectTimeout:    time.Duration(drone.Key("connect_timeout").MustInt(5)) * time.Second,
+		DroneLostTimeout:       time.Duration(drone.Key("lost_timeout").MustInt(3)) * time.Second,
+		DroneReconnectInterval: time.Duration(drone.Key("reconnect_interval").MustInt(2)) * time.Second,
+
+		VideoDecoder:         video.Key("decoder").MustString("ffmpeg"),
+		FfmpegPath:           video.Key("ffmpeg_path").MustString("ffmpeg"),
+		FfmpegArgs:           strings.Fields(video.Key("ffmpeg_args").String()),
+		VideoHwaccel:         video.Key("hwaccel").MustString("auto"),
+		VideoHwaccelDevice:   video.Key("hwaccel_device").String(),
+		VideoLogLevel:        video.Key("log_level").MustString("error"),
+		VideoWidth:           video.Key("width").MustInt(320),
+		VideoHeight:          video.Key("height").MustInt(240),
+		VideoRestartInterval: time.Duration(video.Key("restart_interval").MustFloat64(2) * float64(time.Second)),
+		VideoStallTimeout:    time.Duration(video.Key("stall_timeout").MustFloat64(3) * float64(time.Second)),
+
+		SafetyBatteryWarn:       safety.Key("battery_warn").MustInt(30),
+		SafetyBatteryHover:      safety.Key("battery_hover").MustInt(15),
+		SafetyBatteryLand:       safety.Key("battery_land").MustInt(10),
+		SafetyTakeOffMinBattery: safety.Key("takeoff_min_battery").MustInt(20),
+		SafetyLostLinkAction:    safety.Key("lost_link_action").In("hover", []string{"none", "warn", "hover", "land"}),
+		EmergencyLockout:        time.Duration(safety.Key("emergency_lockout").MustInt(3)) * time.Second,
+
+		GeofenceMaxHeight:   geofence.Key("max_height").MustFloat64(3),
+		GeofenceMaxRadius:   geofence.Key("max_radius").MustFloat64(5),
+		GeofenceBoxNorth:    geofence.Key("box_north").MustFloat64(0),
+		GeofenceBoxEast:     geofence.Key("box_east").MustFloat64(0),
+		GeofenceMargin:      geofence.Key("margin").MustFloat64(0.5),
+		GeofenceReturnSpeed: geofence.Key("return_speed").MustInt(20),
+
+		WatchdogTimeout: time.Duration(watchdog.Key("timeout").MustFloat64(3) * float64(time.Second)),
+		WatchdogLand:    watchdog.Key("land").MustBool(false),
+
+		LeaderboardFile: cfg.Section("go_tello_edu").Key("leaderboard_file").MustString("leaderboard.json"),
+
+		ControlManualHold: time.Duration(cfg.Section("control").Key("manual_hold").MustFloat64(3) * float64(time.Second)),
+
+		TrackingYaw:        tracking.Key("yaw").MustBool(false),
+		TrackingXKp:        tracking.Key("x_kp").MustFloat64(40),
+		TrackingXKi:        tracking.Key("x_ki").MustFloat64(0),
+		TrackingXKd:        tracking.Key("x_kd").MustFloat64(10),
+		TrackingYKp:        tracking.Key("y_kp").MustFloat64(40),
+		TrackingYKi:        tracking.Key("y_ki").MustFloat64(0),
+		TrackingYKd:        tracking.Key("y_kd").MustFloat64(10),
+		TrackingDistanceKp: tracking.Key("distance_kp").MustFloat64(20),
+		TrackingDistanceKi: tracking.Key("distance_ki").MustFloat64(0),
+		TrackingDistanceKd: tracking.Key("distance_kd").MustFloat64(5),
+		TrackingTargetArea: tracking.Key("target_area").MustFloat64(10),
+		TrackingMaxSpeed:   tracking.Key("max_speed").MustInt(30),
+		TrackingMaxStep:    tracking.Key("max_step").MustInt(10),
+		TrackingSmoothing:  tracking.Key("smoothing").MustFloat64(DefaultTrackingSmoothing),
+		TrackingDeadband:   tracking.Key("deadband").MustFloat64(0.1),
+
+		DetectorType:          detector.Key("type").In("haar", []string{"haar", "dnn", "color"}),
+		DetectorModelsDir:     detector.Key("models_dir").MustString("models"),
+		DetectorHaarCascade:   detector.Key("haar_cascade").MustString("app/models/haarcascade_frontalface_default.xml"),
+		DetectorHaarLabel:     detector.Key("haar_label").MustString("Human"),
+		DetectorDNNKind:       detector.Key("dnn_kind").In("ssd", []string{"ssd", "yolo"}),
+		DetectorDNNModel:      detector.Key("dnn_model").String(),
+		DetectorDNNConfig:     detector.Key("dnn_config").String(),
+		DetectorDNNLabels:     detector.Key("dnn_labels").String(),
+		DetectorDNNClasses:    detector.Key("dnn_classes").Ints(","),
+		DetectorDNNConfidence: detector.Key("dnn_confidence").MustFloat64(0.5),
+		DetectorDNNSize:       detector.Key("dnn_size").MustInt(0),
+		DetectorDNNScale:      detector.Key("dnn_scale").MustFloat64(0),
+		DetectorDNNMean:       detector.Key("dnn_mean").Float64s(","),
+		DetectorColorLower:    detector.Key("color_lower").Float64s(","),
+		DetectorColorUpper:    detector.Key("color_upper").Float64s(","),
+		DetectorColorMinArea:  detector.Key("color_min_area").MustFloat64(200),
+		DetectorColorLabel:    detector.Key("color_label").MustString("Marker"),
+
+		TargetMode:        target.Key("mode").In("detect", []string{"detect", "track"}),
+		TargetAlgorithm:   target.Key("algorithm").In("kcf", []string{"kcf", "csrt", "mil"}),
+		TargetRedetect:    time.Duration(target.Key("redetect_interval").MustFloat64(1) * float64(time.Second)),
+		TargetLostTimeout: time.Duration(target.Key("lost_timeout").MustFloat64(3) * float64(time.Second)),
+
+		RecordingDir:           recording.Key("dir").MustString("recordings"),
+		RecordingFrameRate:     recording.Key("framerate").MustFloat64(30),
+		RecordingAnnotated:     recording.Key("annotated").MustBool(false),
+		RecordingAnnotatedArgs: strings.Fields(recording.Key("annotated_args").String()),
+	}
+
+	// 平滑化は新しいフレームの重みなので0より大きく1以下
+	if s := Config.TrackingSmoothing; s <= 0 || s > 1 {
+		log.Printf("tracking smoothing=%v must be in (0, 1], using %v", s, DefaultTrackingSmoothing)
+		Config.TrackingSmoothing = DefaultTrackingSmoothing
 	}
 }
@@ -3,31 +3,12 @@ module udemy_drone/go_tello_edu
 go 1.16
 
 require (
-	github.com/bmizerany/pat v0.0.0-20210406213842-e4b6760bdd6f // indirect
-	github.com/cpuguy83/go-md2man/v2 v2.0.1 // indirect
-	github.com/donovanhide/eventsource v0.0.0-20210830082556-c59027999da0 // indirect
-	github.com/eclipse/paho.mqtt.golang v1.3.5 // indirect
-	github.com/go-ole/go-ole v1.2.6 // indirect
-	github.com/gobuffalo/uuid v2.0.5+incompatible // indirect
-	github.com/godbus/dbus/v5 v5.0.6 // indirect
 	github.com/gofrs/uuid v4.2.0+incompatible // indirect
 	github.com/hashicorp/errwrap v1.1.0 // indirect
 	github.com/hashicorp/go-multierror v1.1.1 // indirect
-	github.com/hybridgroup/mjpeg v0.0.0-20140228234708-4680f319790e // indirect
-	github.com/muka/go-bluetooth v0.0.0-20220201183156-3ac497e99331 // indirect
-	github.com/nats-io/nats.go v1.13.0 // indirect
-	github.com/sigurn/crc8 v0.0.0-20220107193325-2243fe600f9f // indirect
-	github.com/sirupsen/logrus v1.8.1 // indirect
-	github.com/urfave/cli v1.22.5 // indirect
-	github.com/veandco/go-sdl2 v0.4.12 // indirect
-	go.bug.st/serial v1.3.4 // indirect
-	gobot.io/x/gobot v1.15.1-0.20211114123147-40bf1710dddb // indirect
-	gocv.io/x/gocv v0.29.0 // indirect
-	golang.org/x/crypto v0.0.0-20220210151621-f4118a5b28e2 // indirect
-	golang.org/x/net v0.0.0-20220127200216-cd36cc0744dd // indirect
-	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
-	golang.org/x/sys v0.0.0-20220209214540-3681064d5158 // indirect
-	gopkg.in/ini.v1 v1.66.4 // indirect
-	periph.io/x/periph v3.6.8+incompatible // indirect
-	tinygo.org/x/bluetooth v0.4.0 // indirect
+	github.com/hybridgroup/mjpeg v0.0.0-20140228234708-4680f319790e
+	github.com/stretchr/testify v1.7.0 // indirect
+	gobot.io/x/gobot v1.15.1-0.20211114123147-40bf1710dddb
+	gocv.io/x/gocv v0.29.0
+	gopkg.in/ini.v1 v1.66.4
 )
@@ -2,6 +2,9 @@ package main
 
 import (
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 	"udemy_drone/go_tello_edu/app/controllers"
 	"udemy_drone/go_tello_edu/config"
 	"udemy_drone/go_tello_edu/utils"
@@ -21,5 +24,13 @@ func main() {
 	// droneManager.Land()
 
 	utils.LoggingSettings(config.Config.LogFile)
+	// Ctrl+Cなどで終了する場合も録画を保存する
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		log.Printf("action=main signal=%s", <-sig)
+		controllers.Shutdown()
+		os.Exit(0)
+	}()
 	log.Println(controllers.StartWebServer())
 }
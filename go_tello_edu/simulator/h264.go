@@ -0,0 +1,219 @@
+package main
+
+// 外部エンコーダーを使わずにH.264(Baseline)のストリームを作成する
+// 全マクロブロックをI_PCM(非圧縮)で書き出すため、画質の劣化はないがデータ量は大きい
+// ffmpegなどのデコーダーで普通のH.264として読み込める
+
+const (
+	nalSlice = 5 // IDRスライス
+	nalSPS   = 7
+	nalPPS   = 8
+
+	mbTypeIPCM = 25
+)
+
+type bitWriter struct {
+	buf []byte
+	cur byte
+	n   uint
+}
+
+func (w *bitWriter) writeBit(b uint) {
+	w.cur = w.cur<<1 | byte(b&1)
+	w.n++
+	if w.n == 8 {
+		w.buf = append(w.buf, w.cur)
+		w.cur, w.n = 0, 0
+	}
+}
+
+func (w *bitWriter) writeBits(v uint64, n int) {
+	for i := n - 1; i >= 0; i-- {
+		w.writeBit(uint(v >> uint(i)))
+	}
+}
+
+// 符号なし指数ゴロム符号
+func (w *bitWriter) writeUE(v uint) {
+	v++
+	length := 0
+	for t := v; t > 0; t >>= 1 {
+		length++
+	}
+	w.writeBits(0, length-1)
+	w.writeBits(uint64(v), length)
+}
+
+// 符号付き指数ゴロム符号
+func (w *bitWriter) writeSE(v int) {
+	if v <= 0 {
+		w.writeUE(uint(-2 * v))
+	} else {
+		w.writeUE(uint(2*v - 1))
+	}
+}
+
+func (w *bitWriter) byteAligned() bool {
+	return w.n == 0
+}
+
+// rbsp_trailing_bits
+func (w *bitWriter) writeTrailingBits() {
+	w.writeBit(1)
+	for !w.byteAligned() {
+		w.writeBit(0)
+	}
+}
+
+func (w *bitWriter) bytes() []byte {
+	return w.buf
+}
+
+// 0x000000~0x000003の並びが出ないようにエミュレーション防止バイトを挿入する
+func escapeRBSP(rbsp []byte) []byte {
+	out := make([]byte, 0, len(rbsp)+len(rbsp)/64)
+	zeros := 0
+	for _, b := range rbsp {
+		if zeros >= 2 && b <= 3 {
+			out = append(out, 3)
+			zeros = 0
+		}
+		out = append(out, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return out
+}
+
+func appendNAL(dst []byte, refIdc, nalType byte, rbsp []byte) []byte {
+	dst = append(dst, 0, 0, 0, 1, refIdc<<5|nalType)
+	return append(dst, escapeRBSP(rbsp)...)
+}
+
+// YUV 4:2:0の1フレーム
+type yuvFrame struct {
+	width, height int
+	y, cb, cr     []byte
+}
+
+func newYUVFrame(width, height int) *yuvFrame {
+	return &yuvFrame{
+		width:  width,
+		height: height,
+		y:      make([]byte, width*height),
+		cb:     make([]byte, width*height/4),
+		cr:     make([]byte, width*height/4),
+	}
+}
+
+type h264Encoder struct {
+	width, height int
+	idrPicID      uint
+}
+
+// width, heightは16の倍数であること
+func newH264Encoder(width, height int) *h264Encoder {
+	return &h264Encoder{width: width, height: height}
+}
+
+func (e *h264Encoder) sps() []byte {
+	w := &bitWriter{}
+	w.writeBits(66, 8)   // profile_idc: Baseline
+	w.writeBits(0xc0, 8) // constraint_set0_flag, constraint_set1_flag
+	w.writeBits(40, 8)   // level_idc: 4.0
+	w.writeUE(0)         // seq_parameter_set_id
+	w.writeUE(0)         // log2_max_frame_num_minus4
+	w.writeUE(2)         // pic_order_cnt_type
+	w.writeUE(1)         // max_num_ref_frames
+	w.writeBit(0)        // gaps_in_frame_num_value_allowed_flag
+	w.writeUE(uint(e.width/16 - 1))
+	w.writeUE(uint(e.height/16 - 1))
+	w.writeBit(1) // frame_mbs_only_flag
+	w.writeBit(1) // direct_8x8_inference_flag
+	w.writeBit(0) // frame_cropping_flag
+	w.writeBit(0) // vui_parameters_present_flag
+	w.writeTrailingBits()
+	return w.bytes()
+}
+
+func (e *h264Encoder) pps() []byte {
+	w := &bitWriter{}
+	w.writeUE(0)      // pic_parameter_set_id
+	w.writeUE(0)      // seq_parameter_set_id
+	w.writeBit(0)     // entropy_coding_mode_flag: CAVLC
+	w.writeBit(0)     // bottom_field_pic_order_in_frame_present_flag
+	w.writeUE(0)      // num_slice_groups_minus1
+	w.writeUE(0)      // num_ref_idx_l0_default_active_minus1
+	w.writeUE(0)      // num_ref_idx_l1_default_active_minus1
+	w.writeBit(0)     // weighted_pred_flag
+	w.writeBits(0, 2) // weighted_bipred_idc
+	w.writeSE(0)      // pic_init_qp_minus26
+	w.writeSE(0)      // pic_init_qs_minus26
+	w.writeSE(0)      // chroma_qp_index_offset
+	w.writeBit(1)     // deblocking_filter_control_present_flag
+	w.writeBit(0)     // constrained_intra_pred_flag
+	w.writeBit(0)     // redundant_pic_cnt_present_flag
+	w.writeTrailingBits()
+	return w.bytes()
+}
+
+// PCMサンプルは0を避ける
+func pcmSample(v byte) uint64 {
+	if v == 0 {
+		return 1
+	}
+	return uint64(v)
+}
+
+func (e *h264Encoder) slice(f *yuvFrame) []byte {
+	w := &bitWriter{buf: make([]byte, 0, f.width*f.height*3/2+f.width*f.height/256*2+16)}
+	w.writeUE(0)          // first_mb_in_slice
+	w.writeUE(7)          // slice_type: I (全スライス)
+	w.writeUE(0)          // pic_parameter_set_id
+	w.writeBits(0, 4)     // frame_num
+	w.writeUE(e.idrPicID) // idr_pic_id
+	w.writeBit(0)         // no_output_of_prior_pics_flag
+	w.writeBit(0)         // long_term_reference_flag
+	w.writeSE(0)          // slice_qp_delta
+	w.writeUE(1)          // disable_deblocking_filter_idc
+
+	mbWidth, mbHeight := f.width/16, f.height/16
+	for mby := 0; mby < mbHeight; mby++ {
+		for mbx := 0; mbx < mbWidth; mbx++ {
+			w.writeUE(mbTypeIPCM)
+			for !w.byteAligned() {
+				w.writeBit(0) // pcm_alignment_zero_bit
+			}
+			for y := 0; y < 16; y++ {
+				row := (mby*16+y)*f.width + mbx*16
+				for x := 0; x < 16; x++ {
+					w.writeBits(pcmSample(f.y[row+x]), 8)
+				}
+			}
+			for _, plane := range [][]byte{f.cb, f.cr} {
+				for y := 0; y < 8; y++ {
+					row := (mby*8+y)*f.width/2 + mbx*8
+					for x := 0; x < 8; x++ {
+						w.writeBits(pcmSample(plane[row+x]), 8)
+					}
+				}
+			}
+		}
+	}
+	w.writeTrailingBits()
+	return w.bytes()
+}
+
+// SPS/PPSを含むAnnex B形式のIDRフレームを返す
+func (e *h264Encoder) encode(f *yuvFrame) []byte {
+	var out []byte
+	out = appendNAL(out, 3, nalSPS, e.sps())
+	out = appendNAL(out, 3, nalPPS, e.pps())
+	out = appendNAL(out, 3, nalSlice, e.slice(f))
+	// 連続するIDRピクチャはidr_pic_idを変える必要がある
+	e.idrPicID = (e.idrPicID + 1) % 2
+	return out
+}
@@ -0,0 +1,194 @@
+// What it does:
+//
+// Telloの代わりにgobotのtelloドライバーと通信するUDPシミュレーター
+// conn_req、スティックコマンド、離陸/着陸、フリップ、ビデオ開始を受け付け、
+// 位置・姿勢・バッテリーを計算してFlightDataと合成したH.264映像を送り返す
+//
+// How to run:
+//
+//	go run ./simulator -addr 127.0.0.1:8889
+//
+// go_tello_eduのconfig.iniでドローンのIPを127.0.0.1にすれば
+// 実機なしでアプリ全体を動かせる
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	addr       = flag.String("addr", "0.0.0.0:8889", "コマンドを受け付けるUDPアドレス")
+	fps        = flag.Int("fps", 10, "映像のフレームレート")
+	width      = flag.Int("width", 320, "映像の幅(16の倍数)")
+	height     = flag.Int("height", 240, "映像の高さ(16の倍数)")
+	battery    = flag.Float64("battery", 100, "バッテリー残量の初期値(%)")
+	statusRate = flag.Duration("status-interval", 100*time.Millisecond, "FlightDataの送信間隔")
+)
+
+type simulator struct {
+	conn  *net.UDPConn
+	state *droneState
+
+	mux       sync.Mutex
+	client    *net.UDPAddr
+	videoAddr *net.UDPAddr
+	videoOn   bool
+	seq       int16
+}
+
+func newSimulator(conn *net.UDPConn, state *droneState) *simulator {
+	return &simulator{conn: conn, state: state}
+}
+
+func (s *simulator) send(cmd uint16, pktType byte, payload []byte) {
+	s.mux.Lock()
+	client := s.client
+	s.seq++
+	seq := s.seq
+	s.mux.Unlock()
+	if client == nil {
+		return
+	}
+	if _, err := s.conn.WriteToUDP(createPacket(cmd, pktType, seq, payload), client); err != nil {
+		log.Println(err)
+	}
+}
+
+// コマンドを受信して処理する
+func (s *simulator) serve() {
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		b := buf[:n]
+
+		if videoPort, ok := parseConnRequest(b); ok {
+			s.mux.Lock()
+			s.client = from
+			s.videoAddr = &net.UDPAddr{IP: from.IP, Port: videoPort}
+			s.mux.Unlock()
+			log.Printf("action=connect client=%s video_port=%d", from, videoPort)
+			if _, err := s.conn.WriteToUDP(append([]byte("conn_ack:"), b[len(connRequestPrefix):]...), from); err != nil {
+				log.Println(err)
+			}
+			continue
+		}
+
+		pkt, ok := parsePacket(b)
+		if !ok {
+			log.Printf("action=serve unknown packet=%x", b)
+			continue
+		}
+		s.handle(pkt)
+	}
+}
+
+func (s *simulator) handle(pkt packet) {
+	switch pkt.cmd {
+	case stickCommand:
+		if rx, ry, ly, lx, ok := parseStick(pkt.payload); ok {
+			s.state.setStick(rx, ry, ly, lx)
+		}
+	case takeoffCommand, throwtakeoffCommand:
+		log.Printf("action=takeOff accepted=%t", s.state.takeOff())
+		s.send(pkt.cmd, 0x68, []byte{0x00})
+	case landCommand, palmLandCommand:
+		log.Printf("action=land accepted=%t", s.state.land())
+		s.send(pkt.cmd, 0x68, []byte{0x00})
+	case flipCommand:
+		if len(pkt.payload) > 0 && s.state.isFlying() {
+			log.Printf("action=flip direction=%d", pkt.payload[0])
+		}
+		s.send(flipCommand, 0x70, []byte{0x00})
+	case videoStartCommand:
+		s.mux.Lock()
+		if !s.videoOn {
+			log.Println("action=startVideo")
+		}
+		s.videoOn = true
+		s.mux.Unlock()
+	case bounceCommand, exposureCommand, videoEncoderRateCommand, timeCommand:
+		s.send(pkt.cmd, 0x48, []byte{0x00})
+	default:
+		log.Printf("action=handle unknown command=0x%04x", pkt.cmd)
+	}
+}
+
+// 状態を更新してFlightDataとWiFiの情報を送信する
+func (s *simulator) runStatus() {
+	t := time.NewTicker(*statusRate)
+	defer t.Stop()
+	last := time.Now()
+	count := 0
+	for now := range t.C {
+		s.state.update(now.Sub(last).Seconds())
+		last = now
+		s.send(flightMessage, 0x48, encodeFlightData(s.state.flightData()))
+		count++
+		if count%10 == 0 {
+			s.send(wifiMessage, 0x48, []byte{90, 0})
+		}
+	}
+}
+
+// 合成映像をH.264にエンコードしてビデオポートに送信する
+func (s *simulator) runVideo() {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer conn.Close()
+
+	encoder := newH264Encoder(*width, *height)
+	frame := newYUVFrame(*width, *height)
+	t := time.NewTicker(time.Second / time.Duration(*fps))
+	defer t.Stop()
+	frameNo := 0
+	for range t.C {
+		s.mux.Lock()
+		videoOn, videoAddr := s.videoOn, s.videoAddr
+		s.mux.Unlock()
+		if !videoOn || videoAddr == nil {
+			continue
+		}
+		yaw, z := s.state.pose()
+		renderFrame(frame, frameNo, yaw, z)
+		for _, pkt := range splitVideoPackets(frameNo, encoder.encode(frame)) {
+			if _, err := conn.WriteToUDP(pkt, videoAddr); err != nil {
+				log.Println(err)
+				break
+			}
+		}
+		frameNo++
+	}
+}
+
+func main() {
+	flag.Parse()
+	if *width%16 != 0 || *height%16 != 0 || *fps <= 0 {
+		log.Fatalf("invalid video settings width=%d height=%d fps=%d", *width, *height, *fps)
+	}
+
+	udpAddr, err := net.ResolveUDPAddr("udp", *addr)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer conn.Close()
+	log.Printf("tello simulator listening on %s", conn.LocalAddr())
+
+	sim := newSimulator(conn, newDroneState(*battery))
+	go sim.runStatus()
+	go sim.runVideo()
+	sim.serve()
+}
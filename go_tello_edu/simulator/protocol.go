@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+
+	"gobot.io/x/gobot/platforms/dji/tello"
+)
+
+// gobotのtelloドライバーが利用しているメッセージID(バイト5,6)
+const (
+	messageStart = 0xcc
+
+	wifiMessage   = 0x001a
+	lightMessage  = 0x0035
+	flightMessage = 0x0056
+
+	videoEncoderRateCommand = 0x0020
+	videoStartCommand       = 0x0025
+	exposureCommand         = 0x0034
+	timeCommand             = 0x0046
+	stickCommand            = 0x0050
+	takeoffCommand          = 0x0054
+	landCommand             = 0x0055
+	flipCommand             = 0x005c
+	throwtakeoffCommand     = 0x005d
+	palmLandCommand         = 0x005e
+	bounceCommand           = 0x1053
+)
+
+const connRequestPrefix = "conn_req:"
+
+// ドローンから受信したパケット
+type packet struct {
+	cmd     uint16
+	payload []byte
+}
+
+// バイナリパケットを解析する
+// ヘッダー(9バイト) + ペイロード + CRC16(2バイト)
+func parsePacket(b []byte) (packet, bool) {
+	if len(b) < 11 || b[0] != messageStart {
+		return packet{}, false
+	}
+	size := int(binary.LittleEndian.Uint16(b[1:3]) >> 3)
+	if size > len(b) || size < 11 {
+		return packet{}, false
+	}
+	if tello.CalculateCRC8(b[0:3]) != b[3] {
+		return packet{}, false
+	}
+	if tello.CalculateCRC16(b[:size-2]) != binary.LittleEndian.Uint16(b[size-2:size]) {
+		return packet{}, false
+	}
+	return packet{
+		cmd:     uint16(b[6])<<8 | uint16(b[5]),
+		payload: b[9 : size-2],
+	}, true
+}
+
+// conn_req:<ビデオポート(リトルエンディアン2バイト)>を解析する
+func parseConnRequest(b []byte) (videoPort int, ok bool) {
+	if !strings.HasPrefix(string(b), connRequestPrefix) {
+		return 0, false
+	}
+	rest := b[len(connRequestPrefix):]
+	if len(rest) < 2 {
+		return 11111, true
+	}
+	return int(binary.LittleEndian.Uint16(rest[0:2])), true
+}
+
+// スティックコマンドのペイロードから-1.0~1.0の各軸の値を取り出す
+func parseStick(payload []byte) (rx, ry, ly, lx float64, ok bool) {
+	if len(payload) < 6 {
+		return 0, 0, 0, 0, false
+	}
+	var packed int64
+	for i := 0; i < 6; i++ {
+		packed |= int64(payload[i]) << (8 * uint(i))
+	}
+	axis := func(shift uint) float64 {
+		v := (float64(packed>>shift&0x7FF) - 1024) / 660
+		if v > 1 {
+			return 1
+		}
+		if v < -1 {
+			return -1
+		}
+		return v
+	}
+	return axis(0), axis(11), axis(22), axis(33), true
+}
+
+// gobotのcreatePacketと同じ形式でパケットを作成する
+func createPacket(cmd uint16, pktType byte, seq int16, payload []byte) []byte {
+	l := int16(len(payload) + 11)
+	buf := &bytes.Buffer{}
+	buf.WriteByte(messageStart)
+	binary.Write(buf, binary.LittleEndian, l<<3)
+	buf.WriteByte(tello.CalculateCRC8(buf.Bytes()[0:3]))
+	buf.WriteByte(pktType)
+	binary.Write(buf, binary.LittleEndian, cmd)
+	binary.Write(buf, binary.LittleEndian, seq)
+	buf.Write(payload)
+	binary.Write(buf, binary.LittleEndian, tello.CalculateCRC16(buf.Bytes()))
+	return buf.Bytes()
+}
+
+func boolBit(b bool, shift uint) byte {
+	if b {
+		return 1 << shift
+	}
+	return 0
+}
+
+// tello.Driver.ParseFlightDataで読み込める24バイトのペイロードを作成する
+func encodeFlightData(fd *tello.FlightData) []byte {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, fd.Height)
+	binary.Write(buf, binary.LittleEndian, fd.NorthSpeed)
+	binary.Write(buf, binary.LittleEndian, fd.EastSpeed)
+	binary.Write(buf, binary.LittleEndian, fd.VerticalSpeed)
+	binary.Write(buf, binary.LittleEndian, fd.FlyTime)
+	buf.WriteByte(boolBit(fd.ImuState, 0) | boolBit(fd.PressureState, 1) | boolBit(fd.DownVisualState, 2) |
+		boolBit(fd.PowerState, 3) | boolBit(fd.BatteryState, 4) | boolBit(fd.GravityState, 5) | boolBit(fd.WindState, 7))
+	binary.Write(buf, binary.LittleEndian, fd.ImuCalibrationState)
+	binary.Write(buf, binary.LittleEndian, fd.BatteryPercentage)
+	binary.Write(buf, binary.LittleEndian, fd.DroneFlyTimeLeft)
+	binary.Write(buf, binary.LittleEndian, fd.DroneBatteryLeft)
+	buf.WriteByte(boolBit(fd.Flying, 0) | boolBit(fd.OnGround, 1) | boolBit(fd.EmOpen, 2) | boolBit(fd.DroneHover, 3) |
+		boolBit(fd.OutageRecording, 4) | boolBit(fd.BatteryLow, 5) | boolBit(fd.BatteryLower, 6) | boolBit(fd.FactoryMode, 7))
+	binary.Write(buf, binary.LittleEndian, fd.FlyMode)
+	binary.Write(buf, binary.LittleEndian, fd.ThrowFlyTimer)
+	binary.Write(buf, binary.LittleEndian, fd.CameraState)
+	buf.WriteByte(byte(fd.ElectricalMachineryState))
+	buf.WriteByte(boolBit(fd.FrontIn, 0) | boolBit(fd.FrontOut, 1) | boolBit(fd.FrontLSC, 2))
+	buf.WriteByte(boolBit(fd.TemperatureHigh, 0))
+	return buf.Bytes()
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"math"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"gobot.io/x/gobot/platforms/dji/tello"
+)
+
+func testFlightData() *tello.FlightData {
+	return &tello.FlightData{
+		Height:                   12,
+		NorthSpeed:               -3,
+		EastSpeed:                4,
+		VerticalSpeed:            -5,
+		FlyTime:                  321,
+		ImuState:                 true,
+		DownVisualState:          true,
+		BatteryState:             true,
+		WindState:                true,
+		ImuCalibrationState:      2,
+		BatteryPercentage:        87,
+		DroneFlyTimeLeft:         500,
+		DroneBatteryLeft:         4100,
+		Flying:                   true,
+		DroneHover:               true,
+		BatteryLower:             true,
+		FactoryMode:              true,
+		FlyMode:                  6,
+		ThrowFlyTimer:            3,
+		CameraState:              1,
+		ElectricalMachineryState: 7,
+		FrontOut:                 true,
+		TemperatureHigh:          true,
+	}
+}
+
+func TestFlightDataRoundTrip(t *testing.T) {
+	want := testFlightData()
+	pkt, ok := parsePacket(createPacket(flightMessage, 0x48, 7, encodeFlightData(want)))
+	if !ok {
+		t.Fatal("parsePacket rejected our own packet")
+	}
+	if pkt.cmd != flightMessage {
+		t.Errorf("cmd = 0x%04x, want 0x%04x", pkt.cmd, flightMessage)
+	}
+	got, err := tello.NewDriver("0").ParseFlightData(pkt.payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("flight data = %+v, want %+v", got, want)
+	}
+}
+
+func TestParsePacketRejectsBroken(t *testing.T) {
+	valid := createPacket(landCommand, 0x68, 1, []byte{0x00})
+	corrupt := func(i int) []byte {
+		b := append([]byte{}, valid...)
+		b[i] ^= 0xff
+		return b
+	}
+	for name, b := range map[string][]byte{
+		"short":   valid[:10],
+		"start":   corrupt(0),
+		"crc8":    corrupt(3),
+		"payload": corrupt(9),
+		"crc16":   corrupt(len(valid) - 1),
+		"size":    valid[:len(valid)-1],
+	} {
+		if _, ok := parsePacket(b); ok {
+			t.Errorf("%s: parsePacket accepted %x", name, b)
+		}
+	}
+	if pkt, ok := parsePacket(valid); !ok || pkt.cmd != landCommand || !reflect.DeepEqual(pkt.payload, []byte{0x00}) {
+		t.Errorf("parsePacket(valid) = %+v, %t", pkt, ok)
+	}
+}
+
+// gobotのtelloドライバーとシミュレーターを実際にUDPでつないで、両方向のパケットを確認する
+// ドライバーはリクエスト先のポートが8889で固定なので、使えなければスキップする
+func TestSimulatorWithGobotDriver(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8889})
+	if err != nil {
+		t.Skip("port 8889 is not available: " + err.Error())
+	}
+	// gobotのドライバーはスティックコマンドの送信を止められないので、
+	// 接続はテストのプロセスが終わるまで開いたままにしておく
+	sim := newSimulator(conn, newDroneState(100))
+	go sim.serve()
+
+	driver := tello.NewDriverWithIP("127.0.0.1", "0")
+	events := func(name string) chan interface{} {
+		ch := make(chan interface{}, 16)
+		driver.On(driver.Event(name), func(data interface{}) {
+			select {
+			case ch <- data:
+			default:
+			}
+		})
+		return ch
+	}
+	timeSet := events(tello.TimeEvent)
+	takeoff := events(tello.TakeoffEvent)
+	flightData := events(tello.FlightDataEvent)
+	wait := func(what string, ch chan interface{}) interface{} {
+		select {
+		case data := <-ch:
+			return data
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %s", what)
+			return nil
+		}
+	}
+
+	if err := driver.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// conn_ackを受けるとドライバーは時刻を送ってくる
+	// その応答を待ってからコマンドを送る(時刻の送信中はcmdMutexを持っている)
+	wait("time response", timeSet)
+	driver.Forward(0)
+
+	// ドライバーからシミュレーター
+	if err := driver.TakeOff(); err != nil {
+		t.Fatal(err)
+	}
+	wait("takeoff response", takeoff)
+	if !sim.state.isFlying() {
+		t.Error("simulator did not accept the takeoff command")
+	}
+	driver.Forward(50)
+	driver.Left(25)
+	driver.Up(100)
+	driver.Clockwise(75)
+	want := [4]float64{-0.25, 0.5, 1, 0.75}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		sim.state.mux.Lock()
+		got := [4]float64{sim.state.rx, sim.state.ry, sim.state.ly, sim.state.lx}
+		sim.state.mux.Unlock()
+		matched := true
+		for i := range got {
+			// スティックの値は1/660刻みで送られる
+			if math.Abs(got[i]-want[i]) > 1.0/660 {
+				matched = false
+			}
+		}
+		if matched {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("stick = %v, want %v", got, want)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// シミュレーターからドライバー
+	fd := testFlightData()
+	sim.send(flightMessage, 0x48, encodeFlightData(fd))
+	if got := wait("flight data", flightData); !reflect.DeepEqual(got, fd) {
+		t.Errorf("flight data = %+v, want %+v", got, fd)
+	}
+}
+
+func TestParseConnRequest(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		port int
+		ok   bool
+	}{
+		{"conn_req:\x67\x2b", 11111, true},
+		{"conn_req:\x39\x30", 12345, true},
+		{"conn_req:", 11111, true},
+		{"command", 0, false},
+	} {
+		port, ok := parseConnRequest([]byte(tt.in))
+		if port != tt.port || ok != tt.ok {
+			t.Errorf("parseConnRequest(%q) = %d, %t, want %d, %t", tt.in, port, ok, tt.port, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"math"
+	"sync"
+
+	"gobot.io/x/gobot/platforms/dji/tello"
+)
+
+const (
+	maxHorizontalSpeed = 2.0               // m/s (スティック最大時)
+	maxVerticalSpeed   = 1.0               // m/s
+	maxYawRate         = 90.0              // deg/s
+	takeOffHeight      = 1.0               // m
+	landingSpeed       = 0.5               // m/s
+	flyingDrainRate    = 100.0 / (10 * 60) // %/s 約10分で空になる
+	idleDrainRate      = 100.0 / (60 * 60) // %/s
+	minTakeOffBattery  = 10.0
+)
+
+// シミュレーター上のドローンの状態
+type droneState struct {
+	mux sync.Mutex
+
+	// 離陸地点からの位置(m)と機首方位(deg)
+	x, y, z float64
+	yaw     float64
+	// ワールド座標系での速度(m/s)
+	north, east, vertical float64
+
+	// -1.0~1.0のスティック入力
+	rx, ry, ly, lx float64
+
+	flying    bool
+	takingOff bool
+	landing   bool
+	flyTime   float64
+	battery   float64
+}
+
+func newDroneState(battery float64) *droneState {
+	return &droneState{battery: battery}
+}
+
+func (s *droneState) setStick(rx, ry, ly, lx float64) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.rx, s.ry, s.ly, s.lx = rx, ry, ly, lx
+}
+
+func (s *droneState) takeOff() bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.flying || s.battery < minTakeOffBattery {
+		return false
+	}
+	s.flying = true
+	s.takingOff = true
+	s.landing = false
+	return true
+}
+
+func (s *droneState) land() bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if !s.flying {
+		return false
+	}
+	s.takingOff = false
+	s.landing = true
+	return true
+}
+
+func (s *droneState) isFlying() bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.flying
+}
+
+// dt秒分だけ状態を進める
+func (s *droneState) update(dt float64) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if !s.flying {
+		s.north, s.east, s.vertical = 0, 0, 0
+		s.battery = math.Max(0, s.battery-idleDrainRate*dt)
+		return
+	}
+
+	s.flyTime += dt
+	s.battery = math.Max(0, s.battery-flyingDrainRate*dt)
+	if s.battery == 0 && !s.landing {
+		s.landing = true
+	}
+
+	switch {
+	case s.takingOff:
+		s.north, s.east = 0, 0
+		s.vertical = maxVerticalSpeed
+		if s.z >= takeOffHeight {
+			s.takingOff = false
+			s.vertical = 0
+		}
+	case s.landing:
+		s.north, s.east = 0, 0
+		s.vertical = -landingSpeed
+	default:
+		s.yaw = math.Mod(s.yaw+s.lx*maxYawRate*dt+360, 360)
+		rad := s.yaw * math.Pi / 180
+		forward := s.ry * maxHorizontalSpeed
+		side := s.rx * maxHorizontalSpeed
+		s.north = forward*math.Cos(rad) - side*math.Sin(rad)
+		s.east = forward*math.Sin(rad) + side*math.Cos(rad)
+		s.vertical = s.ly * maxVerticalSpeed
+	}
+
+	s.x += s.north * dt
+	s.y += s.east * dt
+	s.z += s.vertical * dt
+	if s.z <= 0 {
+		s.z = 0
+		if s.landing || s.vertical < 0 {
+			s.flying = false
+			s.landing = false
+			s.north, s.east, s.vertical = 0, 0, 0
+		}
+	}
+}
+
+// 現在の状態からFlightDataを作成する
+// 高さ・速度の単位はTelloと同じくデシメートル
+func (s *droneState) flightData() *tello.FlightData {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	hovering := s.flying && s.rx == 0 && s.ry == 0 && s.ly == 0 && s.lx == 0
+	flyMode := int8(1)
+	if s.flying {
+		flyMode = 6
+	}
+	return &tello.FlightData{
+		Height:            int16(math.Round(s.z * 10)),
+		NorthSpeed:        int16(math.Round(s.north * 10)),
+		EastSpeed:         int16(math.Round(s.east * 10)),
+		VerticalSpeed:     int16(math.Round(s.vertical * 10)),
+		FlyTime:           int16(s.flyTime * 10),
+		ImuState:          true,
+		PressureState:     true,
+		DownVisualState:   true,
+		PowerState:        true,
+		BatteryState:      true,
+		GravityState:      true,
+		BatteryPercentage: int8(math.Ceil(s.battery)),
+		DroneBatteryLeft:  int16(3400 + s.battery*8),
+		DroneFlyTimeLeft:  int16(s.battery / flyingDrainRate),
+		Flying:            s.flying,
+		OnGround:          !s.flying,
+		EmOpen:            s.flying,
+		DroneHover:        hovering,
+		BatteryLow:        s.battery < 20,
+		BatteryLower:      s.battery < 10,
+		FlyMode:           flyMode,
+	}
+}
+
+// 映像の描画に使う位置と方位
+func (s *droneState) pose() (yaw, height float64) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.yaw, s.z
+}
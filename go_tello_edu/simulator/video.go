@@ -0,0 +1,85 @@
+package main
+
+import (
+	"math"
+)
+
+// カラーバーのYUV値(白,黄,シアン,緑,マゼンタ,赤,青,黒)
+var colorBars = [][3]byte{
+	{235, 128, 128},
+	{210, 16, 146},
+	{170, 166, 16},
+	{145, 54, 34},
+	{106, 202, 222},
+	{81, 90, 240},
+	{41, 240, 110},
+	{16, 128, 128},
+}
+
+// 合成映像を描画する
+// 機首方位に合わせてカラーバーが横に流れ、高さに合わせて白い四角が上下する
+func renderFrame(f *yuvFrame, frameNo int, yaw, height float64) {
+	barWidth := f.width / len(colorBars)
+	// 360度回転で画面8枚分ずれる
+	offset := int(yaw / 360 * float64(f.width*len(colorBars)))
+
+	boxSize := f.height / 6
+	boxX := (f.width - boxSize) / 2
+	boxY := f.height/2 - boxSize/2 + int(height*float64(f.height)/8)
+	if boxY < 0 {
+		boxY = 0
+	}
+	if boxY > f.height-boxSize {
+		boxY = f.height - boxSize
+	}
+
+	// フレームの進行が分かるように画面下部のバーを点滅させる
+	blink := byte(16)
+	if frameNo/5%2 == 0 {
+		blink = 235
+	}
+
+	for y := 0; y < f.height; y++ {
+		for x := 0; x < f.width; x++ {
+			bar := colorBars[((x+offset)/barWidth%len(colorBars)+len(colorBars))%len(colorBars)]
+			luma, cb, cr := bar[0], bar[1], bar[2]
+			if x >= boxX && x < boxX+boxSize && y >= boxY && y < boxY+boxSize {
+				luma, cb, cr = 235, 128, 128
+			}
+			if y >= f.height-8 && x < f.width*(frameNo%30+1)/30 {
+				luma, cb, cr = blink, 128, 128
+			}
+			// 上下にグラデーションをかけて位置が分かりやすいようにする
+			shade := 1 - 0.3*math.Abs(float64(y)/float64(f.height)-0.5)
+			f.y[y*f.width+x] = byte(float64(luma) * shade)
+			if x%2 == 0 && y%2 == 0 {
+				f.cb[y/2*f.width/2+x/2] = cb
+				f.cr[y/2*f.width/2+x/2] = cr
+			}
+		}
+	}
+}
+
+// 1つのUDPパケットに載せるH.264データの最大サイズ
+const videoChunkSize = 1400
+
+// Telloと同じく先頭2バイトのヘッダーを付けてUDPパケットに分割する
+// (gobotはbuf[2:]をVideoFrameEventとして通知する)
+func splitVideoPackets(frameNo int, data []byte) [][]byte {
+	var pkts [][]byte
+	for i := 0; i*videoChunkSize < len(data); i++ {
+		end := (i + 1) * videoChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		idx := byte(i & 0x7f)
+		if end == len(data) {
+			idx |= 0x80
+		}
+		pkt := make([]byte, 0, end-i*videoChunkSize+2)
+		pkt = append(pkt, byte(frameNo), idx)
+		pkt = append(pkt, data[i*videoChunkSize:end]...)
+		pkts = append(pkts, pkt)
+	}
+	return pkts
+}